@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksTTL is how long fetched keys are trusted before refetching
+	jwksTTL = 10 * time.Minute
+
+	// jwksMinRefresh limits refetches triggered by unknown key IDs
+	jwksMinRefresh = 30 * time.Second
+)
+
+// jwk is a single entry of a JSON Web Key Set
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the public keys published at a JWKS URL
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	inflight    *refresh // the fetch in progress, shared by every waiting caller
+}
+
+// refresh is a single JWKS fetch; err is set before done is closed
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+func newKeySet(url string) *keySet {
+	return &keySet{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		keys:   make(map[string]interface{}),
+	}
+}
+
+// key returns the public key for kid, refreshing the set when it is stale or
+// the kid is unknown. The fetch runs without holding the lock, so requests
+// with known keys are not held up by a slow JWKS endpoint, and concurrent
+// misses share one fetch.
+func (s *keySet) key(kid string) (interface{}, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	fresh := time.Since(s.fetchedAt) < jwksTTL
+	if ok && fresh {
+		s.mu.Unlock()
+		return key, nil
+	}
+
+	r := s.inflight
+	if r == nil && (time.Since(s.lastAttempt) >= jwksMinRefresh || !fresh) {
+		r = &refresh{done: make(chan struct{})}
+		s.inflight = r
+		s.lastAttempt = time.Now()
+		s.mu.Unlock()
+		s.refresh(r)
+	} else {
+		s.mu.Unlock()
+	}
+
+	if r != nil {
+		<-r.done
+		if r.err != nil {
+			// Keep using keys we already have rather than failing every request
+			if ok {
+				return key, nil
+			}
+			return nil, errKeyUnavailable
+		}
+	}
+
+	s.mu.Lock()
+	key, ok = s.keys[kid]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errKeyUnavailable
+	}
+	return key, nil
+}
+
+// refresh fetches the key set and swaps it in, then releases everyone
+// waiting on r
+func (s *keySet) refresh(r *refresh) {
+	keys, err := s.fetch()
+	if err != nil {
+		log.Printf("JWKS refresh failed: %v", err)
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys = keys
+		s.fetchedAt = time.Now()
+	}
+	s.inflight = nil
+	s.mu.Unlock()
+
+	r.err = err
+	close(r.done)
+}
+
+func (s *keySet) fetch() (map[string]interface{}, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWK %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA or P-256 EC key
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// age makes the key set look like it was last fetched d ago
+func age(s *keySet, d time.Duration) {
+	s.mu.Lock()
+	s.fetchedAt = s.fetchedAt.Add(-d)
+	s.lastAttempt = s.lastAttempt.Add(-d)
+	s.mu.Unlock()
+}
+
+func TestKeySetRefreshesOnUnknownKid(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.add("k1", &rsaKey(t).PublicKey)
+	s := newKeySet(srv.URL)
+
+	if _, err := s.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.hits.Load() != 1 {
+		t.Fatalf("got %d fetches for a cached key, want 1", srv.hits.Load())
+	}
+
+	// A kid the server starts publishing is picked up, but refetches for
+	// unknown kids are rate limited
+	srv.add("k2", &ecKey(t).PublicKey)
+	if _, err := s.key("k2"); err != errKeyUnavailable {
+		t.Fatalf("got %v right after a fetch, want errKeyUnavailable", err)
+	}
+	if srv.hits.Load() != 1 {
+		t.Fatalf("got %d fetches within jwksMinRefresh, want 1", srv.hits.Load())
+	}
+
+	age(s, jwksMinRefresh)
+	if _, err := s.key("k2"); err != nil {
+		t.Fatalf("got %v for a newly published kid", err)
+	}
+	if _, err := s.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.hits.Load() != 2 {
+		t.Errorf("got %d fetches, want 2", srv.hits.Load())
+	}
+}
+
+func TestKeySetRefetchesStaleKeys(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.add("k1", &rsaKey(t).PublicKey)
+	s := newKeySet(srv.URL)
+
+	if _, err := s.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	age(s, jwksTTL)
+	if _, err := s.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.hits.Load() != 2 {
+		t.Errorf("got %d fetches after the TTL, want 2", srv.hits.Load())
+	}
+}
+
+func TestKeySetKeepsKeysWhenRefreshFails(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.add("k1", &rsaKey(t).PublicKey)
+	s := newKeySet(srv.URL)
+
+	if _, err := s.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.setFailing(true)
+	age(s, jwksTTL)
+	if _, err := s.key("k1"); err != nil {
+		t.Errorf("got %v for a known key while the JWKS is down", err)
+	}
+	age(s, jwksMinRefresh)
+	if _, err := s.key("unknown"); err != errKeyUnavailable {
+		t.Errorf("got %v for an unknown key while the JWKS is down, want errKeyUnavailable", err)
+	}
+	if srv.hits.Load() != 3 {
+		t.Errorf("got %d fetches, want 3", srv.hits.Load())
+	}
+}
+
+func TestKeySetSharesOneFetch(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.add("new", &rsaKey(t).PublicKey)
+	release := make(chan struct{})
+	srv.release = release
+
+	s := newKeySet(srv.URL)
+	s.keys["cached"] = &rsaKey(t).PublicKey
+	s.fetchedAt = time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.key("new")
+			errs <- err
+		}()
+	}
+
+	// Known keys are served while the fetch is stuck
+	for srv.hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := s.key("cached")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got %v for a cached key", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("a cached key waited on the JWKS fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("got %v for the fetched key", err)
+		}
+	}
+	if srv.hits.Load() != 1 {
+		t.Errorf("got %d fetches for concurrent misses, want 1", srv.hits.Load())
+	}
+}
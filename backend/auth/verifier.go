@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Verifier checks Supabase access tokens without calling GoTrue
+type Verifier struct {
+	cfg  Config
+	jwks *keySet
+}
+
+// NewVerifier creates a verifier from the middleware config
+func NewVerifier(cfg Config) *Verifier {
+	v := &Verifier{cfg: cfg}
+	if cfg.JWKSURL != "" {
+		v.jwks = newKeySet(cfg.JWKSURL)
+	}
+	return v
+}
+
+// Verify validates the token's signature and expiry and returns its claims.
+// When the token cannot be checked locally and fallback is enabled, GoTrue
+// is asked instead.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims, err := v.verifyLocal(token)
+	if err == nil {
+		return claims, nil
+	}
+
+	if errors.Is(err, errKeyUnavailable) && v.cfg.FallbackToGoTrue && v.cfg.AuthClient != nil {
+		return v.verifyRemote(token)
+	}
+	return nil, err
+}
+
+func (v *Verifier) verifyLocal(token string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		jwt.WithExpirationRequired(),
+	}
+	if v.cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(v.cfg.Audience))
+	}
+
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(token, claims, v.key, options...); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("auth: token has no subject")
+	}
+	return claims, nil
+}
+
+// key picks the verification key for a token based on its algorithm
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case "HS256":
+		if v.cfg.JWTSecret == "" {
+			return nil, errKeyUnavailable
+		}
+		return []byte(v.cfg.JWTSecret), nil
+
+	default:
+		if v.jwks == nil {
+			return nil, errKeyUnavailable
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.jwks.key(kid)
+	}
+}
+
+// verifyRemote asks GoTrue who the token belongs to
+func (v *Verifier) verifyRemote(token string) (*Claims, error) {
+	user, err := v.cfg.AuthClient.WithToken(token).GetUser()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{
+		Email:        user.Email,
+		Phone:        user.Phone,
+		Role:         user.Role,
+		AppMetadata:  user.AppMetadata,
+		UserMetadata: user.UserMetadata,
+	}
+	claims.Subject = user.ID.String()
+	return claims, nil
+}
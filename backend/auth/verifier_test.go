@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/supabase-community/gotrue-go"
+)
+
+const testSecret = "test-jwt-secret"
+
+// jwksServer publishes a key set and counts how often it is fetched
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jwk
+	failing bool
+	release chan struct{} // when set, requests wait for it to close
+
+	hits atomic.Int32
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+		s.mu.Lock()
+		keys, failing, release := s.keys, s.failing, s.release
+		s.mu.Unlock()
+
+		if release != nil {
+			<-release
+		}
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// add publishes an RSA or EC public key under kid
+func (s *jwksServer) add(kid string, key interface{}) {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var k jwk
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		k = jwk{Kid: kid, Kty: "RSA", Use: "sig", N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		k = jwk{Kid: kid, Kty: "EC", Crv: "P-256", X: encode(key.X.FillBytes(make([]byte, 32))), Y: encode(key.Y.FillBytes(make([]byte, 32)))}
+	}
+
+	s.mu.Lock()
+	s.keys = append(s.keys, k)
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func ecKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// claims returns the claims of a valid Supabase token, with overrides applied
+func claims(overrides jwt.MapClaims) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"sub":  "user-1",
+		"aud":  "authenticated",
+		"role": "authenticated",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(c, k)
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, c jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, c)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	rsaPriv, ecPriv, otherRSA := rsaKey(t), ecKey(t), rsaKey(t)
+	jwks := newJWKSServer(t)
+	jwks.add("rsa-1", &rsaPriv.PublicKey)
+	jwks.add("ec-1", &ecPriv.PublicKey)
+
+	// The RSA public key as an attacker would use it for an HMAC secret
+	der, err := x509.MarshalPKIXPublicKey(&rsaPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	v := NewVerifier(Config{JWTSecret: testSecret, JWKSURL: jwks.URL, Audience: "authenticated"})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"HS256", sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(nil)), false},
+		{"RS256", sign(t, jwt.SigningMethodRS256, rsaPriv, "rsa-1", claims(nil)), false},
+		{"ES256", sign(t, jwt.SigningMethodES256, ecPriv, "ec-1", claims(nil)), false},
+
+		{"HS256 with the wrong secret", sign(t, jwt.SigningMethodHS256, []byte("other"), "", claims(nil)), true},
+		{"RS256 signed by another key", sign(t, jwt.SigningMethodRS256, otherRSA, "rsa-1", claims(nil)), true},
+		{"ES256 under an RSA kid", sign(t, jwt.SigningMethodES256, ecPriv, "rsa-1", claims(nil)), true},
+		{"HS256 signed with the RSA public key", sign(t, jwt.SigningMethodHS256, rsaPEM, "rsa-1", claims(nil)), true},
+		{"alg none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims(nil)), true},
+		{"RS384", sign(t, jwt.SigningMethodRS384, rsaPriv, "rsa-1", claims(nil)), true},
+
+		{"wrong audience", sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(jwt.MapClaims{"aud": "anon"})), true},
+		{"expired", sign(t, jwt.SigningMethodRS256, rsaPriv, "rsa-1", claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), true},
+		{"no expiry", sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(jwt.MapClaims{"exp": nil})), true},
+		{"no subject", sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(jwt.MapClaims{"sub": nil})), true},
+		{"malformed", "not.a.token", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Verify(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got claims for %s, want an error", got.Subject)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if got.Subject != "user-1" || got.Role != "authenticated" {
+				t.Errorf("got subject %q role %q", got.Subject, got.Role)
+			}
+		})
+	}
+}
+
+func TestVerifyAlgConfusionWithoutSecret(t *testing.T) {
+	rsaPriv := rsaKey(t)
+	jwks := newJWKSServer(t)
+	jwks.add("rsa-1", &rsaPriv.PublicKey)
+
+	der, err := x509.MarshalPKIXPublicKey(&rsaPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With no HS256 secret configured, an HMAC token must not be checked
+	// against the RSA key it names
+	v := NewVerifier(Config{JWKSURL: jwks.URL})
+	for _, secret := range [][]byte{der, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})} {
+		if _, err := v.Verify(sign(t, jwt.SigningMethodHS256, secret, "rsa-1", claims(nil))); err == nil {
+			t.Error("got claims for an HS256 token signed with the RSA public key")
+		}
+	}
+}
+
+// goTrue serves GET /user for one token and counts the lookups
+func goTrue(t *testing.T, token, userID string) (gotrue.Client, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/user" || r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    userID,
+			"email": "user@example.com",
+			"role":  "authenticated",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return gotrue.New("test", "anon").WithCustomGoTrueURL(srv.URL), &hits
+}
+
+func TestVerifyGoTrueFallback(t *testing.T) {
+	const userID = "9f5a8d2e-1c4b-4e7a-8f3d-2b6c1a0e9d47"
+	rsaPriv := rsaKey(t)
+	jwks := newJWKSServer(t)
+	jwks.add("rsa-1", &rsaPriv.PublicKey)
+
+	// Signed with a key the JWKS does not publish, e.g. one rotated in
+	// before the cache caught up
+	unknownKid := sign(t, jwt.SigningMethodRS256, rsaKey(t), "rotated", claims(nil))
+	badSignature := sign(t, jwt.SigningMethodRS256, rsaKey(t), "rsa-1", claims(nil))
+	expired := sign(t, jwt.SigningMethodRS256, rsaPriv, "rsa-1", claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}))
+
+	tests := []struct {
+		name     string
+		fallback bool
+		token    string
+		wantErr  bool
+		wantHits int32
+	}{
+		{"key unavailable with fallback", true, unknownKid, false, 1},
+		{"key unavailable without fallback", false, unknownKid, true, 0},
+		{"bad signature is not retried", true, badSignature, true, 0},
+		{"expired token is not retried", true, expired, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, hits := goTrue(t, tt.token, userID)
+			v := NewVerifier(Config{
+				JWKSURL:          jwks.URL,
+				Audience:         "authenticated",
+				FallbackToGoTrue: tt.fallback,
+				AuthClient:       client,
+			})
+
+			got, err := v.Verify(tt.token)
+			if hits.Load() != tt.wantHits {
+				t.Errorf("GoTrue was asked %d times, want %d", hits.Load(), tt.wantHits)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got claims for %s, want an error", got.Subject)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if got.Subject != userID || got.Email != "user@example.com" {
+				t.Errorf("got subject %q email %q from GoTrue", got.Subject, got.Email)
+			}
+		})
+	}
+}
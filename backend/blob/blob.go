@@ -0,0 +1,139 @@
+// Package blob stores binary objects such as voicemail recordings under
+// slash-separated keys. Disk keeps them in a local directory; other backends
+// only need to implement Store.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNotFound   = errors.New("blob: not found")
+	ErrInvalidKey = errors.New("blob: invalid key")
+)
+
+// Store keeps blobs by key
+type Store interface {
+	// Put stores the content of r under key, replacing any earlier blob,
+	// and returns the number of bytes written
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Open returns the blob under key and its size
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Delete removes the blob under key. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Disk stores each blob as a file below a directory. A blob only appears
+// under its key once it is completely written.
+type Disk struct {
+	dir string
+}
+
+var _ Store = (*Disk)(nil)
+
+// NewDisk stores blobs in dir, creating it if needed
+func NewDisk(dir string) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("blob: %w", err)
+	}
+	return &Disk{dir: dir}, nil
+}
+
+func (d *Disk) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, fmt.Errorf("blob: %w", err)
+	}
+
+	// Written next to its final name so the rename stays on one filesystem
+	f, err := os.CreateTemp(filepath.Dir(path), ".blob-*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("blob: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("blob: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, fmt.Errorf("blob: %w", err)
+	}
+	return n, nil
+}
+
+func (d *Disk) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("blob: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("blob: %w", err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, 0, ErrNotFound
+	}
+	return f, info.Size(), nil
+}
+
+func (d *Disk) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("blob: %w", err)
+	}
+	return nil
+}
+
+// path maps a key to its file. Every segment of the key must be a plain name
+// of letters, digits, '-', '_' and '.', not starting with a dot, so keys can
+// neither escape the directory nor collide with temporary files.
+func (d *Disk) path(key string) (string, error) {
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment[0] == '.' {
+			return "", ErrInvalidKey
+		}
+		for _, r := range segment {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			default:
+				return "", ErrInvalidKey
+			}
+		}
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,382 @@
+// Package calls models one-to-one call sessions and group call rooms. A
+// Session only moves along the transitions listed in the transition table,
+// and only when the event comes from a participant allowed to trigger it. A
+// Room only tracks who takes part in a group call.
+package calls
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownCall       = errors.New("calls: unknown call")
+	ErrCallExists        = errors.New("calls: call ID already in use")
+	ErrNotParticipant    = errors.New("calls: not a participant of the call")
+	ErrInvalidTransition = errors.New("calls: event not allowed in this state")
+	ErrBufferFull        = errors.New("calls: candidate buffer full")
+)
+
+// Limits of the ICE candidates buffered while a call rings
+const (
+	MaxEarlyCandidates     = 64
+	MaxEarlyCandidateBytes = 32 * 1024
+)
+
+// State of a call session
+type State string
+
+const (
+	StateRinging State = "ringing" // offer delivered, callee devices ringing
+	StateActive  State = "active"  // answered, pinned to one device on each side
+	StateEnded   State = "ended"
+)
+
+// Event is something that happens to a call
+type Event string
+
+const (
+	EventAnswer       Event = "answer"
+	EventIceCandidate Event = "ice-candidate"
+	EventEnd          Event = "end"
+	EventDecline      Event = "decline"     // callee turns down a ringing call
+	EventCancel       Event = "cancel"      // caller gives up before an answer
+	EventTimeout      Event = "timeout"     // nobody answered in time
+	EventRenegotiate  Event = "renegotiate" // mid-call offer/answer, e.g. adding video or an ICE restart
+)
+
+// Why a call ended
+const (
+	ReasonHangup       = "hangup"
+	ReasonDeclined     = "declined"
+	ReasonCancelled    = "cancelled"
+	ReasonNoAnswer     = "no_answer"
+	ReasonDisconnected = "peer_disconnected"
+)
+
+// Role is who triggers an event
+type Role string
+
+const (
+	RoleCaller Role = "caller"
+	RoleCallee Role = "callee"
+	RoleServer Role = "server" // the hub itself, e.g. when a device disconnects
+)
+
+// Media is the kind of call
+type Media string
+
+const (
+	MediaAudio  Media = "audio"
+	MediaVideo  Media = "video"
+	MediaScreen Media = "screen" // video with a shared screen
+)
+
+type transition struct {
+	from  State
+	event Event
+	by    Role
+}
+
+// transitions lists every allowed event and the state it leads to
+var transitions = map[transition]State{
+	{StateRinging, EventAnswer, RoleCallee}:       StateActive,
+	{StateRinging, EventIceCandidate, RoleCaller}: StateRinging,
+	{StateRinging, EventEnd, RoleCaller}:          StateEnded,
+	{StateRinging, EventEnd, RoleCallee}:          StateEnded,
+	{StateRinging, EventEnd, RoleServer}:          StateEnded,
+	{StateRinging, EventDecline, RoleCallee}:      StateEnded,
+	{StateRinging, EventCancel, RoleCaller}:       StateEnded,
+	{StateRinging, EventTimeout, RoleServer}:      StateEnded,
+
+	{StateActive, EventIceCandidate, RoleCaller}: StateActive,
+	{StateActive, EventIceCandidate, RoleCallee}: StateActive,
+	{StateActive, EventEnd, RoleCaller}:          StateEnded,
+	{StateActive, EventEnd, RoleCallee}:          StateEnded,
+	{StateActive, EventEnd, RoleServer}:          StateEnded,
+	{StateActive, EventRenegotiate, RoleCaller}:  StateActive,
+	{StateActive, EventRenegotiate, RoleCallee}:  StateActive,
+}
+
+// Session is one call between a caller and a callee. The caller's device is
+// known from the start; the callee's once one of its devices answers.
+type Session struct {
+	ID         string
+	Caller     string // user IDs
+	Callee     string
+	CallerConn string // connection ID of the calling device
+	CreatedAt  time.Time
+
+	mu         sync.Mutex
+	state      State
+	media      Media // changes when the call is renegotiated
+	calleeConn string
+	answeredAt time.Time
+	endedAt    time.Time
+	endReason  string
+
+	// Caller ICE candidates held back until the callee answers
+	early      [][]byte
+	earlyBytes int
+	drained    bool
+}
+
+// Snapshot is a consistent copy of a session's fields
+type Snapshot struct {
+	ID         string
+	Caller     string
+	Callee     string
+	CallerConn string
+	CalleeConn string
+	Media      Media
+	State      State
+	CreatedAt  time.Time
+	AnsweredAt time.Time // zero until answered
+	EndedAt    time.Time // zero until ended
+	EndReason  string
+}
+
+// Snapshot returns the session's current fields
+func (s *Session) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Snapshot{
+		ID:         s.ID,
+		Caller:     s.Caller,
+		Callee:     s.Callee,
+		CallerConn: s.CallerConn,
+		CalleeConn: s.calleeConn,
+		Media:      s.media,
+		State:      s.state,
+		CreatedAt:  s.CreatedAt,
+		AnsweredAt: s.answeredAt,
+		EndedAt:    s.endedAt,
+		EndReason:  s.endReason,
+	}
+}
+
+// State returns the session's current state
+func (s *Session) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Media returns the current media of the call
+func (s *Session) Media() Media {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.media
+}
+
+// Renegotiate records the media agreed on by a mid-call offer/answer exchange
+func (s *Session) Renegotiate(userID string, media Media) error {
+	role, err := s.RoleOf(userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.nextLocked(role, EventRenegotiate); err != nil {
+		return err
+	}
+	s.media = media
+	return nil
+}
+
+// CalleeConn returns the connection ID of the device that answered, if any
+func (s *Session) CalleeConn() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calleeConn
+}
+
+// RoleOf returns the role of userID in the call
+func (s *Session) RoleOf(userID string) (Role, error) {
+	switch userID {
+	case s.Caller:
+		return RoleCaller, nil
+	case s.Callee:
+		return RoleCallee, nil
+	}
+	return "", ErrNotParticipant
+}
+
+// Peer returns the other participant of userID
+func (s *Session) Peer(userID string) string {
+	if userID == s.Caller {
+		return s.Callee
+	}
+	return s.Caller
+}
+
+// Check reports whether userID may trigger event now, without applying it
+func (s *Session) Check(userID string, event Event) error {
+	role, err := s.RoleOf(userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.nextLocked(role, event)
+	return err
+}
+
+// Answer pins the call to the callee's device conn and makes it active
+func (s *Session) Answer(userID, conn string) error {
+	role, err := s.RoleOf(userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, err := s.nextLocked(role, EventAnswer)
+	if err != nil {
+		return err
+	}
+	s.state = next
+	s.calleeConn = conn
+	s.answeredAt = time.Now()
+	return nil
+}
+
+// BufferCandidate holds an encoded ICE candidate frame from the caller until
+// the callee's answer is in flight. It returns false once the buffer has been
+// drained, in which case the frame should be sent straight away.
+func (s *Session) BufferCandidate(frame []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.drained || s.state == StateEnded {
+		return false, nil
+	}
+	if len(s.early) >= MaxEarlyCandidates || s.earlyBytes+len(frame) > MaxEarlyCandidateBytes {
+		return false, ErrBufferFull
+	}
+	s.early = append(s.early, frame)
+	s.earlyBytes += len(frame)
+	return true, nil
+}
+
+// DrainCandidates returns the buffered candidate frames in the order they
+// arrived and stops buffering. Call it once the answer has been forwarded.
+func (s *Session) DrainCandidates() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	early := s.early
+	s.early, s.earlyBytes, s.drained = nil, 0, true
+	return early
+}
+
+// End hangs up on behalf of userID
+func (s *Session) End(userID string) error {
+	return s.endBy(userID, EventEnd, ReasonHangup)
+}
+
+// Decline turns down a ringing call on behalf of the callee
+func (s *Session) Decline(userID string) error {
+	return s.endBy(userID, EventDecline, ReasonDeclined)
+}
+
+// Cancel withdraws a ringing call on behalf of the caller
+func (s *Session) Cancel(userID string) error {
+	return s.endBy(userID, EventCancel, ReasonCancelled)
+}
+
+// Expire ends a call that is still ringing because nobody answered
+func (s *Session) Expire() error {
+	return s.end(RoleServer, EventTimeout, ReasonNoAnswer)
+}
+
+// Terminate ends the call on behalf of the server
+func (s *Session) Terminate(reason string) error {
+	return s.end(RoleServer, EventEnd, reason)
+}
+
+func (s *Session) endBy(userID string, event Event, reason string) error {
+	role, err := s.RoleOf(userID)
+	if err != nil {
+		return err
+	}
+	return s.end(role, event, reason)
+}
+
+func (s *Session) end(role Role, event Event, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, err := s.nextLocked(role, event)
+	if err != nil {
+		return err
+	}
+	s.state = next
+	s.endedAt = time.Now()
+	s.endReason = reason
+	// Candidates nobody will answer expire with the call
+	s.early, s.earlyBytes, s.drained = nil, 0, true
+	return nil
+}
+
+// nextLocked looks up the state event leads to. Callers must hold s.mu.
+func (s *Session) nextLocked(role Role, event Event) (State, error) {
+	next, ok := transitions[transition{from: s.state, event: event, by: role}]
+	if !ok {
+		return "", ErrInvalidTransition
+	}
+	return next, nil
+}
+
+// Registry holds the sessions that have not ended yet
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*Session)}
+}
+
+// Start registers a ringing session with a caller-chosen ID
+func (r *Registry) Start(id, caller, callerConn, callee string, media Media) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[id]; ok {
+		return nil, ErrCallExists
+	}
+
+	s := &Session{
+		ID:         id,
+		Caller:     caller,
+		Callee:     callee,
+		CallerConn: callerConn,
+		CreatedAt:  time.Now(),
+		state:      StateRinging,
+		media:      media,
+	}
+	r.sessions[id] = s
+	return s, nil
+}
+
+// Get returns a session that has not been removed
+func (r *Registry) Get(id string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrUnknownCall
+	}
+	return s, nil
+}
+
+// Remove forgets a session, normally once it has ended
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	delete(r.sessions, id)
+	r.mu.Unlock()
+}
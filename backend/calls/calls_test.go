@@ -0,0 +1,290 @@
+package calls_test
+
+import (
+	"errors"
+	"testing"
+
+	"athena-backend/calls"
+)
+
+// ring starts a call from alice's laptop to bob
+func ring(t *testing.T, r *calls.Registry, id string) *calls.Session {
+	t.Helper()
+	s, err := r.Start(id, "alice", "alice-laptop", "bob", calls.MediaAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func answered(s *calls.Session) error { return s.Answer("bob", "bob-phone") }
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      []func(*calls.Session) error
+		event      func(*calls.Session) error
+		wantErr    error
+		wantState  calls.State
+		wantReason string
+	}{
+		{
+			name:      "callee answers",
+			event:     answered,
+			wantState: calls.StateActive,
+		},
+		{
+			name:      "caller cannot answer",
+			event:     func(s *calls.Session) error { return s.Answer("alice", "alice-phone") },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateRinging,
+		},
+		{
+			name:      "outsider cannot answer",
+			event:     func(s *calls.Session) error { return s.Answer("mallory", "mallory-phone") },
+			wantErr:   calls.ErrNotParticipant,
+			wantState: calls.StateRinging,
+		},
+		{
+			name:       "callee declines",
+			event:      func(s *calls.Session) error { return s.Decline("bob") },
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonDeclined,
+		},
+		{
+			name:      "caller cannot decline",
+			event:     func(s *calls.Session) error { return s.Decline("alice") },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateRinging,
+		},
+		{
+			name:       "caller cancels",
+			event:      func(s *calls.Session) error { return s.Cancel("alice") },
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonCancelled,
+		},
+		{
+			name:      "callee cannot cancel",
+			event:     func(s *calls.Session) error { return s.Cancel("bob") },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateRinging,
+		},
+		{
+			name:       "nobody answers in time",
+			event:      (*calls.Session).Expire,
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonNoAnswer,
+		},
+		{
+			name:       "caller hangs up while ringing",
+			event:      func(s *calls.Session) error { return s.End("alice") },
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonHangup,
+		},
+		{
+			name:      "renegotiating before the answer",
+			event:     func(s *calls.Session) error { return s.Renegotiate("alice", calls.MediaVideo) },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateRinging,
+		},
+
+		{
+			name:      "a second device answers",
+			setup:     []func(*calls.Session) error{answered},
+			event:     func(s *calls.Session) error { return s.Answer("bob", "bob-laptop") },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateActive,
+		},
+		{
+			name:      "ring timeout after the answer",
+			setup:     []func(*calls.Session) error{answered},
+			event:     (*calls.Session).Expire,
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateActive,
+		},
+		{
+			name:      "decline after the answer",
+			setup:     []func(*calls.Session) error{answered},
+			event:     func(s *calls.Session) error { return s.Decline("bob") },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateActive,
+		},
+		{
+			name:      "cancel after the answer",
+			setup:     []func(*calls.Session) error{answered},
+			event:     func(s *calls.Session) error { return s.Cancel("alice") },
+			wantErr:   calls.ErrInvalidTransition,
+			wantState: calls.StateActive,
+		},
+		{
+			name:      "callee renegotiates",
+			setup:     []func(*calls.Session) error{answered},
+			event:     func(s *calls.Session) error { return s.Renegotiate("bob", calls.MediaVideo) },
+			wantState: calls.StateActive,
+		},
+		{
+			name:       "callee hangs up",
+			setup:      []func(*calls.Session) error{answered},
+			event:      func(s *calls.Session) error { return s.End("bob") },
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonHangup,
+		},
+		{
+			name:       "server ends the call",
+			setup:      []func(*calls.Session) error{answered},
+			event:      func(s *calls.Session) error { return s.Terminate(calls.ReasonDisconnected) },
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonDisconnected,
+		},
+
+		{
+			name:       "answer after a cancel",
+			setup:      []func(*calls.Session) error{func(s *calls.Session) error { return s.Cancel("alice") }},
+			event:      answered,
+			wantErr:    calls.ErrInvalidTransition,
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonCancelled,
+		},
+		{
+			name:       "ring timeout after a decline",
+			setup:      []func(*calls.Session) error{func(s *calls.Session) error { return s.Decline("bob") }},
+			event:      (*calls.Session).Expire,
+			wantErr:    calls.ErrInvalidTransition,
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonDeclined,
+		},
+		{
+			name:       "hang up twice",
+			setup:      []func(*calls.Session) error{answered, func(s *calls.Session) error { return s.End("alice") }},
+			event:      func(s *calls.Session) error { return s.End("bob") },
+			wantErr:    calls.ErrInvalidTransition,
+			wantState:  calls.StateEnded,
+			wantReason: calls.ReasonHangup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := ring(t, calls.NewRegistry(), "call-1")
+			for _, step := range tt.setup {
+				if err := step(s); err != nil {
+					t.Fatalf("setup: %v", err)
+				}
+			}
+
+			if err := tt.event(s); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			snap := s.Snapshot()
+			if snap.State != tt.wantState {
+				t.Errorf("got state %s, want %s", snap.State, tt.wantState)
+			}
+			if snap.EndReason != tt.wantReason {
+				t.Errorf("got end reason %q, want %q", snap.EndReason, tt.wantReason)
+			}
+			if (snap.State == calls.StateEnded) == snap.EndedAt.IsZero() {
+				t.Errorf("got ended at %v in state %s", snap.EndedAt, snap.State)
+			}
+		})
+	}
+}
+
+func TestCheckDoesNotApply(t *testing.T) {
+	s := ring(t, calls.NewRegistry(), "call-1")
+
+	if err := s.Check("bob", calls.EventAnswer); err != nil {
+		t.Fatalf("got %v checking an answer", err)
+	}
+	if err := s.Check("alice", calls.EventDecline); !errors.Is(err, calls.ErrInvalidTransition) {
+		t.Errorf("got %v checking a decline by the caller", err)
+	}
+	if s.State() != calls.StateRinging {
+		t.Errorf("got state %s after checks, want ringing", s.State())
+	}
+}
+
+func TestSecondDeviceAnswer(t *testing.T) {
+	s := ring(t, calls.NewRegistry(), "call-1")
+	if err := s.Answer("bob", "bob-phone"); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Snapshot()
+
+	if err := s.Answer("bob", "bob-laptop"); !errors.Is(err, calls.ErrInvalidTransition) {
+		t.Fatalf("got %v for a second answer", err)
+	}
+	snap := s.Snapshot()
+	if snap.CalleeConn != "bob-phone" {
+		t.Errorf("call moved to %s, want it pinned to bob-phone", snap.CalleeConn)
+	}
+	if !snap.AnsweredAt.Equal(first.AnsweredAt) {
+		t.Errorf("answered at moved from %v to %v", first.AnsweredAt, snap.AnsweredAt)
+	}
+}
+
+func TestRingTimeout(t *testing.T) {
+	s := ring(t, calls.NewRegistry(), "call-1")
+	if err := s.Expire(); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := s.Snapshot()
+	if !snap.AnsweredAt.IsZero() || snap.CalleeConn != "" {
+		t.Errorf("got an expired call answered at %v by %q", snap.AnsweredAt, snap.CalleeConn)
+	}
+	if snap.EndedAt.Before(snap.CreatedAt) {
+		t.Errorf("got ended at %v before created at %v", snap.EndedAt, snap.CreatedAt)
+	}
+
+	// A late answer from a device that was still ringing is refused
+	if err := answered(s); !errors.Is(err, calls.ErrInvalidTransition) {
+		t.Errorf("got %v answering an expired call", err)
+	}
+}
+
+func TestCallWaiting(t *testing.T) {
+	r := calls.NewRegistry()
+	first := ring(t, r, "call-1")
+	if err := answered(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol calls bob during the call with alice
+	second, err := r.Start("call-2", "carol", "carol-phone", "bob", calls.MediaVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Start("call-2", "dave", "dave-phone", "bob", calls.MediaAudio); !errors.Is(err, calls.ErrCallExists) {
+		t.Errorf("got %v reusing a call ID", err)
+	}
+
+	// Declining the waiting call leaves the first one alone
+	if err := second.Decline("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if first.State() != calls.StateActive {
+		t.Errorf("got first call %s after declining the waiting one, want active", first.State())
+	}
+
+	// Hanging up and picking up the next waiting call
+	third, err := r.Start("call-3", "carol", "carol-phone", "bob", calls.MediaVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.End("bob"); err != nil {
+		t.Fatal(err)
+	}
+	r.Remove(first.ID)
+	if err := third.Answer("bob", "bob-phone"); err != nil {
+		t.Fatal(err)
+	}
+	if third.State() != calls.StateActive || third.Media() != calls.MediaVideo {
+		t.Errorf("got waiting call %s with %s, want active video", third.State(), third.Media())
+	}
+
+	if _, err := r.Get("call-1"); !errors.Is(err, calls.ErrUnknownCall) {
+		t.Errorf("got %v for a removed call", err)
+	}
+	if got, err := r.Get("call-3"); err != nil || got != third {
+		t.Errorf("got %v, %v for the waiting call", got, err)
+	}
+}
@@ -0,0 +1,182 @@
+package calls
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownRoom = errors.New("calls: unknown room")
+	ErrRoomFull    = errors.New("calls: room is full")
+	ErrInRoom      = errors.New("calls: already in the room")
+)
+
+// MaxRoomSize caps a mesh room: every participant sends its media to every
+// other one, so uplink use grows with each participant
+const MaxRoomSize = 6
+
+// Topology is how media flows between the participants of a room
+type Topology string
+
+const (
+	TopologyMesh Topology = "mesh" // a peer connection between every pair of participants
+	TopologySFU  Topology = "sfu"  // one peer connection per participant to the server, which forwards
+)
+
+// Why a participant left a room
+const (
+	ReasonLeft    = "left"
+	ReasonRemoved = "removed" // no longer a member of the group
+)
+
+// Participant is one user in a room, on one device
+type Participant struct {
+	UserID   string    `json:"user_id"`
+	Conn     string    `json:"-"` // connection ID of the device in the room
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Room is a group call. In mesh topology each participant holds a peer
+// connection to every other one, so the server only tracks who is in the
+// room and relays signalling between pairs of participants; in SFU topology
+// the server's forwarding unit carries the media. A group conversation has
+// at most one room at a time.
+type Room struct {
+	ID             string
+	ConversationID string
+	Media          Media    // chosen by whoever started the room
+	Topology       Topology // likewise
+	Size           int      // most participants the room holds
+	CreatedAt      time.Time
+
+	mu           sync.Mutex
+	participants map[string]Participant // keyed by user ID
+	ended        bool
+}
+
+// Participant returns the participant userID, if in the room
+func (r *Room) Participant(userID string) (Participant, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.participants[userID]
+	return p, ok
+}
+
+// Participants returns everyone in the room, in the order they joined
+func (r *Room) Participants() []Participant {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	participants := make([]Participant, 0, len(r.participants))
+	for _, p := range r.participants {
+		participants = append(participants, p)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+	return participants
+}
+
+// RoomOptions are chosen by whoever opens a room
+type RoomOptions struct {
+	Media    Media
+	Topology Topology
+	Size     int
+}
+
+// Rooms holds the rooms that still have participants
+type Rooms struct {
+	mu             sync.Mutex
+	rooms          map[string]*Room // keyed by room ID
+	byConversation map[string]*Room
+}
+
+// NewRooms creates an empty room registry
+func NewRooms() *Rooms {
+	return &Rooms{
+		rooms:          make(map[string]*Room),
+		byConversation: make(map[string]*Room),
+	}
+}
+
+// Get returns a room that has not been torn down
+func (rs *Rooms) Get(id string) (*Room, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.rooms[id]
+	if !ok {
+		return nil, ErrUnknownRoom
+	}
+	return r, nil
+}
+
+// ForConversation returns the room of a group conversation, if one is open
+func (rs *Rooms) ForConversation(conversationID string) (*Room, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.byConversation[conversationID]
+	return r, ok
+}
+
+// Join puts userID's device conn in the room of a conversation, opening the
+// room with opts if there is none. It reports whether the room was opened.
+func (rs *Rooms) Join(conversationID, userID, conn string, opts RoomOptions) (*Room, bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.byConversation[conversationID]
+	if !ok {
+		r = &Room{
+			ID:             uuid.NewString(),
+			ConversationID: conversationID,
+			Media:          opts.Media,
+			Topology:       opts.Topology,
+			Size:           opts.Size,
+			CreatedAt:      time.Now(),
+			participants:   make(map[string]Participant),
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.participants[userID]; ok {
+		return nil, false, ErrInRoom
+	}
+	if len(r.participants) >= r.Size {
+		return nil, false, ErrRoomFull
+	}
+	r.participants[userID] = Participant{UserID: userID, Conn: conn, JoinedAt: time.Now()}
+
+	if !ok {
+		rs.rooms[r.ID] = r
+		rs.byConversation[conversationID] = r
+	}
+	return r, !ok, nil
+}
+
+// Leave takes userID out of a room. The last one out tears the room down,
+// which Leave reports.
+func (rs *Rooms) Leave(r *Room, userID string) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.participants[userID]; !ok || r.ended {
+		return false, ErrNotParticipant
+	}
+	delete(r.participants, userID)
+
+	if len(r.participants) > 0 {
+		return false, nil
+	}
+	r.ended = true
+	delete(rs.rooms, r.ID)
+	delete(rs.byConversation, r.ConversationID)
+	return true, nil
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -12,6 +18,56 @@ type Config struct {
 	SupabaseKey string
 	Port        string
 	FrontendURL string
+
+	// Access token verification
+	JWTSecret    string // HS256 secret of the Supabase project
+	JWKSURL      string // Public keys for RS256/ES256 tokens
+	AuthFallback bool   // Ask GoTrue when a token cannot be verified locally
+
+	// Directory of the local message outbox; empty disables it
+	OutboxDir string
+
+	// Directory voicemail recordings are stored in; empty disables voicemail
+	BlobDir string
+
+	// WebSocket heartbeats and limits; zero keeps the handler defaults
+	WSPingInterval   time.Duration
+	WSPongTimeout    time.Duration
+	WSWriteTimeout   time.Duration
+	WSMaxMessageSize int64
+
+	// How long a call may ring before it ends with no_answer; zero keeps the default
+	RingTimeout time.Duration
+
+	// Let a busy user see a second incoming call instead of rejecting it
+	// with user_busy
+	CallWaiting bool
+
+	// ICE servers handed to clients. TURN credentials are derived from
+	// TURNSecret (coturn's static-auth-secret) and expire after TURNTTL.
+	STUNURLs   []string
+	TURNURLs   []string
+	TURNSecret string
+	TURNTTL    time.Duration
+
+	// Embedded TURN/STUN server for deployments without coturn. It accepts
+	// the credentials issued with TURNSecret.
+	TURNEmbedded         bool
+	TURNListenAddr       string
+	TURNPublicIP         net.IP
+	TURNRealm            string
+	TURNRelayPortMin     uint16
+	TURNRelayPortMax     uint16
+	TURNMaxAllocsPerUser int
+
+	// Selective forwarding unit for group call rooms that ask for it. Its
+	// peer connections receive media on SFUPortMin-SFUPortMax and announce
+	// SFUPublicIP when the server sits behind a 1:1 NAT.
+	SFUEnabled         bool
+	SFUMaxParticipants int
+	SFUPublicIP        string
+	SFUPortMin         uint16
+	SFUPortMax         uint16
 }
 
 func Load() (*Config, error) {
@@ -25,6 +81,11 @@ func Load() (*Config, error) {
 	supabaseKey := os.Getenv("SUPABASE_KEY")
 	port := os.Getenv("PORT")
 	frontendURL := os.Getenv("FRONTEND_URL")
+	jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
+	jwksURL := os.Getenv("SUPABASE_JWKS_URL")
+	authFallback := os.Getenv("AUTH_GOTRUE_FALLBACK") == "true"
+	outboxDir := os.Getenv("OUTBOX_DIR")
+	blobDir := os.Getenv("BLOB_DIR")
 
 	if supabaseURL == "" || supabaseKey == "" {
 		log.Fatal("SUPABASE_URL and SUPABASE_KEY must be set")
@@ -38,6 +99,123 @@ func Load() (*Config, error) {
 		frontendURL = "http://localhost:3000"
 	}
 
+	if jwksURL == "" {
+		jwksURL = supabaseURL + "/auth/v1/.well-known/jwks.json"
+	}
+
+	wsPingInterval, err := durationEnv("WS_PING_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	wsPongTimeout, err := durationEnv("WS_PONG_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	wsWriteTimeout, err := durationEnv("WS_WRITE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	var wsMaxMessageSize int64
+	if v := os.Getenv("WS_MAX_MESSAGE_SIZE"); v != "" {
+		wsMaxMessageSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || wsMaxMessageSize <= 0 {
+			return nil, fmt.Errorf("WS_MAX_MESSAGE_SIZE must be a positive number of bytes, got %q", v)
+		}
+	}
+	ringTimeout, err := durationEnv("CALL_RING_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	callWaiting := os.Getenv("CALL_WAITING") == "true"
+	stunURLs := listEnv("STUN_URLS")
+	turnURLs := listEnv("TURN_URLS")
+	turnSecret := os.Getenv("TURN_SECRET")
+	turnTTL, err := durationEnv("TURN_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if len(turnURLs) > 0 && turnSecret == "" {
+		return nil, fmt.Errorf("TURN_SECRET must be set when TURN_URLS is")
+	}
+
+	turnEmbedded := os.Getenv("TURN_EMBEDDED") == "true"
+	turnListenAddr := os.Getenv("TURN_LISTEN_ADDR")
+	if turnListenAddr == "" {
+		turnListenAddr = "0.0.0.0:3478"
+	}
+	turnRealm := os.Getenv("TURN_REALM")
+	if turnRealm == "" {
+		turnRealm = "athena"
+	}
+	var turnPublicIP net.IP
+	if v := os.Getenv("TURN_PUBLIC_IP"); v != "" {
+		if turnPublicIP = net.ParseIP(v); turnPublicIP == nil || turnPublicIP.To4() == nil {
+			return nil, fmt.Errorf("TURN_PUBLIC_IP must be an IPv4 address, got %q", v)
+		}
+	}
+	turnRelayPortMin, err := portEnv("TURN_RELAY_PORT_MIN", 49152)
+	if err != nil {
+		return nil, err
+	}
+	turnRelayPortMax, err := portEnv("TURN_RELAY_PORT_MAX", 65535)
+	if err != nil {
+		return nil, err
+	}
+	turnMaxAllocsPerUser := 4
+	if v := os.Getenv("TURN_MAX_ALLOCATIONS_PER_USER"); v != "" {
+		turnMaxAllocsPerUser, err = strconv.Atoi(v)
+		if err != nil || turnMaxAllocsPerUser <= 0 {
+			return nil, fmt.Errorf("TURN_MAX_ALLOCATIONS_PER_USER must be a positive number, got %q", v)
+		}
+	}
+	if turnEmbedded {
+		if turnSecret == "" || turnPublicIP == nil {
+			return nil, fmt.Errorf("TURN_SECRET and TURN_PUBLIC_IP must be set when TURN_EMBEDDED is true")
+		}
+		if turnRelayPortMin > turnRelayPortMax {
+			return nil, fmt.Errorf("TURN_RELAY_PORT_MIN must not be above TURN_RELAY_PORT_MAX")
+		}
+	}
+	sfuEnabled := os.Getenv("SFU_ENABLED") == "true"
+	sfuMaxParticipants := 25
+	if v := os.Getenv("SFU_MAX_PARTICIPANTS"); v != "" {
+		sfuMaxParticipants, err = strconv.Atoi(v)
+		if err != nil || sfuMaxParticipants < 2 {
+			return nil, fmt.Errorf("SFU_MAX_PARTICIPANTS must be a number above 1, got %q", v)
+		}
+	}
+	sfuPublicIP := os.Getenv("SFU_PUBLIC_IP")
+	if sfuPublicIP != "" && net.ParseIP(sfuPublicIP) == nil {
+		return nil, fmt.Errorf("SFU_PUBLIC_IP must be an IP address, got %q", sfuPublicIP)
+	}
+	var sfuPortMin, sfuPortMax uint16
+	if os.Getenv("SFU_PORT_MIN") != "" || os.Getenv("SFU_PORT_MAX") != "" {
+		if sfuPortMin, err = portEnv("SFU_PORT_MIN", 49152); err != nil {
+			return nil, err
+		}
+		if sfuPortMax, err = portEnv("SFU_PORT_MAX", 65535); err != nil {
+			return nil, err
+		}
+		if sfuPortMin > sfuPortMax {
+			return nil, fmt.Errorf("SFU_PORT_MIN must not be above SFU_PORT_MAX")
+		}
+	}
+	if wsPingInterval > 0 && wsPongTimeout > 0 && wsPingInterval >= wsPongTimeout {
+		return nil, fmt.Errorf("WS_PING_INTERVAL must be shorter than WS_PONG_TIMEOUT")
+	}
+
+	// Relative directories are resolved now so the logs name the real place
+	for _, dir := range []*string{&outboxDir, &blobDir} {
+		if *dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", *dir, err)
+		}
+		*dir = abs
+	}
+
 	log.Println("Configuration loaded successfully")
 
 	return &Config{
@@ -45,5 +223,76 @@ func Load() (*Config, error) {
 		SupabaseKey: supabaseKey,
 		Port:        port,
 		FrontendURL: frontendURL,
+
+		JWTSecret:    jwtSecret,
+		JWKSURL:      jwksURL,
+		AuthFallback: authFallback,
+
+		OutboxDir: outboxDir,
+		BlobDir:   blobDir,
+
+		WSPingInterval:   wsPingInterval,
+		WSPongTimeout:    wsPongTimeout,
+		WSWriteTimeout:   wsWriteTimeout,
+		WSMaxMessageSize: wsMaxMessageSize,
+
+		RingTimeout: ringTimeout,
+		CallWaiting: callWaiting,
+
+		STUNURLs:   stunURLs,
+		TURNURLs:   turnURLs,
+		TURNSecret: turnSecret,
+		TURNTTL:    turnTTL,
+
+		TURNEmbedded:         turnEmbedded,
+		TURNListenAddr:       turnListenAddr,
+		TURNPublicIP:         turnPublicIP,
+		TURNRealm:            turnRealm,
+		TURNRelayPortMin:     turnRelayPortMin,
+		TURNRelayPortMax:     turnRelayPortMax,
+		TURNMaxAllocsPerUser: turnMaxAllocsPerUser,
+
+		SFUEnabled:         sfuEnabled,
+		SFUMaxParticipants: sfuMaxParticipants,
+		SFUPublicIP:        sfuPublicIP,
+		SFUPortMin:         sfuPortMin,
+		SFUPortMax:         sfuPortMax,
 	}, nil
 }
+
+// durationEnv parses an optional duration such as "30s" from the environment
+func durationEnv(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 30s, got %q", name, v)
+	}
+	return d, nil
+}
+
+// listEnv splits an optional comma-separated list from the environment
+func listEnv(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// portEnv parses an optional port number from the environment
+func portEnv(name string, def uint16) (uint16, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	port, err := strconv.ParseUint(v, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("%s must be a port number, got %q", name, v)
+	}
+	return uint16(port), nil
+}
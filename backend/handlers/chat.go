@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"athena-backend/store"
+)
+
+// How long friendship lookups are cached. Negative answers expire sooner so a
+// friendship accepted on another instance is picked up quickly.
+const (
+	friendshipTTL         = 5 * time.Minute
+	friendshipNegativeTTL = 30 * time.Second
+)
+
+type friendshipEntry struct {
+	friends bool
+	expires time.Time
+}
+
+// friendshipCache memoises AreFriends lookups for the chat path
+type friendshipCache struct {
+	mu      sync.Mutex
+	entries map[[2]string]friendshipEntry
+}
+
+var friendships = &friendshipCache{entries: make(map[[2]string]friendshipEntry)}
+
+// areFriends reports whether two users are friends, asking the store on a cache miss
+func (fc *friendshipCache) areFriends(ctx context.Context, userA, userB string) (bool, error) {
+	userID1, userID2 := store.SortedPair(userA, userB)
+	key := [2]string{userID1, userID2}
+
+	fc.mu.Lock()
+	entry, ok := fc.entries[key]
+	fc.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.friends, nil
+	}
+
+	friends, err := friendStore.AreFriends(ctx, userID1, userID2)
+	if err != nil {
+		return false, err
+	}
+
+	ttl := friendshipNegativeTTL
+	if friends {
+		ttl = friendshipTTL
+	}
+	fc.mu.Lock()
+	fc.entries[key] = friendshipEntry{friends: friends, expires: time.Now().Add(ttl)}
+	fc.mu.Unlock()
+	return friends, nil
+}
+
+// forget drops a cached answer, e.g. once a friend request is accepted
+func (fc *friendshipCache) forget(userA, userB string) {
+	userID1, userID2 := store.SortedPair(userA, userB)
+	fc.mu.Lock()
+	delete(fc.entries, [2]string{userID1, userID2})
+	fc.mu.Unlock()
+}
+
+// How long group member lists are cached. Changes made through this instance
+// drop the entry at once; the TTL bounds how stale other instances get.
+const conversationMembersTTL = 30 * time.Second
+
+type membersEntry struct {
+	members []string
+	expires time.Time
+}
+
+// memberCache memoises the member lists of groups for the chat path
+type memberCache struct {
+	mu      sync.Mutex
+	entries map[string]membersEntry
+}
+
+var conversationMembers = &memberCache{entries: make(map[string]membersEntry)}
+
+// members returns the user IDs of a group's members, asking the store on a
+// cache miss. Unknown groups yield store.ErrNotFound.
+func (mc *memberCache) members(ctx context.Context, conversationID string) ([]string, error) {
+	mc.mu.Lock()
+	entry, ok := mc.entries[conversationID]
+	mc.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.members, nil
+	}
+
+	conv, err := conversationStore.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, len(conv.Members))
+	for i, m := range conv.Members {
+		members[i] = m.UserID
+	}
+
+	mc.mu.Lock()
+	mc.entries[conversationID] = membersEntry{members: members, expires: time.Now().Add(conversationMembersTTL)}
+	mc.mu.Unlock()
+	return members, nil
+}
+
+// forget drops a cached member list, e.g. once someone joins or leaves
+func (mc *memberCache) forget(conversationID string) {
+	mc.mu.Lock()
+	delete(mc.entries, conversationID)
+	mc.mu.Unlock()
+}
+
+// prepareChat validates a chat message sent by c and fills in the fields the
+// server owns: the sender, the conversation and the timestamp. Direct
+// messages are addressed by recipient_id, group messages by conversation_id
+// alone; whatever the client put in sender_id, user_id_1, user_id_2, kind
+// and voicemail is ignored. It returns a chat-error reason when the message
+// must be rejected.
+func (c *Client) prepareChat(msg *Message) string {
+	group := msg.RecipientID == "" && msg.ConversationID != ""
+	if !group && (msg.RecipientID == "" || msg.RecipientID == c.UserID) {
+		return "invalid_recipient"
+	}
+	if strings.TrimSpace(msg.Content) == "" {
+		return "empty_message"
+	}
+
+	var reason string
+	if group {
+		reason = c.addressGroup(msg)
+	} else {
+		reason = c.addressDirect(msg)
+	}
+	if reason != "" {
+		return reason
+	}
+
+	msg.SenderID = c.UserID
+	msg.Kind, msg.Voicemail = "", nil
+	msg.CreatedAt = messageTime()
+	msg.origin = c
+	return ""
+}
+
+// messageTime returns the created_at of a new message, at the microsecond
+// precision of the database, so the copy delivered live and the stored one
+// compare the same against receipt watermarks and since
+func messageTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// addressDirect checks the sender and recipient are friends and sets the
+// pair and their direct conversation
+func (c *Client) addressDirect(msg *Message) string {
+	friends, err := friendships.areFriends(context.Background(), c.UserID, msg.RecipientID)
+	if err != nil {
+		log.Printf("Error checking friendship between %s and %s: %v", c.UserID, msg.RecipientID, err)
+		return "unavailable"
+	}
+	if !friends {
+		return "not_friends"
+	}
+
+	msg.UserID1, msg.UserID2 = store.SortedPair(c.UserID, msg.RecipientID)
+	msg.ConversationID = store.DirectConversationID(c.UserID, msg.RecipientID)
+	msg.members = nil
+	return ""
+}
+
+// addressGroup checks the sender is a member of the group and addresses the
+// message to all its members. Groups the sender cannot see are reported as
+// not_member, so their existence is not revealed.
+func (c *Client) addressGroup(msg *Message) string {
+	members, err := conversationMembers.members(context.Background(), msg.ConversationID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error loading members of conversation %s: %v", msg.ConversationID, err)
+		return "unavailable"
+	}
+	if !slices.Contains(members, c.UserID) {
+		return "not_member"
+	}
+
+	msg.UserID1, msg.UserID2 = "", ""
+	msg.members = members
+	return ""
+}
+
+// How long acks are kept to answer retries of the same client_msg_id
+const ackTTL = 10 * time.Minute
+
+type ackEntry struct {
+	ack     ChatAck
+	pending bool // still being stored, no ack yet
+	expires time.Time
+}
+
+// ackCache remembers the acks of stored messages, keyed by sender and
+// client_msg_id, so a retry gets the original ack instead of a duplicate
+type ackCache struct {
+	mu      sync.Mutex
+	entries map[[2]string]ackEntry
+}
+
+func newAckCache() *ackCache {
+	return &ackCache{entries: make(map[[2]string]ackEntry)}
+}
+
+// lookup returns the entry of an earlier message with the same client ID
+func (ac *ackCache) lookup(msg *Message) (ackEntry, bool) {
+	if msg.ClientMsgID == "" {
+		return ackEntry{}, false
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	entry, ok := ac.entries[[2]string{msg.SenderID, msg.ClientMsgID}]
+	if !ok || time.Now().After(entry.expires) {
+		return ackEntry{}, false
+	}
+	return entry, true
+}
+
+// begin marks a message as being stored, so retries that arrive before it
+// is acknowledged are dropped
+func (ac *ackCache) begin(msg *Message) {
+	ac.set(msg.SenderID, ackEntry{ack: ChatAck{ClientMsgID: msg.ClientMsgID}, pending: true})
+}
+
+// remember records the ack of a stored message
+func (ac *ackCache) remember(senderID string, ack ChatAck) {
+	ac.set(senderID, ackEntry{ack: ack})
+}
+
+// abandon forgets a message that could not be stored, so it may be retried
+func (ac *ackCache) abandon(msg *Message) {
+	if msg.ClientMsgID == "" {
+		return
+	}
+
+	ac.mu.Lock()
+	delete(ac.entries, [2]string{msg.SenderID, msg.ClientMsgID})
+	ac.mu.Unlock()
+}
+
+// set stores an entry and prunes expired ones
+func (ac *ackCache) set(senderID string, entry ackEntry) {
+	if entry.ack.ClientMsgID == "" {
+		return
+	}
+
+	now := time.Now()
+	entry.expires = now.Add(ackTTL)
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for key, e := range ac.entries {
+		if now.After(e.expires) {
+			delete(ac.entries, key)
+		}
+	}
+	ac.entries[[2]string{senderID, entry.ack.ClientMsgID}] = entry
+}
+
+// sendChatAck confirms a message to the connection it came from. Messages
+// without a client_msg_id are not acknowledged.
+func sendChatAck(hub *Hub, msg *Message, ack ChatAck) {
+	if ack.ClientMsgID == "" || msg.origin == nil {
+		return
+	}
+
+	wrapperJSON, err := wrapMessage(MessageTypeChatAck, ack)
+	if err != nil {
+		log.Printf("Failed to marshal chat ack: %v", err)
+		return
+	}
+
+	if !hub.sendTo(msg.origin, wrapperJSON) {
+		log.Printf("Failed to send chat ack to %s: channel full", msg.SenderID)
+	}
+}
+
+// sendChatError tells the sending connection its message was rejected
+func sendChatError(hub *Hub, client *Client, reason string, msg *Message) {
+	wrapperJSON, err := wrapMessage(MessageTypeChatError, ChatErrorResponse{
+		Reason:         reason,
+		RecipientID:    msg.RecipientID,
+		ConversationID: msg.ConversationID,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal chat error: %v", err)
+		return
+	}
+
+	if !hub.sendTo(client, wrapperJSON) {
+		log.Printf("Failed to send chat error to %s: channel full", client.UserID)
+	}
+}
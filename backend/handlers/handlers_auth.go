@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 
+	"athena-backend/auth"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/supabase-community/gotrue-go/types"
 )
@@ -82,22 +84,8 @@ func HandleRefreshToken(c *fiber.Ctx) error {
 }
 
 func HandleGetUser(c *fiber.Ctx) error {
-	// Get the authorization header
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Authorization header is required",
-		})
-	}
-
-	// Extract the token (format: "Bearer <token>")
-	token := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		token = authHeader[7:]
-	}
-
-	// Get user info using the token
-	client := authClient.WithToken(token)
+	// The token is already verified; GoTrue holds the full user record
+	client := authClient.WithToken(auth.Token(c))
 	user, err := client.GetUser()
 
 	if err != nil {
@@ -114,22 +102,8 @@ func HandleGetUser(c *fiber.Ctx) error {
 }
 
 func HandleLogout(c *fiber.Ctx) error {
-	// Get the authorization header
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Authorization header is required",
-		})
-	}
-
-	// Extract the token (format: "Bearer <token>")
-	token := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		token = authHeader[7:]
-	}
-
 	// Create authenticated client with user's token
-	client := authClient.WithToken(token)
+	client := authClient.WithToken(auth.Token(c))
 
 	// Call Supabase logout to revoke all refresh tokens
 	// This is important - it invalidates refresh tokens on the server side
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"athena-backend/auth"
+	"athena-backend/calls"
+	"athena-backend/store"
+	"athena-backend/turn"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// turnServer is the embedded TURN server, if enabled
+var turnServer *turn.Server
+
+// SetTURNServer ties the relays of the embedded TURN server to calls: a user's
+// relays are released once the user is in no call anymore
+func SetTURNServer(s *turn.Server) {
+	turnServer = s
+}
+
+// TURNUsage returns the relay usage of the embedded TURN server, if enabled
+func TURNUsage() (turn.Usage, bool) {
+	if turnServer == nil {
+		return turn.Usage{}, false
+	}
+	return turnServer.Usage(), true
+}
+
+// UserInCall reports whether any device of userID is ringing or in a call,
+// one-to-one or in a room. The embedded TURN server only relays for such users.
+func UserInCall(userID string) bool {
+	for _, device := range hub.devices(userID) {
+		if device.currentCall() != nil || device.currentRoom() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseRelays frees the TURN relays of users no longer in any call.
+// Closing the relays happens in the background so the hub never waits on it.
+func releaseRelays(userIDs ...string) {
+	if turnServer == nil {
+		return
+	}
+	for _, userID := range userIDs {
+		if !UserInCall(userID) {
+			go turnServer.Release(userID)
+		}
+	}
+}
+
+// callStoreTimeout bounds each call record read or write made by the hub
+const callStoreTimeout = 10 * time.Second
+
+// callRecord turns an ended session into the record kept in call history
+func callRecord(snap calls.Snapshot) store.CallRecord {
+	record := store.CallRecord{
+		CallerID:  snap.Caller,
+		CalleeID:  snap.Callee,
+		CallType:  string(snap.Media),
+		StartedAt: snap.CreatedAt,
+		EndedAt:   snap.EndedAt,
+		EndReason: snap.EndReason,
+	}
+	if record.EndedAt.IsZero() {
+		record.EndedAt = time.Now()
+	}
+	if !snap.AnsweredAt.IsZero() {
+		answeredAt := snap.AnsweredAt
+		record.AnsweredAt = &answeredAt
+		record.Duration = int(record.EndedAt.Sub(answeredAt).Seconds())
+	}
+	// A call the callee turned down was seen, not missed
+	record.Missed = record.AnsweredAt == nil && record.EndReason != calls.ReasonDeclined
+	return record
+}
+
+// recordCall stores a finished call in the background. Once stored, a missed
+// call is pushed to the callee straight away if one of its devices is
+// connected, otherwise the next time it connects.
+func (h *Hub) recordCall(record store.CallRecord) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), callStoreTimeout)
+		defer cancel()
+		if err := callStore.InsertCall(ctx, &record); err != nil {
+			log.Printf("Failed to record call between %s and %s: %v", record.CallerID, record.CalleeID, err)
+			return
+		}
+		if !record.Missed || !h.sendMissedCall(record.CalleeID, &record) {
+			return
+		}
+		if err := callStore.MarkCallsNotified(ctx, record.CalleeID, []string{record.ID}); err != nil {
+			log.Printf("Failed to mark missed call %s as notified: %v", record.ID, err)
+		}
+	}()
+}
+
+// sendMissedCall tells every connected device of userID about a missed call.
+// It reports whether any device got it.
+func (h *Hub) sendMissedCall(userID string, record *store.CallRecord) bool {
+	wrapperJSON, err := wrapMessage(MessageTypeMissedCall, record)
+	if err != nil {
+		log.Printf("Failed to marshal missed call: %v", err)
+		return false
+	}
+
+	sent := false
+	for _, device := range h.devices(userID) {
+		if h.sendTo(device, wrapperJSON) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// pushMissedCalls sends a newly connected device the missed calls its user
+// has not been told about yet
+func (h *Hub) pushMissedCalls(client *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), callStoreTimeout)
+	defer cancel()
+
+	missed, err := callStore.ListUnnotifiedMissedCalls(ctx, client.UserID)
+	if err != nil {
+		log.Printf("Failed to load missed calls for %s: %v", client.UserID, err)
+		return
+	}
+
+	var notified []string
+	for i := range missed {
+		wrapperJSON, err := wrapMessage(MessageTypeMissedCall, &missed[i])
+		if err != nil {
+			log.Printf("Failed to marshal missed call: %v", err)
+			continue
+		}
+		if h.sendTo(client, wrapperJSON) {
+			notified = append(notified, missed[i].ID)
+		}
+	}
+	if len(notified) == 0 {
+		return
+	}
+
+	if err := callStore.MarkCallsNotified(ctx, client.UserID, notified); err != nil {
+		log.Printf("Failed to mark missed calls of %s as notified: %v", client.UserID, err)
+		return
+	}
+	log.Printf("Pushed %d missed call(s) to %s (connection %s)", len(notified), client.UserID, client.ID)
+}
+
+// maxCallHistoryLimit caps the calls returned by one history request
+const maxCallHistoryLimit = 500
+
+// HandleGetCallHistory lists the calls of the authenticated user, newest first,
+// optionally only those with one friend
+func HandleGetCallHistory(c *fiber.Ctx) error {
+	userID := auth.UserID(c)
+
+	query := store.CallQuery{
+		UserID:   userID,
+		FriendID: c.Query("friend_id"),
+		Limit:    c.QueryInt("limit", 50),
+		Offset:   c.QueryInt("offset", 0),
+	}
+	if query.Limit <= 0 || query.Offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "limit must be positive and offset must not be negative",
+		})
+	}
+	query.Limit = min(query.Limit, maxCallHistoryLimit)
+
+	// Calls are read with the API key, the same credentials the hub writes them with
+	records, err := callStore.ListCalls(c.UserContext(), query)
+	if err != nil {
+		log.Printf("Error fetching call history: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch call history",
+		})
+	}
+	if records == nil {
+		records = []store.CallRecord{}
+	}
+
+	return c.JSON(fiber.Map{
+		"calls":        records,
+		"current_user": userID,
+	})
+}
+
+// HandleGetICEServers returns the STUN and TURN servers for RTCPeerConnection.
+// TURN entries carry credentials for the authenticated user that expire after
+// ttl seconds, so clients should fetch them right before each call.
+func HandleGetICEServers(c *fiber.Ctx) error {
+	userID := auth.UserID(c)
+
+	var servers []ICEServer
+	if len(iceConfig.STUNURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: iceConfig.STUNURLs})
+	}
+
+	ttl := 0
+	if len(iceConfig.TURNURLs) > 0 && iceConfig.TURNSecret != "" {
+		creds := turn.Issue(iceConfig.TURNSecret, userID, iceConfig.TURNTTL, time.Now())
+		servers = append(servers, ICEServer{
+			URLs:       iceConfig.TURNURLs,
+			Username:   creds.Username,
+			Credential: creds.Password,
+		})
+		ttl = int(iceConfig.TURNTTL.Seconds())
+	}
+	if servers == nil {
+		servers = []ICEServer{}
+	}
+
+	return c.JSON(fiber.Map{
+		"ice_servers": servers,
+		"ttl":         ttl,
+	})
+}
@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"athena-backend/auth"
+	"athena-backend/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Group limits
+const (
+	maxGroupMembers = 50 // including the owner
+	maxGroupNameLen = 100
+)
+
+// Group conversations are read and written with the API key: membership
+// and roles are checked here, not by row level security.
+
+// HandleListConversations lists the caller's conversations: their groups
+// and a direct conversation with each friend
+func HandleListConversations(c *fiber.Ctx) error {
+	userID := auth.UserID(c)
+
+	groups, err := conversationStore.ListConversations(c.UserContext(), userID)
+	if err != nil {
+		log.Printf("Error fetching conversations of %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch conversations",
+		})
+	}
+
+	friends, err := friendStore.ListFriends(userContext(c), userID)
+	if err != nil {
+		log.Printf("Error fetching friends of %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch conversations",
+		})
+	}
+
+	conversations := groups
+	for _, friend := range friends {
+		id := store.DirectConversationID(userID, friend.FriendID)
+		conversations = append(conversations, store.Conversation{
+			ID:        id,
+			Kind:      store.ConversationDirect,
+			Name:      friend.Name,
+			CreatedAt: friend.CreatedAt,
+			Members: []store.Member{
+				{ConversationID: id, UserID: userID, Role: store.RoleMember, JoinedAt: friend.CreatedAt},
+				{ConversationID: id, UserID: friend.FriendID, Role: store.RoleMember, JoinedAt: friend.CreatedAt},
+			},
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"conversations": conversations,
+	})
+}
+
+// HandleCreateConversation creates a group owned by the caller. The initial
+// members must be the caller's friends.
+func HandleCreateConversation(c *fiber.Ctx) error {
+	var req CreateConversationBody
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxGroupNameLen {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Name must be between 1 and %d characters", maxGroupNameLen),
+		})
+	}
+
+	userID := auth.UserID(c)
+	conv := &store.Conversation{
+		Kind:      store.ConversationGroup,
+		Name:      name,
+		CreatedBy: userID,
+	}
+
+	memberIDs, err := newMembers(c, userID, conv, req.MemberIDs)
+	if memberIDs == nil {
+		return err
+	}
+
+	members := []store.Member{{UserID: userID, Role: store.RoleOwner}}
+	for _, id := range memberIDs {
+		members = append(members, store.Member{UserID: id, Role: store.RoleMember})
+	}
+
+	if err := conversationStore.CreateConversation(c.UserContext(), conv, members); err != nil {
+		log.Printf("Error creating conversation for %s: %v", userID, err)
+		return c.Status(storeErrorStatus(err)).JSON(fiber.Map{
+			"error": "Failed to create conversation",
+		})
+	}
+
+	hub.conversationChanged(conv.ID, conv, nil)
+	log.Printf("Conversation %s created by %s with %d member(s)", conv.ID, userID, len(members))
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"conversation": conv,
+	})
+}
+
+// HandleGetConversation returns a group and its members to one of its members
+func HandleGetConversation(c *fiber.Ctx) error {
+	conv, _, err := memberConversation(c)
+	if conv == nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"conversation": conv,
+	})
+}
+
+// HandleAddMembers adds friends of the caller to a group. Only the owner and
+// admins may add members.
+func HandleAddMembers(c *fiber.Ctx) error {
+	conv, self, err := memberConversation(c)
+	if conv == nil {
+		return err
+	}
+
+	var req AddMembersBody
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if len(req.MemberIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "member_ids is required",
+		})
+	}
+
+	if self.Role != store.RoleOwner && self.Role != store.RoleAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the owner and admins can add members",
+		})
+	}
+
+	memberIDs, err := newMembers(c, self.UserID, conv, req.MemberIDs)
+	if memberIDs == nil {
+		return err
+	}
+
+	members := make([]store.Member, len(memberIDs))
+	for i, id := range memberIDs {
+		members[i] = store.Member{ConversationID: conv.ID, UserID: id, Role: store.RoleMember}
+	}
+	if err := conversationStore.AddMembers(c.UserContext(), members); err != nil {
+		log.Printf("Error adding members to conversation %s: %v", conv.ID, err)
+		return c.Status(storeErrorStatus(err)).JSON(fiber.Map{
+			"error": "Failed to add members",
+		})
+	}
+	conv.Members = append(conv.Members, members...)
+
+	hub.conversationChanged(conv.ID, conv, nil)
+
+	return c.JSON(fiber.Map{
+		"conversation": conv,
+	})
+}
+
+// HandleRemoveMember removes another member from a group. The owner may
+// remove anyone, admins only plain members.
+func HandleRemoveMember(c *fiber.Ctx) error {
+	conv, self, err := memberConversation(c)
+	if conv == nil {
+		return err
+	}
+
+	targetID := c.Params("userId")
+	if targetID == self.UserID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Use leave to leave a conversation",
+		})
+	}
+	target, ok := conv.FindMember(targetID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User is not a member",
+		})
+	}
+
+	allowed := self.Role == store.RoleOwner || (self.Role == store.RoleAdmin && target.Role == store.RoleMember)
+	if !allowed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Not allowed to remove this member",
+		})
+	}
+
+	if err := conversationStore.RemoveMember(c.UserContext(), conv.ID, targetID); err != nil {
+		log.Printf("Error removing %s from conversation %s: %v", targetID, conv.ID, err)
+		return c.Status(storeErrorStatus(err)).JSON(fiber.Map{
+			"error": "Failed to remove member",
+		})
+	}
+	conv.Members = withoutMember(conv.Members, targetID)
+
+	hub.conversationChanged(conv.ID, conv, []string{targetID})
+
+	return c.JSON(fiber.Map{
+		"conversation": conv,
+	})
+}
+
+// HandleUpdateMemberRole makes a member an admin or a plain member again.
+// Only the owner may change roles.
+func HandleUpdateMemberRole(c *fiber.Ctx) error {
+	conv, self, err := memberConversation(c)
+	if conv == nil {
+		return err
+	}
+
+	var req UpdateMemberRoleBody
+	if err := c.BodyParser(&req); err != nil || (req.Role != store.RoleAdmin && req.Role != store.RoleMember) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be 'admin' or 'member'",
+		})
+	}
+
+	if self.Role != store.RoleOwner {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the owner can change roles",
+		})
+	}
+
+	targetID := c.Params("userId")
+	target, ok := conv.FindMember(targetID)
+	if !ok || targetID == self.UserID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User is not a member",
+		})
+	}
+
+	if err := conversationStore.UpdateMemberRole(c.UserContext(), conv.ID, targetID, req.Role); err != nil {
+		log.Printf("Error updating role of %s in conversation %s: %v", targetID, conv.ID, err)
+		return c.Status(storeErrorStatus(err)).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+	target.Role = req.Role
+
+	hub.conversationChanged(conv.ID, conv, nil)
+
+	return c.JSON(fiber.Map{
+		"conversation": conv,
+	})
+}
+
+// HandleLeaveConversation removes the caller from a group. When the owner
+// leaves, the longest-standing admin (or, failing that, member) takes over;
+// the last member to leave deletes the group. Its messages are kept.
+func HandleLeaveConversation(c *fiber.Ctx) error {
+	conv, self, err := memberConversation(c)
+	if conv == nil {
+		return err
+	}
+	userID := self.UserID
+	wasOwner := self.Role == store.RoleOwner
+
+	ctx := c.UserContext()
+	remaining := withoutMember(conv.Members, userID)
+	if len(remaining) == 0 {
+		err = conversationStore.DeleteConversation(ctx, conv.ID)
+	} else {
+		err = conversationStore.RemoveMember(ctx, conv.ID, userID)
+	}
+	if err != nil {
+		log.Printf("Error removing %s from conversation %s: %v", userID, conv.ID, err)
+		return c.Status(storeErrorStatus(err)).JSON(fiber.Map{
+			"error": "Failed to leave conversation",
+		})
+	}
+
+	if len(remaining) == 0 {
+		hub.conversationChanged(conv.ID, nil, []string{userID})
+		log.Printf("Conversation %s deleted after its last member left", conv.ID)
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	}
+
+	conv.Members = remaining
+	if wasOwner {
+		successor := &conv.Members[0]
+		for i := range conv.Members {
+			if conv.Members[i].Role == store.RoleAdmin {
+				successor = &conv.Members[i]
+				break
+			}
+		}
+		// The owner is already gone, so a failure here leaves the group
+		// without one; it is logged rather than undoing the leave
+		if err := conversationStore.UpdateMemberRole(ctx, conv.ID, successor.UserID, store.RoleOwner); err != nil {
+			log.Printf("Error handing conversation %s over to %s: %v", conv.ID, successor.UserID, err)
+		} else {
+			successor.Role = store.RoleOwner
+		}
+	}
+
+	hub.conversationChanged(conv.ID, conv, []string{userID})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// memberConversation loads the group named by the :id parameter along with
+// the caller's membership. If the caller is not a member, or the group cannot
+// be loaded, it writes the error response and returns a nil conversation
+// along with the result of writing it.
+func memberConversation(c *fiber.Ctx) (*store.Conversation, *store.Member, error) {
+	userID := auth.UserID(c)
+
+	conv, err := conversationStore.GetConversation(c.UserContext(), c.Params("id"))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error fetching conversation %s: %v", c.Params("id"), err)
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch conversation",
+		})
+	}
+
+	// Groups the caller is not in look the same as missing ones
+	var self *store.Member
+	if conv != nil {
+		self, _ = conv.FindMember(userID)
+	}
+	if self == nil {
+		return nil, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Conversation not found",
+		})
+	}
+	return conv, self, nil
+}
+
+// newMembers validates the users inviterID wants to add to conv: they must
+// be inviterID's friends, not members yet, and fit within maxGroupMembers.
+// It returns them without duplicates, or nil after writing the error
+// response, along with the result of writing it.
+func newMembers(c *fiber.Ctx, inviterID string, conv *store.Conversation, ids []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var memberIDs []string
+	for _, id := range ids {
+		if id == "" || id == inviterID || seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if _, ok := conv.FindMember(id); ok {
+			return nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "User is already a member",
+			})
+		}
+
+		friends, err := friendships.areFriends(c.UserContext(), inviterID, id)
+		if err != nil {
+			log.Printf("Error checking friendship between %s and %s: %v", inviterID, id, err)
+			return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check friendships",
+			})
+		}
+		if !friends {
+			return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Only friends can be added to a conversation",
+			})
+		}
+		memberIDs = append(memberIDs, id)
+	}
+
+	// Members of a new group are counted with their owner
+	total := len(conv.Members) + len(memberIDs)
+	if conv.ID == "" {
+		total++
+	}
+	if total > maxGroupMembers {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("A conversation can have at most %d members", maxGroupMembers),
+		})
+	}
+	if memberIDs == nil {
+		memberIDs = []string{}
+	}
+	return memberIDs, nil
+}
+
+// withoutMember returns members without userID
+func withoutMember(members []store.Member, userID string) []store.Member {
+	remaining := make([]store.Member, 0, len(members))
+	for _, m := range members {
+		if m.UserID != userID {
+			remaining = append(remaining, m)
+		}
+	}
+	return remaining
+}
+
+// conversationChanged drops the cached member list of a group, takes the
+// users in removed out of its call room and sends a conversation-updated to
+// every connected device of its members and of the removed users. conv is
+// nil when the group was deleted.
+func (h *Hub) conversationChanged(conversationID string, conv *store.Conversation, removed []string) {
+	conversationMembers.forget(conversationID)
+	h.removeFromRoom(conversationID, removed)
+
+	wrapperJSON, err := wrapMessage(MessageTypeConversationUpdated, ConversationUpdate{
+		ConversationID: conversationID,
+		Conversation:   conv,
+		Removed:        removed,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal conversation update: %v", err)
+		return
+	}
+
+	recipients := removed
+	if conv != nil {
+		for _, m := range conv.Members {
+			recipients = append(recipients, m.UserID)
+		}
+	}
+	for _, userID := range recipients {
+		for _, device := range h.devices(userID) {
+			h.sendTo(device, wrapperJSON)
+		}
+	}
+}
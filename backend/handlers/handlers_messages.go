@@ -1,129 +1,25 @@
 package handlers
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"os"
-	"sort"
+	"net"
 	"time"
 
+	"athena-backend/auth"
+	"athena-backend/store"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 )
 
-var hub = &Hub{
-	clients:    make(map[string]*Client),
-	broadcast:  make(chan *Message),
-	register:   make(chan *Client),
-	unregister: make(chan *Client),
-}
-
-// Initialize the hub
-func init() {
-	go hub.run()
-}
-
-// Run the hub to manage clients and messages
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client.UserID] = client
-			h.mu.Unlock()
-			log.Printf("Client registered: %s", client.UserID)
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client.UserID]; ok {
-				delete(h.clients, client.UserID)
-				close(client.Send)
-				log.Printf("Client unregistered: %s", client.UserID)
-			}
-			h.mu.Unlock()
-
-		case message := <-h.broadcast:
-			// Store message in Supabase
-			if err := storeMessage(message); err != nil {
-				log.Printf("Error storing message: %v", err)
-			}
-
-			// Send to recipient if online
-			h.mu.RLock()
-			recipientID := message.UserID2
-			if message.SenderID == message.UserID2 {
-				recipientID = message.UserID1
-			}
-
-			if client, ok := h.clients[recipientID]; ok {
-				messageJSON, _ := json.Marshal(message)
-				select {
-				case client.Send <- messageJSON:
-				default:
-					close(client.Send)
-					delete(h.clients, client.UserID)
-				}
-			}
-			h.mu.RUnlock()
-		}
-	}
-}
-
-// Store message in Supabase
-func storeMessage(msg *Message) error {
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_KEY")
-
-	// Create request body
-	body := map[string]interface{}{
-		"user_id_1":  msg.UserID1,
-		"user_id_2":  msg.UserID2,
-		"sender_id":  msg.SenderID,
-		"content":    msg.Content,
-		"created_at": msg.CreatedAt.Format(time.RFC3339),
-	}
-
-	bodyJSON, err := json.Marshal([]interface{}{body})
-	if err != nil {
-		return err
-	}
-
-	// Make HTTP request to Supabase REST API
-	url := fmt.Sprintf("%s/rest/v1/messages", supabaseURL)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyJSON))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+supabaseKey)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=minimal")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		log.Printf("Supabase insert error: Status %d, Body: %s", resp.StatusCode, string(bodyBytes))
-		return fmt.Errorf("failed to insert message: %d", resp.StatusCode)
-	}
-
-	return nil
-}
-
 // WebSocket connection handler
 func HandleWebSocket(c *websocket.Conn) {
 	// Get AUTHENTICATED user ID from context (not from query!)
-	userIDInterface := c.Locals("authenticated_user_id")
+	userIDInterface := c.Locals(auth.LocalUserID)
 	if userIDInterface == nil {
 		log.Println("No authenticated user in WebSocket context")
 		c.Close()
@@ -134,10 +30,10 @@ func HandleWebSocket(c *websocket.Conn) {
 	log.Printf("Authenticated WebSocket connection for user: %s", userID)
 
 	client := &Client{
+		ID:     uuid.NewString(),
 		UserID: userID,
 		Conn:   c,
 		Send:   make(chan []byte, 256),
-		State:  StateIdle, // New connections start in idle state
 	}
 
 	hub.register <- client
@@ -154,15 +50,26 @@ func (c *Client) readPump() {
 		c.Conn.Close()
 	}()
 
+	// Every pong (and message) proves the connection is alive
+	c.Conn.SetReadLimit(wsConfig.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(wsConfig.PongTimeout))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(wsConfig.PongTimeout))
+	})
+
 	for {
 		var wsMsg WebSocketMessage
 		err := c.Conn.ReadJSON(&wsMsg)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("Reaping connection %s of user %s: no pong within %s", c.ID, c.UserID, wsConfig.PongTimeout)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break // Exit loop on error
 		}
+		c.Conn.SetReadDeadline(time.Now().Add(wsConfig.PongTimeout))
 
 		switch wsMsg.Type {
 
@@ -174,16 +81,43 @@ func (c *Client) readPump() {
 				continue // Skip this message, continue loop
 			}
 
-			// Ensure user_id_1 < user_id_2 for consistency
-			userIDs := []string{msg.UserID1, msg.UserID2}
-			sort.Strings(userIDs)
-			msg.UserID1 = userIDs[0]
-			msg.UserID2 = userIDs[1]
-			msg.CreatedAt = time.Now()
+			// Sender and pair come from the authenticated connection
+			if reason := c.prepareChat(&msg); reason != "" {
+				log.Printf("Rejected chat from %s (recipient %q, conversation %q): %s", c.UserID, msg.RecipientID, msg.ConversationID, reason)
+				sendChatError(hub, c, reason, &msg)
+				continue
+			}
+
+			// The message ends the sender's typing indicator
+			hub.stopTyping(typingKey{userID: c.UserID, conversationID: msg.ConversationID}, false)
 
 			// Broadcast message
 			hub.broadcast <- &msg
 
+		case MessageTypeDelivered, MessageTypeRead:
+			var receipt MessageReceipt
+			err := json.Unmarshal(wsMsg.Payload, &receipt)
+			if err != nil {
+				log.Printf("Error unmarshaling %s: %v", wsMsg.Type, err)
+				continue
+			}
+			err = HandleMessageReceipt(hub, c, wsMsg.Type, &receipt)
+			if err != nil {
+				log.Printf("Error handling %s: %v", wsMsg.Type, err)
+			}
+
+		case MessageTypeTyping:
+			var typing Typing
+			err := json.Unmarshal(wsMsg.Payload, &typing)
+			if err != nil {
+				log.Printf("Error unmarshaling typing: %v", err)
+				continue
+			}
+			err = HandleTyping(hub, c, &typing)
+			if err != nil {
+				log.Printf("Error handling typing: %v", err)
+			}
+
 		case MessageTypeCallOffer:
 			var sdpOffer CallSDP
 			err := json.Unmarshal(wsMsg.Payload, &sdpOffer)
@@ -232,123 +166,228 @@ func (c *Client) readPump() {
 				log.Printf("Error handling call-end: %v", err)
 			}
 
+		case MessageTypeRenegotiate:
+			var sdp CallSDP
+			err := json.Unmarshal(wsMsg.Payload, &sdp)
+			if err != nil {
+				log.Printf("Error unmarshaling call-renegotiate: %v", err)
+				continue
+			}
+			err = HandleCallRenegotiate(hub, c, &sdp)
+			if err != nil {
+				log.Printf("Error handling call-renegotiate: %v", err)
+			}
+
+		case MessageTypeCallDecline:
+			var decline CallEnd
+			err := json.Unmarshal(wsMsg.Payload, &decline)
+			if err != nil {
+				log.Printf("Error unmarshaling call-decline: %v", err)
+				continue
+			}
+			err = HandleCallDecline(hub, c, &decline)
+			if err != nil {
+				log.Printf("Error handling call-decline: %v", err)
+			}
+
+		case MessageTypeCallCancel:
+			var cancel CallEnd
+			err := json.Unmarshal(wsMsg.Payload, &cancel)
+			if err != nil {
+				log.Printf("Error unmarshaling call-cancel: %v", err)
+				continue
+			}
+			err = HandleCallCancel(hub, c, &cancel)
+			if err != nil {
+				log.Printf("Error handling call-cancel: %v", err)
+			}
+
+		case MessageTypeRoomJoin:
+			var join RoomJoin
+			err := json.Unmarshal(wsMsg.Payload, &join)
+			if err != nil {
+				log.Printf("Error unmarshaling room-join: %v", err)
+				continue
+			}
+			err = HandleRoomJoin(hub, c, &join)
+			if err != nil {
+				log.Printf("Error handling room-join: %v", err)
+			}
+
+		case MessageTypeRoomLeave:
+			var leave RoomLeave
+			err := json.Unmarshal(wsMsg.Payload, &leave)
+			if err != nil {
+				log.Printf("Error unmarshaling room-leave: %v", err)
+				continue
+			}
+			err = HandleRoomLeave(hub, c, &leave)
+			if err != nil {
+				log.Printf("Error handling room-leave: %v", err)
+			}
+
+		case MessageTypeRoomOffer, MessageTypeRoomAnswer, MessageTypeRoomIceCandidate:
+			var signal RoomSignal
+			err := json.Unmarshal(wsMsg.Payload, &signal)
+			if err != nil {
+				log.Printf("Error unmarshaling %s: %v", wsMsg.Type, err)
+				continue
+			}
+			err = HandleRoomSignal(hub, c, wsMsg.Type, &signal)
+			if err != nil {
+				log.Printf("Error handling %s: %v", wsMsg.Type, err)
+			}
+
+		case MessageTypeSFUOffer, MessageTypeSFUAnswer, MessageTypeSFUIceCandidate:
+			var signal SFUSignal
+			err := json.Unmarshal(wsMsg.Payload, &signal)
+			if err != nil {
+				log.Printf("Error unmarshaling %s: %v", wsMsg.Type, err)
+				continue
+			}
+			err = HandleSFUSignal(hub, c, wsMsg.Type, &signal)
+			if err != nil {
+				log.Printf("Error handling %s: %v", wsMsg.Type, err)
+			}
+
+		case MessageTypeSFULayer:
+			var layer SFULayer
+			err := json.Unmarshal(wsMsg.Payload, &layer)
+			if err != nil {
+				log.Printf("Error unmarshaling sfu-layer: %v", err)
+				continue
+			}
+			err = HandleSFULayer(hub, c, &layer)
+			if err != nil {
+				log.Printf("Error handling sfu-layer: %v", err)
+			}
+
 		default:
 			log.Printf("Unknown message type: %s from user %s", wsMsg.Type, c.UserID)
 		}
 	}
 }
 
-// Write messages to WebSocket
+// Write messages to WebSocket and ping it every PingInterval
 func (c *Client) writePump() {
+	ticker := time.NewTicker(wsConfig.PingInterval)
 	defer func() {
+		ticker.Stop()
 		c.Conn.Close()
 	}()
 
-	for message := range c.Send {
-		err := c.Conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			return
+	for {
+		select {
+		case message, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(wsConfig.WriteTimeout))
+			if !ok {
+				// The hub dropped this connection
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(wsConfig.WriteTimeout))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
-// HandleGetMessageHistory retrieves message history between two users
-func HandleGetMessageHistory(c *fiber.Ctx) error {
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_KEY")
-
-	// Get authorization token
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "No authorization token provided",
-		})
-	}
-
-	// Extract the token (format: "Bearer <token>")
-	token := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		token = authHeader[7:]
-	}
+// maxHistoryLimit caps the messages returned by one history request
+const maxHistoryLimit = 500
 
-	// Verify token and get user
-	client := authClient.WithToken(token)
-	user, err := client.GetUser()
-	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid token",
-		})
-	}
+// HandleGetMessageHistory retrieves the message history of a direct
+// conversation (friend_id) or of a group the caller is in (conversation_id),
+// with the status of each message and the receipts of the conversation
+func HandleGetMessageHistory(c *fiber.Ctx) error {
+	userID := auth.UserID(c)
 
-	// Get friend ID from query params
+	// Get friend or conversation ID from query params
 	friendID := c.Query("friend_id")
-	if friendID == "" {
+	conversationID := c.Query("conversation_id")
+	if friendID == "" && conversationID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "friend_id is required",
+			"error": "friend_id or conversation_id is required",
 		})
 	}
 
 	limit := c.QueryInt("limit", 100)
 	offset := c.QueryInt("offset", 0)
+	if limit <= 0 || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "limit must be positive and offset must not be negative",
+		})
+	}
+	limit = min(limit, maxHistoryLimit)
 
 	// Get optional 'since' parameter for incremental sync
-	sinceParam := c.Query("since")
-
-	// Ensure user_id_1 < user_id_2
-	userIDs := []string{user.ID.String(), friendID}
-	sort.Strings(userIDs)
-	userID1 := userIDs[0]
-	userID2 := userIDs[1]
-
-	// Build query URL with optional 'since' filter
-	var url string
-	if sinceParam != "" {
-		// Incremental sync: fetch only messages created after 'since' timestamp
-		url = fmt.Sprintf("%s/rest/v1/messages?user_id_1=eq.%s&user_id_2=eq.%s&created_at=gt.%s&order=created_at.asc&limit=%d",
-			supabaseURL, userID1, userID2, sinceParam, limit)
-	} else {
-		// Full sync: fetch all messages with limit and offset
-		url = fmt.Sprintf("%s/rest/v1/messages?user_id_1=eq.%s&user_id_2=eq.%s&order=created_at.asc&limit=%d&offset=%d",
-			supabaseURL, userID1, userID2, limit, offset)
+	query := store.MessageQuery{
+		Limit:  limit,
+		Offset: offset,
 	}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create request",
-		})
+	if sinceParam := c.Query("since"); sinceParam != "" {
+		since, err := time.Parse(time.RFC3339Nano, sinceParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "since must be an RFC 3339 timestamp",
+			})
+		}
+		query.Since = &since
 	}
 
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+supabaseKey)
+	var members []store.Member
+	if conversationID != "" {
+		conv, err := conversationStore.GetConversation(c.UserContext(), conversationID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Error fetching conversation %s: %v", conversationID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch messages",
+			})
+		}
+		if conv == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Conversation not found",
+			})
+		}
+		if _, ok := conv.FindMember(userID); !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Conversation not found",
+			})
+		}
+		query.ConversationID = conversationID
+		members = conv.Members
+	} else {
+		// Ensure user_id_1 < user_id_2
+		query.UserID1, query.UserID2 = store.SortedPair(userID, friendID)
+		conversationID = store.DirectConversationID(userID, friendID)
+		members = []store.Member{{UserID: userID}, {UserID: friendID}}
+	}
 
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
+	// Messages are read with the API key, the same credentials the hub writes them with
+	messages, err := messageStore.ListMessages(c.UserContext(), query)
 	if err != nil {
 		log.Printf("Error fetching messages: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch messages",
 		})
 	}
-	defer resp.Body.Close()
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+	receipts, err := receiptStore.ListReceipts(c.UserContext(), conversationID)
 	if err != nil {
+		log.Printf("Error fetching receipts of conversation %s: %v", conversationID, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read response",
-		})
-	}
-
-	var messages []Message
-	if err := json.Unmarshal(bodyBytes, &messages); err != nil {
-		log.Printf("Error unmarshaling messages: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to parse messages",
+			"error": "Failed to fetch messages",
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"messages":     messages,
-		"current_user": user.ID.String(),
+		"messages":     withStatus(messages, members, receipts),
+		"receipts":     receipts,
+		"current_user": userID,
 	})
 }
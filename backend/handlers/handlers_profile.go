@@ -1,76 +1,34 @@
 package handlers
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
+	"errors"
 	"log"
-	"net/http"
-	"os"
+
+	"athena-backend/auth"
+	"athena-backend/store"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 func HandleCheckProfile(c *fiber.Ctx) error {
-	// Get the authorization header
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Authorization header is required",
-		})
-	}
-
-	// Extract the token
-	token := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		token = authHeader[7:]
-	}
-
-	// Get user info
-	client := authClient.WithToken(token)
-	user, err := client.GetUser()
-
-	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid or expired token",
-		})
-	}
-
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_KEY")
+	userID := auth.UserID(c)
 
 	// Check if profile exists
-	req, err := http.NewRequest("GET", supabaseURL+"/rest/v1/user_profiles?id=eq."+user.ID.String(), nil)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to check profile",
-		})
-	}
-
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+	profile, err := profileStore.GetProfile(userContext(c), userID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error checking profile: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to check profile",
 		})
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var profiles []map[string]interface{}
-	json.Unmarshal(body, &profiles)
 
 	result := fiber.Map{
-		"exists": len(profiles) > 0,
+		"exists": profile != nil,
 	}
 
 	// If profile exists, include the UID
-	if len(profiles) > 0 {
-		if uid, ok := profiles[0]["uid"]; ok {
-			result["uid"] = uid
-		}
+	if profile != nil {
+		result["uid"] = profile.UID
 	}
 
 	return c.JSON(result)
@@ -90,110 +48,24 @@ func HandleCreateProfile(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get the authorization header
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Authorization header is required",
-		})
-	}
-
-	// Extract the token
-	token := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		token = authHeader[7:]
-	}
-
-	// Get user info
-	client := authClient.WithToken(token)
-	user, err := client.GetUser()
-
-	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid or expired token",
-		})
-	}
-
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_KEY")
-
-	// Call PostgreSQL function via Supabase RPC
-	rpcPayload := map[string]interface{}{
-		"p_user_id": user.ID.String(),
-		"p_name":    req.Name,
-	}
-
-	jsonData, _ := json.Marshal(rpcPayload)
-
-	httpReq, err := http.NewRequest("POST", supabaseURL+"/rest/v1/rpc/create_user_profile", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create profile",
-		})
-	}
-
-	httpReq.Header.Set("apikey", supabaseKey)
-	httpReq.Header.Set("Authorization", "Bearer "+token)
-	httpReq.Header.Set("Content-Type", "application/json")
+	userID := auth.UserID(c)
 
-	resp, err := http.DefaultClient.Do(httpReq)
+	// Create the profile via the create_user_profile database function
+	profile, err := profileStore.CreateProfile(userContext(c), userID, req.Name)
 	if err != nil {
-		log.Printf("Error calling Supabase function: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create profile",
-		})
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode != 200 {
-		log.Printf("Supabase error: %s", string(body))
-		return c.Status(resp.StatusCode).JSON(fiber.Map{
-			"error": "Failed to create profile",
-		})
-	}
-
-	var profile []map[string]interface{}
-	json.Unmarshal(body, &profile)
-
-	if len(profile) == 0 {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		log.Printf("Error creating profile: %v", err)
+		return c.Status(storeErrorStatus(err)).JSON(fiber.Map{
 			"error": "Failed to create profile",
 		})
 	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
-		"profile": profile[0],
+		"profile": profile,
 	})
 }
 
 func HandleCheckId(c *fiber.Ctx) error {
-	// Get the authorization header
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Authorization header is required",
-		})
-	}
-
-	// Extract the token
-	token := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		token = authHeader[7:]
-	}
-
-	// Verify the authenticated user
-	client := authClient.WithToken(token)
-	_, err := client.GetUser()
-
-	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid or expired token",
-		})
-	}
-
 	// Get the user ID from query parameter or path parameter
 	userId := c.Query("id")
 	if userId == "" {
@@ -206,41 +78,22 @@ func HandleCheckId(c *fiber.Ctx) error {
 		})
 	}
 
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_KEY")
-
-	// Check if profile exists and get only the name column
-	req, err := http.NewRequest("GET", supabaseURL+"/rest/v1/user_profiles?id=eq."+userId+"&select=name", nil)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to check profile",
-		})
-	}
-
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+	// Check if profile exists and get its name
+	profile, err := profileStore.GetProfile(userContext(c), userId)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error checking profile: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to check profile",
 		})
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var profiles []map[string]interface{}
-	json.Unmarshal(body, &profiles)
 
 	result := fiber.Map{
-		"exists": len(profiles) > 0,
+		"exists": profile != nil,
 	}
 
 	// If profile exists, include the name
-	if len(profiles) > 0 {
-		if name, ok := profiles[0]["name"]; ok {
-			result["name"] = name
-		}
+	if profile != nil {
+		result["name"] = profile.Name
 	}
 
 	return c.JSON(result)
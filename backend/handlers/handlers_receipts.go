@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"athena-backend/store"
+)
+
+// How long delivered messages are remembered for receipts
+const recentMessageTTL = 10 * time.Minute
+
+type recentEntry struct {
+	message store.Message // without its content
+	expires time.Time
+}
+
+// recentMessages remembers the messages the hub delivered lately. Receipts
+// mostly name one of them, and with an outbox a delivered message may not
+// be in the database yet.
+type recentMessages struct {
+	mu        sync.Mutex
+	entries   map[string]recentEntry
+	lastPrune time.Time
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{entries: make(map[string]recentEntry)}
+}
+
+// remember records a delivered message and, once a minute, prunes expired ones
+func (rm *recentMessages) remember(msg *Message) {
+	now := time.Now()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if now.Sub(rm.lastPrune) > time.Minute {
+		for id, e := range rm.entries {
+			if now.After(e.expires) {
+				delete(rm.entries, id)
+			}
+		}
+		rm.lastPrune = now
+	}
+	rm.entries[msg.ID] = recentEntry{
+		message: store.Message{
+			ID:             msg.ID,
+			ConversationID: msg.ConversationID,
+			UserID1:        msg.UserID1,
+			UserID2:        msg.UserID2,
+			SenderID:       msg.SenderID,
+			CreatedAt:      msg.CreatedAt,
+		},
+		expires: now.Add(recentMessageTTL),
+	}
+}
+
+func (rm *recentMessages) lookup(id string) (store.Message, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	entry, ok := rm.entries[id]
+	if !ok || time.Now().After(entry.expires) {
+		return store.Message{}, false
+	}
+	return entry.message, true
+}
+
+// receiptMessage returns the message a receipt from userID names and the
+// users of its conversation, which userID must be one of
+func (h *Hub) receiptMessage(ctx context.Context, userID, messageID string) (*store.Message, []string, error) {
+	msg, ok := h.recent.lookup(messageID)
+	if !ok {
+		stored, err := messageStore.GetMessage(ctx, messageID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("looking up message %s: %w", messageID, err)
+		}
+		msg = *stored
+	}
+
+	var participants []string
+	if msg.UserID1 != "" {
+		participants = []string{msg.UserID1, msg.UserID2}
+		if msg.ConversationID == "" {
+			msg.ConversationID = store.DirectConversationID(msg.UserID1, msg.UserID2)
+		}
+	} else {
+		members, err := conversationMembers.members(ctx, msg.ConversationID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, nil, fmt.Errorf("loading members of conversation %s: %w", msg.ConversationID, err)
+		}
+		participants = members
+	}
+	if !slices.Contains(participants, userID) {
+		return nil, nil, fmt.Errorf("%s is not in the conversation of message %s", userID, messageID)
+	}
+	return &msg, participants, nil
+}
+
+// HandleMessageReceipt moves the sender's delivered (message-delivered) or
+// read (message-read) watermark in a conversation up to the named message.
+// A read message counts as delivered too. When the watermark moves, delivery
+// is reported to the message's sender and reading to every device in the
+// conversation, the reader's other devices included, since it covers
+// messages of any sender. Receipts that would move a watermark back are
+// dropped silently.
+func HandleMessageReceipt(hub *Hub, sender *Client, msgType string, receipt *MessageReceipt) error {
+	if receipt.MessageID == "" {
+		return errors.New("message_id is required")
+	}
+
+	ctx := context.Background()
+	msg, participants, err := hub.receiptMessage(ctx, sender.UserID, receipt.MessageID)
+	if err != nil {
+		return err
+	}
+
+	watermark := store.ReceiptDelivered
+	if msgType == MessageTypeRead {
+		watermark = store.ReceiptRead
+	}
+	moved, err := receiptStore.AdvanceReceipt(ctx, msg.ConversationID, sender.UserID, watermark, msg.ID, msg.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("storing %s receipt of %s: %w", watermark, sender.UserID, err)
+	}
+	if watermark == store.ReceiptRead {
+		if _, err := receiptStore.AdvanceReceipt(ctx, msg.ConversationID, sender.UserID, store.ReceiptDelivered, msg.ID, msg.CreatedAt); err != nil {
+			log.Printf("Error storing delivered receipt of %s: %v", sender.UserID, err)
+		}
+	}
+	if !moved {
+		return nil
+	}
+
+	recipients := participants
+	if watermark == store.ReceiptDelivered {
+		if msg.SenderID == sender.UserID {
+			return nil
+		}
+		recipients = []string{msg.SenderID}
+	}
+
+	wrapperJSON, err := wrapMessage(msgType, MessageReceipt{
+		MessageID:      msg.ID,
+		ConversationID: msg.ConversationID,
+		UserID:         sender.UserID,
+		CreatedAt:      &msg.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling %s: %w", msgType, err)
+	}
+	for _, userID := range recipients {
+		for _, device := range hub.devices(userID) {
+			if device != sender {
+				hub.sendTo(device, wrapperJSON)
+			}
+		}
+	}
+	return nil
+}
+
+// withStatus gives each message the status it has for the rest of its
+// conversation: read once all the others read it, delivered once all of
+// them received it, else sent. Members who joined after a message do not
+// count for it.
+func withStatus(messages []store.Message, members []store.Member, receipts []store.Receipt) []HistoryMessage {
+	byUser := make(map[string]*store.Receipt, len(receipts))
+	for i := range receipts {
+		byUser[receipts[i].UserID] = &receipts[i]
+	}
+
+	history := make([]HistoryMessage, len(messages))
+	for i, msg := range messages {
+		status, counted := StatusRead, false
+		for _, m := range members {
+			if m.UserID == msg.SenderID || m.JoinedAt.After(msg.CreatedAt) {
+				continue
+			}
+			counted = true
+			if s := receiptStatus(byUser[m.UserID], msg.CreatedAt); statusRank(s) < statusRank(status) {
+				status = s
+			}
+		}
+		if !counted {
+			status = StatusSent
+		}
+		history[i] = HistoryMessage{Message: msg, Status: status}
+	}
+	return history
+}
+
+// receiptStatus is the status of a message created at createdAt for the
+// user whose watermarks are r
+func receiptStatus(r *store.Receipt, createdAt time.Time) string {
+	switch {
+	case r == nil:
+		return StatusSent
+	case r.LastReadAt != nil && !createdAt.After(*r.LastReadAt):
+		return StatusRead
+	case r.LastDeliveredAt != nil && !createdAt.After(*r.LastDeliveredAt):
+		return StatusDelivered
+	}
+	return StatusSent
+}
+
+func statusRank(status string) int {
+	switch status {
+	case StatusRead:
+		return 2
+	case StatusDelivered:
+		return 1
+	}
+	return 0
+}
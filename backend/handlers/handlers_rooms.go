@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"athena-backend/calls"
+	"athena-backend/store"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// currentRoom returns the group call room this device is in
+func (c *Client) currentRoom() *calls.Room {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.room
+}
+
+// tryJoinRoom puts an idle device in a room. It returns false if the device
+// is ringing, in a call or already in a room.
+func (c *Client) tryJoinRoom(room *calls.Room) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.call != nil || c.room != nil {
+		return false
+	}
+	c.room = room
+	return true
+}
+
+// leaveRoom takes the device out of room
+func (c *Client) leaveRoom(room *calls.Room) {
+	c.mu.Lock()
+	if c.room == room {
+		c.room = nil
+	}
+	c.mu.Unlock()
+}
+
+// sendRoomError tells a device its room request or signalling frame was rejected
+func sendRoomError(hub *Hub, client *Client, roomErr RoomErrorResponse) {
+	wrapperJSON, err := wrapMessage(MessageTypeRoomError, roomErr)
+	if err != nil {
+		log.Errorf("Failed to marshal room error: %v", err)
+		return
+	}
+
+	if hub.sendTo(client, wrapperJSON) {
+		log.Infof("Sent room error to %s: %s", client.UserID, roomErr.Reason)
+	} else {
+		log.Warnf("Failed to send room error to %s: channel full", client.UserID)
+	}
+}
+
+// roomErrorReason maps a room error to the reason sent in room-error
+func roomErrorReason(err error) string {
+	switch {
+	case errors.Is(err, calls.ErrUnknownRoom):
+		return "unknown_room"
+	case errors.Is(err, calls.ErrRoomFull):
+		return "room_full"
+	case errors.Is(err, calls.ErrInRoom):
+		return "already_in_room"
+	default:
+		return "not_participant"
+	}
+}
+
+// roomEvent describes room for the room-* announcements
+func roomEvent(room *calls.Room, userID, reason string) RoomEvent {
+	return RoomEvent{
+		RoomID:         room.ID,
+		ConversationID: room.ConversationID,
+		UserID:         userID,
+		CallType:       callTypeOf(room.Media),
+		Topology:       room.Topology,
+		Reason:         reason,
+	}
+}
+
+// sendToRoom sends a room-* frame to the device of every participant except skip
+func (h *Hub) sendToRoom(room *calls.Room, skip *Client, msgType string, payload interface{}) {
+	wrapperJSON, err := wrapMessage(msgType, payload)
+	if err != nil {
+		log.Errorf("Failed to marshal %s: %v", msgType, err)
+		return
+	}
+
+	for _, p := range room.Participants() {
+		device := h.device(p.UserID, p.Conn)
+		if device == nil || device == skip {
+			continue
+		}
+		if !h.sendTo(device, wrapperJSON) {
+			log.Warnf("Room %s: failed to send %s to %s: channel full or closed", room.ID, msgType, p.UserID)
+		}
+	}
+}
+
+// announceRoom tells every connected device of the group's members, except
+// skip, that its room opened or closed, so they can offer to join
+func (h *Hub) announceRoom(room *calls.Room, skip *Client, msgType string, event RoomEvent) {
+	members, err := conversationMembers.members(context.Background(), room.ConversationID)
+	if err != nil {
+		log.Warnf("Room %s: cannot announce %s, members of %s unavailable: %v", room.ID, msgType, room.ConversationID, err)
+		return
+	}
+
+	wrapperJSON, err := wrapMessage(msgType, event)
+	if err != nil {
+		log.Errorf("Failed to marshal %s: %v", msgType, err)
+		return
+	}
+	for _, userID := range members {
+		for _, device := range h.devices(userID) {
+			if device != skip {
+				h.sendTo(device, wrapperJSON)
+			}
+		}
+	}
+}
+
+// roomFor resolves the room a frame names and checks that the sending device
+// is in it. Rejected frames get a room-error back.
+func (h *Hub) roomFor(sender *Client, roomID string, receiverID string) (*calls.Room, error) {
+	room, err := h.rooms.Get(roomID)
+	if err == nil && sender.currentRoom() != room {
+		err = calls.ErrNotParticipant
+	}
+
+	if err != nil {
+		log.Warnf("Rejected room frame from %s for room %q: %v", sender.UserID, roomID, err)
+		sendRoomError(h, sender, RoomErrorResponse{RoomID: roomID, Reason: roomErrorReason(err), ReceiverID: receiverID})
+		return nil, err
+	}
+	return room, nil
+}
+
+// leaveRoom takes a device out of its room and tells the remaining
+// participants. The last one out closes the room, which the group's members
+// are told about.
+func (h *Hub) leaveRoom(client *Client, room *calls.Room, reason string) {
+	client.leaveRoom(room)
+	ended, err := h.rooms.Leave(room, client.UserID)
+	if err != nil {
+		return
+	}
+	leaveSFU(room, client.UserID)
+	releaseRelays(client.UserID)
+
+	if ended {
+		log.Infof("Room %s of conversation %s closed: last participant %s left (%s)", room.ID, room.ConversationID, client.UserID, reason)
+		// Looking up the members may hit the store, which the hub must not wait for
+		go h.announceRoom(room, nil, MessageTypeRoomEnded, roomEvent(room, "", ""))
+		return
+	}
+
+	log.Infof("Room %s: %s left (%s)", room.ID, client.UserID, reason)
+	h.sendToRoom(room, nil, MessageTypeRoomLeft, roomEvent(room, client.UserID, reason))
+}
+
+// dropFromRoom takes a departing device out of its room
+func (h *Hub) dropFromRoom(client *Client, reason string) {
+	if room := client.currentRoom(); room != nil {
+		h.leaveRoom(client, room, reason)
+	}
+}
+
+// removeFromRoom takes users who left a group out of its room; their device
+// gets the room-left too
+func (h *Hub) removeFromRoom(conversationID string, userIDs []string) {
+	room, ok := h.rooms.ForConversation(conversationID)
+	if !ok {
+		return
+	}
+
+	for _, userID := range userIDs {
+		p, ok := room.Participant(userID)
+		if !ok {
+			continue
+		}
+		device := h.device(userID, p.Conn)
+		if device == nil || device.currentRoom() != room {
+			continue
+		}
+
+		h.leaveRoom(device, room, calls.ReasonRemoved)
+		if wrapperJSON, err := wrapMessage(MessageTypeRoomLeft, roomEvent(room, userID, calls.ReasonRemoved)); err == nil {
+			h.sendTo(device, wrapperJSON)
+		}
+	}
+}
+
+// HandleRoomJoin puts the sending device in the call room of a group it is a
+// member of, opening the room if the group has none. The device gets a
+// room-state listing everyone already in the room, whom it should each send a
+// room-offer; they get a room-joined. When the room opens, the group's other
+// members get a room-started. A device can only be in one room and not in a
+// one-to-one call at the same time.
+//
+// Whoever opens the room picks its topology. In an SFU room the device
+// instead offers its publisher connection to the server with an sfu-offer
+// and is offered everyone else's media on its subscriber connection.
+func HandleRoomJoin(hub *Hub, sender *Client, join *RoomJoin) error {
+	fail := func(reason string) {
+		sendRoomError(hub, sender, RoomErrorResponse{ConversationID: join.ConversationID, Reason: reason})
+	}
+
+	if join.ConversationID == "" {
+		fail("invalid_room")
+		return fmt.Errorf("room-join from %s needs a conversation_id", sender.UserID)
+	}
+	media, ok := join.CallType.media()
+	if !ok {
+		fail("invalid_media")
+		return fmt.Errorf("room-join from %s has unknown call type %d", sender.UserID, join.CallType)
+	}
+	opts, reason := roomOptions(join, media)
+	if reason != "" {
+		fail(reason)
+		return fmt.Errorf("room-join from %s asks for topology %q: %s", sender.UserID, join.Topology, reason)
+	}
+	if sender.currentCall() != nil || sender.currentRoom() != nil {
+		fail("already_in_call")
+		return fmt.Errorf("device %s of %s is already in a call", sender.ID, sender.UserID)
+	}
+
+	members, err := conversationMembers.members(context.Background(), join.ConversationID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		fail("unavailable")
+		return fmt.Errorf("members of %s unavailable: %w", join.ConversationID, err)
+	}
+	if !slices.Contains(members, sender.UserID) {
+		fail("not_member")
+		return fmt.Errorf("%s is not a member of %s", sender.UserID, join.ConversationID)
+	}
+
+	room, opened, err := hub.rooms.Join(join.ConversationID, sender.UserID, sender.ID, opts)
+	if err != nil {
+		fail(roomErrorReason(err))
+		return err
+	}
+	// A call may have started ringing on this device in the meantime
+	if !sender.tryJoinRoom(room) {
+		hub.rooms.Leave(room, sender.UserID)
+		fail("already_in_call")
+		return fmt.Errorf("device %s of %s is already in a call", sender.ID, sender.UserID)
+	}
+	if room.Topology == calls.TopologySFU {
+		if err := hub.joinSFU(sender, room); err != nil {
+			hub.leaveRoom(sender, room, "sfu_failed")
+			fail("unavailable")
+			return fmt.Errorf("cannot connect %s to the SFU of room %s: %w", sender.UserID, room.ID, err)
+		}
+	}
+
+	stateJSON, err := wrapMessage(MessageTypeRoomState, RoomState{
+		RoomID:         room.ID,
+		ConversationID: room.ConversationID,
+		CallType:       callTypeOf(room.Media),
+		Topology:       room.Topology,
+		Participants:   room.Participants(),
+	})
+	if err != nil || !hub.sendTo(sender, stateJSON) {
+		hub.leaveRoom(sender, room, "delivery_failed")
+		return fmt.Errorf("cannot send room state to %s", sender.UserID)
+	}
+
+	if opened {
+		log.Infof("Room %s of conversation %s opened by %s (%s, %s)", room.ID, room.ConversationID, sender.UserID, media, room.Topology)
+		hub.announceRoom(room, sender, MessageTypeRoomStarted, roomEvent(room, sender.UserID, ""))
+		return nil
+	}
+
+	log.Infof("Room %s: %s joined (%d participant(s))", room.ID, sender.UserID, len(room.Participants()))
+	hub.sendToRoom(room, sender, MessageTypeRoomJoined, roomEvent(room, sender.UserID, ""))
+	return nil
+}
+
+// HandleRoomLeave takes the sending device out of its room
+func HandleRoomLeave(hub *Hub, sender *Client, leave *RoomLeave) error {
+	room, err := hub.roomFor(sender, leave.RoomID, "")
+	if err != nil {
+		return err
+	}
+	hub.leaveRoom(sender, room, calls.ReasonLeft)
+	return nil
+}
+
+// HandleRoomSignal forwards a room-offer, room-answer or room-ice-candidate
+// from one participant of a mesh room to another. Each pair of participants
+// negotiates its own peer connection; the server only checks both are in the
+// room and routes the frame to the receiver's device.
+func HandleRoomSignal(hub *Hub, sender *Client, msgType string, signal *RoomSignal) error {
+	room, err := hub.roomFor(sender, signal.RoomID, signal.Receiver)
+	if err != nil {
+		return err
+	}
+	if room.Topology != calls.TopologyMesh {
+		sendRoomError(hub, sender, RoomErrorResponse{RoomID: room.ID, Reason: "invalid_topology", ReceiverID: signal.Receiver})
+		return fmt.Errorf("room %s does not use mesh signalling", room.ID)
+	}
+	signal.Sender = sender.UserID
+
+	peer, ok := room.Participant(signal.Receiver)
+	if !ok || signal.Receiver == sender.UserID {
+		sendRoomError(hub, sender, RoomErrorResponse{RoomID: room.ID, Reason: "not_participant", ReceiverID: signal.Receiver})
+		return fmt.Errorf("%s is not in room %s", signal.Receiver, room.ID)
+	}
+
+	wrapperJSON, err := wrapMessage(msgType, signal)
+	if err != nil {
+		log.Errorf("Failed to marshal %s: %v", msgType, err)
+		return err
+	}
+
+	target := hub.device(peer.UserID, peer.Conn)
+	if target == nil || target.currentRoom() != room || !hub.sendTo(target, wrapperJSON) {
+		log.Errorf("Room %s: failed to send %s to %s: channel full or closed", room.ID, msgType, signal.Receiver)
+		sendRoomError(hub, sender, RoomErrorResponse{RoomID: room.ID, Reason: "delivery_failed", ReceiverID: signal.Receiver})
+		return fmt.Errorf("failed to send to receiver: channel full")
+	}
+
+	log.Infof("Room %s: forwarded %s from %s to %s", room.ID, msgType, sender.UserID, signal.Receiver)
+	return nil
+}
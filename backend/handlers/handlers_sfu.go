@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"fmt"
+
+	"athena-backend/calls"
+	"athena-backend/sfu"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pion/webrtc/v4"
+)
+
+// sfuServer forwards the media of SFU rooms, if enabled
+var sfuServer *sfu.SFU
+
+// sfuRoomSize caps the participants of an SFU room
+var sfuRoomSize = 25
+
+// SetSFU lets clients open rooms whose media goes through the SFU, holding up
+// to maxParticipants each (zero keeps the default)
+func SetSFU(s *sfu.SFU, maxParticipants int) {
+	sfuServer = s
+	if maxParticipants > 0 {
+		sfuRoomSize = maxParticipants
+	}
+}
+
+// roomOptions are the options of a room opened by join, or the reason
+// they are rejected
+func roomOptions(join *RoomJoin, media calls.Media) (calls.RoomOptions, string) {
+	switch join.Topology {
+	case "", calls.TopologyMesh:
+		return calls.RoomOptions{Media: media, Topology: calls.TopologyMesh, Size: calls.MaxRoomSize}, ""
+	case calls.TopologySFU:
+		if sfuServer == nil {
+			return calls.RoomOptions{}, "sfu_unavailable"
+		}
+		return calls.RoomOptions{Media: media, Topology: calls.TopologySFU, Size: sfuRoomSize}, ""
+	default:
+		return calls.RoomOptions{}, "invalid_topology"
+	}
+}
+
+// joinSFU connects a device that joined an SFU room to the SFU, whose
+// signals are sent to the device as sfu-* frames
+func (h *Hub) joinSFU(client *Client, room *calls.Room) error {
+	_, err := sfuServer.Join(room.ID, client.UserID, func(signal sfu.Signal) {
+		msgType, payload := sfuFrame(room, signal)
+		wrapperJSON, err := wrapMessage(msgType, payload)
+		if err != nil {
+			log.Errorf("Failed to marshal %s: %v", msgType, err)
+			return
+		}
+		if !h.sendTo(client, wrapperJSON) {
+			log.Warnf("Room %s: failed to send %s to %s: channel full or closed", room.ID, msgType, client.UserID)
+		}
+	})
+	return err
+}
+
+// leaveSFU disconnects a participant of an SFU room from the SFU
+func leaveSFU(room *calls.Room, userID string) {
+	if room.Topology == calls.TopologySFU && sfuServer != nil {
+		sfuServer.Leave(room.ID, userID)
+	}
+}
+
+// sfuFrame turns a signal of the SFU into the frame sent to the participant
+func sfuFrame(room *calls.Room, signal sfu.Signal) (string, SFUSignal) {
+	frame := SFUSignal{RoomID: room.ID, Target: signal.Target}
+	switch signal.Type {
+	case sfu.SignalOffer:
+		frame.SdpString = signal.SDP
+		return MessageTypeSFUOffer, frame
+	case sfu.SignalAnswer:
+		frame.SdpString = signal.SDP
+		return MessageTypeSFUAnswer, frame
+	default:
+		frame.Candidate = signal.Candidate.Candidate
+		frame.SdpMid = signal.Candidate.SDPMid
+		frame.SdpIndex = signal.Candidate.SDPMLineIndex
+		return MessageTypeSFUIceCandidate, frame
+	}
+}
+
+// sfuPeer resolves the SFU connection of the sending device for a frame
+// naming an SFU room. Rejected frames get a room-error back.
+func (h *Hub) sfuPeer(sender *Client, roomID string) (*sfu.Peer, error) {
+	room, err := h.roomFor(sender, roomID, "")
+	if err != nil {
+		return nil, err
+	}
+	if room.Topology != calls.TopologySFU || sfuServer == nil {
+		sendRoomError(h, sender, RoomErrorResponse{RoomID: room.ID, Reason: "invalid_topology"})
+		return nil, fmt.Errorf("room %s does not use the SFU", room.ID)
+	}
+
+	peer, err := sfuServer.Peer(room.ID, sender.UserID)
+	if err != nil {
+		sendRoomError(h, sender, RoomErrorResponse{RoomID: room.ID, Reason: "not_participant"})
+		return nil, err
+	}
+	return peer, nil
+}
+
+// HandleSFUSignal applies an sfu-offer for the sender's publisher
+// connection, an sfu-answer for its subscriber connection, or an
+// sfu-ice-candidate for either. The SFU answers offers with an sfu-answer and
+// offers the subscriber connection again whenever the tracks forwarded to the
+// sender change.
+func HandleSFUSignal(hub *Hub, sender *Client, msgType string, signal *SFUSignal) error {
+	peer, err := hub.sfuPeer(sender, signal.RoomID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case msgType == MessageTypeSFUOffer && signal.Target == sfu.TargetPublisher:
+		err = peer.Offer(signal.SdpString)
+	case msgType == MessageTypeSFUAnswer && signal.Target == sfu.TargetSubscriber:
+		err = peer.Answer(signal.SdpString)
+	case msgType == MessageTypeSFUIceCandidate:
+		err = peer.AddCandidate(signal.Target, webrtc.ICECandidateInit{
+			Candidate:     signal.Candidate,
+			SDPMid:        signal.SdpMid,
+			SDPMLineIndex: signal.SdpIndex,
+		})
+	default:
+		err = sfu.ErrUnknownTarget
+	}
+
+	if err != nil {
+		log.Warnf("Room %s: rejected %s for the %s connection of %s: %v", signal.RoomID, msgType, signal.Target, sender.UserID, err)
+		sendRoomError(hub, sender, RoomErrorResponse{RoomID: signal.RoomID, Reason: "invalid_signal"})
+		return err
+	}
+	return nil
+}
+
+// HandleSFULayer picks the simulcast layer the SFU forwards to the sender
+// from one publisher
+func HandleSFULayer(hub *Hub, sender *Client, layer *SFULayer) error {
+	peer, err := hub.sfuPeer(sender, layer.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.SelectLayer(layer.PublisherID, layer.Layer); err != nil {
+		sendRoomError(hub, sender, RoomErrorResponse{RoomID: layer.RoomID, Reason: "not_participant", ReceiverID: layer.PublisherID})
+		return err
+	}
+	log.Infof("Room %s: %s receives layer %q of %s", layer.RoomID, sender.UserID, layer.Layer, layer.PublisherID)
+	return nil
+}
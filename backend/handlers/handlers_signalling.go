@@ -2,311 +2,646 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
+
+	"athena-backend/calls"
+	"athena-backend/store"
 
 	"github.com/gofiber/fiber/v2/log"
 )
 
+var errWrongDevice = errors.New("call is on another device")
+
+// currentCall returns the call this device is ringing for or in
+func (c *Client) currentCall() *calls.Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.call
+}
+
+// waitingCall returns the second call ringing on this busy device, if any
+func (c *Client) waitingCall() *calls.Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.waiting
+}
+
+// inCall reports whether session is this device's call or its waiting call
+func (c *Client) inCall(session *calls.Session) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.call == session || c.waiting == session
+}
+
+// tryJoinCall puts an idle device in a call. It returns false if the device
+// is busy, including in a group call room.
+func (c *Client) tryJoinCall(session *calls.Session) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.call != nil || c.room != nil {
+		return false
+	}
+	c.call = session
+	return true
+}
+
+// tryWaitCall rings a busy device for a second call. It returns false if the
+// device is idle or already has a call waiting.
+func (c *Client) tryWaitCall(session *calls.Session) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.call == nil || c.waiting != nil {
+		return false
+	}
+	c.waiting = session
+	return true
+}
+
+// leaveCall takes the device out of session. Once its current call is over, a
+// waiting call takes its place and keeps ringing.
+func (c *Client) leaveCall(session *calls.Session) {
+	c.mu.Lock()
+	switch session {
+	case c.call:
+		c.call, c.waiting = c.waiting, nil
+	case c.waiting:
+		c.waiting = nil
+	}
+	c.mu.Unlock()
+}
+
+// wrapMessage marshals payload inside a WebSocketMessage of the given type
+func wrapMessage(msgType string, payload interface{}) ([]byte, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(WebSocketMessage{
+		Type:    msgType,
+		Payload: json.RawMessage(payloadJSON),
+	})
+}
+
 // sendCallError sends an error response back to the client when a call cannot be established
-func sendCallError(client *Client, reason string, receiverID string) {
-	errResponse := CallErrorResponse{
+// or a signalling frame is rejected
+func sendCallError(hub *Hub, client *Client, callID string, reason string, receiverID string) {
+	wrapperJSON, err := wrapMessage(MessageTypeCallError, CallErrorResponse{
+		CallID:     callID,
 		Reason:     reason,
 		ReceiverID: receiverID,
-	}
-
-	errJSON, err := json.Marshal(errResponse)
+	})
 	if err != nil {
 		log.Errorf("Failed to marshal error response: %v", err)
 		return
 	}
 
-	wrapper := WebSocketMessage{
-		Type:    MessageTypeCallError,
-		Payload: json.RawMessage(errJSON),
+	if hub.sendTo(client, wrapperJSON) {
+		log.Infof("Sent call error to %s: %s", client.UserID, reason)
+	} else {
+		log.Warnf("Failed to send error to %s: channel full", client.UserID)
 	}
+}
 
-	wrapperJSON, err := json.Marshal(wrapper)
+// sendCallEnd tells one device that its call is over
+func sendCallEnd(hub *Hub, client *Client, callEnd *CallEnd) {
+	wrapperJSON, err := wrapMessage(MessageTypeCallEnd, callEnd)
 	if err != nil {
-		log.Errorf("Failed to marshal error wrapper: %v", err)
+		log.Errorf("Failed to marshal call-end: %v", err)
 		return
 	}
 
-	select {
-	case client.Send <- wrapperJSON:
-		log.Infof("Sent call error to %s: %s", client.UserID, reason)
+	if !hub.sendTo(client, wrapperJSON) {
+		log.Warnf("Failed to send call-end to %s (connection %s): channel full", client.UserID, client.ID)
+	}
+}
+
+// callErrorReason maps a session error to the reason sent in call-error
+func callErrorReason(err error) string {
+	switch {
+	case errors.Is(err, calls.ErrUnknownCall):
+		return "unknown_call"
+	case errors.Is(err, calls.ErrNotParticipant):
+		return "not_participant"
+	case errors.Is(err, calls.ErrCallExists):
+		return "invalid_call_id"
 	default:
-		log.Warnf("Failed to send error to %s: channel full", client.UserID)
+		return "invalid_state"
+	}
+}
+
+// device returns one connection of userID, or nil if it is gone
+func (h *Hub) device(userID, connID string) *Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.clients[userID][connID]
+}
+
+// hasWaitingCall reports whether any device of userID has a call waiting
+func (h *Hub) hasWaitingCall(userID string) bool {
+	for _, device := range h.devices(userID) {
+		if device.waitingCall() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionDevices returns the devices of userID taking part in a call: the
+// pinned device once known, otherwise every device still ringing for it
+func (h *Hub) sessionDevices(session *calls.Session, userID string) []*Client {
+	snap := session.Snapshot()
+	conn := snap.CallerConn
+	if userID == snap.Callee {
+		conn = snap.CalleeConn
+	}
+
+	if conn != "" {
+		if device := h.device(userID, conn); device != nil && device.inCall(session) {
+			return []*Client{device}
+		}
+		return nil
+	}
+
+	var ringing []*Client
+	for _, device := range h.devices(userID) {
+		if device.inCall(session) {
+			ringing = append(ringing, device)
+		}
 	}
+	return ringing
 }
 
-// HandleSdpOffer forwards an SDP offer from the sender to the intended receiver via the hub.
-// It checks if the receiver is online and available (not busy), then forwards the offer.
+// sessionFor resolves the call a frame names and checks that the sending
+// device takes part in it and may send event now. Rejected frames get a
+// call-error back.
+func (h *Hub) sessionFor(sender *Client, callID string, receiverID string, event calls.Event) (*calls.Session, error) {
+	session, err := h.calls.Get(callID)
+	if err == nil {
+		err = session.Check(sender.UserID, event)
+	}
+	if err == nil && !sender.inCall(session) {
+		err = errWrongDevice
+	}
+
+	if err != nil {
+		log.Warnf("Rejected %s from %s for call %q: %v", event, sender.UserID, callID, err)
+		sendCallError(h, sender, callID, callErrorReason(err), receiverID)
+		return nil, err
+	}
+	return session, nil
+}
+
+// finishCall tells every device still in an ended call, except skip, that it
+// is over, returns them to idle and forgets the session
+func (h *Hub) finishCall(session *calls.Session, skip *Client, reason string) {
+	for _, userID := range []string{session.Caller, session.Callee} {
+		for _, device := range h.sessionDevices(session, userID) {
+			if device == skip {
+				continue
+			}
+			device.leaveCall(session)
+			sendCallEnd(h, device, &CallEnd{
+				CallID:     session.ID,
+				SenderID:   session.Peer(device.UserID),
+				ReceiverID: device.UserID,
+				Reason:     reason,
+			})
+		}
+	}
+	if skip != nil {
+		skip.leaveCall(session)
+	}
+	h.calls.Remove(session.ID)
+
+	snap := session.Snapshot()
+	releaseRelays(session.Caller, session.Callee)
+	h.recordCall(callRecord(snap))
+	log.Infof("Call %s between %s and %s ended (%s)", session.ID, session.Caller, session.Callee, snap.EndReason)
+}
+
+// dropFromCall takes a departing device out of its call and its waiting call.
+// The other side gets a call-end with the given reason and returns to idle.
+// A ringing callee device leaving only ends the call if none of the callee's
+// other devices still rings.
+func (h *Hub) dropFromCall(client *Client, reason string) {
+	if waiting := client.waitingCall(); waiting != nil {
+		h.leaveSession(client, waiting, reason)
+	}
+	if session := client.currentCall(); session != nil {
+		h.leaveSession(client, session, reason)
+	}
+}
+
+func (h *Hub) leaveSession(client *Client, session *calls.Session, reason string) {
+	if session.State() == calls.StateRinging && client.UserID == session.Callee {
+		client.leaveCall(session)
+		if len(h.sessionDevices(session, session.Callee)) > 0 {
+			return
+		}
+	}
+
+	if err := session.Terminate(reason); err != nil {
+		client.leaveCall(session)
+		return
+	}
+	h.finishCall(session, client, reason)
+}
+
+// expireCall ends session with no_answer if it is still ringing once the ring
+// timeout has passed. The caller may then leave a voicemail.
+func (h *Hub) expireCall(session *calls.Session) {
+	if err := session.Expire(); err != nil {
+		return
+	}
+	log.Infof("Call %s: %s did not answer within %s", session.ID, session.Callee, ringTimeout)
+	openVoicemail(session.ID, session.Caller, session.Callee)
+	h.finishCall(session, nil, calls.ReasonNoAnswer)
+}
+
+// HandleSdpOffer starts a call session and forwards the SDP offer to the intended receiver via the hub.
+// The offer carries a call_id chosen by the caller that every later frame of the call must repeat.
+// It rings every idle device of the receiver; the first one to answer takes the call.
+// If the receiver is busy on all devices and call waiting is on, the busy devices get a
+// call-waiting instead, unless the receiver already has a call waiting.
 // If the receiver is offline or busy, it sends an error response back to the sender.
 // Returns an error if the receiver is unavailable or if sending fails.
 func HandleSdpOffer(hub *Hub, sender *Client, offer *CallSDP) error {
 	receiverId := offer.Receiver
+	offer.Sender = sender.UserID
 
-	// Look up receiver (thread-safe)
-	hub.mu.RLock()
-	receiver, ok := hub.clients[receiverId]
-	hub.mu.RUnlock()
+	if offer.CallID == "" || receiverId == "" || receiverId == sender.UserID {
+		sendCallError(hub, sender, offer.CallID, "invalid_call", receiverId)
+		return fmt.Errorf("offer from %s needs a call_id and another user as receiver", sender.UserID)
+	}
+	if sender.currentCall() != nil || sender.currentRoom() != nil {
+		sendCallError(hub, sender, offer.CallID, "already_in_call", receiverId)
+		return fmt.Errorf("device %s of %s is already in a call", sender.ID, sender.UserID)
+	}
 
+	media, ok := offer.CallType.media()
 	if !ok {
-		// Receiver is OFFLINE (not in hub)
+		sendCallError(hub, sender, offer.CallID, "invalid_media", receiverId)
+		return fmt.Errorf("offer from %s has unknown call type %d", sender.UserID, offer.CallType)
+	}
+
+	// Look up every connection of the receiver (thread-safe)
+	devices := hub.devices(receiverId)
+	if len(devices) == 0 {
+		// Receiver is OFFLINE (not in hub); it learns about the call when it connects
 		log.Warnf("User %s is offline, cannot deliver offer from %s", receiverId, sender.UserID)
-		sendCallError(sender, "user_offline", receiverId)
+		now := time.Now()
+		hub.recordCall(store.CallRecord{
+			CallerID:  sender.UserID,
+			CalleeID:  receiverId,
+			CallType:  string(media),
+			StartedAt: now,
+			EndedAt:   now,
+			EndReason: "user_offline",
+			Missed:    true,
+		})
+		openVoicemail(offer.CallID, sender.UserID, receiverId)
+		sendCallError(hub, sender, offer.CallID, "user_offline", receiverId)
 		return fmt.Errorf("user %s is offline", receiverId)
 	}
+	session, err := hub.calls.Start(offer.CallID, sender.UserID, sender.ID, receiverId, media)
+	if err != nil {
+		sendCallError(hub, sender, offer.CallID, callErrorReason(err), receiverId)
+		return err
+	}
+	if !sender.tryJoinCall(session) {
+		hub.calls.Remove(session.ID)
+		sendCallError(hub, sender, offer.CallID, "already_in_call", receiverId)
+		return fmt.Errorf("device %s of %s is already in a call", sender.ID, sender.UserID)
+	}
 
-	// Check if receiver is available (idle)
-	receiver.mu.RLock()
-	receiverState := receiver.State
-	receiver.mu.RUnlock()
+	wrapperJSON, err := wrapMessage(MessageTypeCallOffer, offer)
+	if err != nil {
+		log.Errorf("Failed to marshal offer: %v", err)
+		session.Terminate("internal_error")
+		hub.finishCall(session, sender, "internal_error")
+		return err
+	}
+
+	// Only idle devices can ring
+	idle, rung := 0, 0
+	for _, device := range devices {
+		if !device.tryJoinCall(session) {
+			continue
+		}
+		idle++
+		if hub.sendTo(device, wrapperJSON) {
+			rung++
+		} else {
+			device.leaveCall(session)
+		}
+	}
+
+	// A busy receiver may take one more call through call waiting
+	waiting := false
+	if rung == 0 && idle == 0 && callWaiting && !hub.hasWaitingCall(receiverId) {
+		waitingJSON, err := wrapMessage(MessageTypeCallWaiting, offer)
+		if err != nil {
+			log.Errorf("Failed to marshal call-waiting: %v", err)
+		}
+		for _, device := range devices {
+			if err != nil || !device.tryWaitCall(session) {
+				continue
+			}
+			if hub.sendTo(device, waitingJSON) {
+				rung++
+			} else {
+				device.leaveCall(session)
+			}
+		}
+		waiting = rung > 0
+	}
 
-	if receiverState != StateIdle {
-		// Receiver is BUSY (calling or in_call)
-		log.Warnf("User %s is busy (state: %s), cannot deliver offer from %s", receiverId, receiverState, sender.UserID)
-		sendCallError(sender, "user_busy", receiverId)
-		return fmt.Errorf("user %s is busy", receiverId)
+	if rung == 0 {
+		reason := "delivery_failed"
+		if idle == 0 {
+			// Receiver is BUSY (ringing or in a call) on every device
+			reason = "user_busy"
+		}
+		log.Warnf("Cannot deliver offer from %s to %s: %s", sender.UserID, receiverId, reason)
+		session.Terminate(reason)
+		sender.leaveCall(session)
+		hub.calls.Remove(session.ID)
+		releaseRelays(sender.UserID)
+		hub.recordCall(callRecord(session.Snapshot()))
+		sendCallError(hub, sender, offer.CallID, reason, receiverId)
+		return fmt.Errorf("cannot deliver offer to %s: %s", receiverId, reason)
 	}
 
-	// Both users available - update states to "calling"
-	sender.mu.Lock()
-	sender.State = StateCalling
-	sender.mu.Unlock()
+	time.AfterFunc(ringTimeout, func() { hub.expireCall(session) })
 
-	receiver.mu.Lock()
-	receiver.State = StateCalling
-	receiver.mu.Unlock()
+	status := "ringing"
+	if waiting {
+		status = "waiting"
+	}
+	log.Infof("Call %s: forwarded %s offer from %s to %d device(s) of %s (%s)", session.ID, media, sender.UserID, rung, receiverId, status)
+	return nil
+}
 
-	// Step 1: Marshal offer
-	offerJSON, err := json.Marshal(offer)
+// HandleSdpAnswer forwards an SDP answer from the answering device to the caller's device.
+// The call is pinned to the answering device and becomes active, and the callee's
+// other ringing devices are told the call was answered elsewhere. Answering a waiting call
+// first ends the call the device is in.
+// Returns an error if this device is not ringing for the call or if sending fails.
+func HandleSdpAnswer(hub *Hub, sender *Client, answer *CallSDP) error {
+	session, err := hub.sessionFor(sender, answer.CallID, answer.Receiver, calls.EventAnswer)
 	if err != nil {
-		log.Errorf("Failed to marshal offer: %v", err)
-		// Reset states on error
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
 		return err
 	}
+	answer.Sender = sender.UserID
+	answer.Receiver = session.Caller
+	answer.CallType = callTypeOf(session.Media())
+
+	// The caller's device must still be waiting
+	caller := hub.device(session.Caller, session.CallerConn)
+	if caller == nil || caller.currentCall() != session {
+		session.Terminate(calls.ReasonDisconnected)
+		hub.finishCall(session, nil, calls.ReasonDisconnected)
+		return fmt.Errorf("caller of %s is gone", session.ID)
+	}
+
+	// Taking a waiting call hangs up the current one, which puts the waiting call in its place
+	if sender.waitingCall() == session {
+		if current := sender.currentCall(); current != nil {
+			if err := endCall(hub, sender, current); err != nil {
+				return err
+			}
+		}
+	}
 
-	// Step 2: Create wrapper
-	wrapper := WebSocketMessage{
-		Type:    MessageTypeCallOffer,
-		Payload: json.RawMessage(offerJSON),
+	// Another device may have answered first
+	if err := session.Answer(sender.UserID, sender.ID); err != nil {
+		sendCallError(hub, sender, session.ID, callErrorReason(err), session.Caller)
+		return err
 	}
 
-	// Step 3: Marshal wrapper
-	wrapperJSON, err := json.Marshal(wrapper)
+	wrapperJSON, err := wrapMessage(MessageTypeCallAnswer, answer)
 	if err != nil {
-		log.Errorf("Failed to marshal wrapper: %v", err)
-		// Reset states on error
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
+		log.Errorf("Failed to marshal answer: %v", err)
 		return err
 	}
 
-	// Step 4: Send to receiver (non-blocking)
-	select {
-	case receiver.Send <- wrapperJSON:
-		log.Infof("Forwarded offer from %s to %s (both now in 'calling' state)", sender.UserID, receiverId)
-		return nil // Success!
-	default:
-		log.Errorf("Failed to send offer to %s: channel full or closed", receiverId)
-		// Reset states on failure
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
-		sendCallError(sender, "delivery_failed", receiverId)
+	if !hub.sendTo(caller, wrapperJSON) {
+		log.Errorf("Failed to send answer to %s: channel full or closed", session.Caller)
+		session.Terminate("delivery_failed")
+		hub.finishCall(session, nil, "delivery_failed")
 		return fmt.Errorf("failed to send to receiver: channel full")
 	}
-}
 
-// HandleSdpAnswer forwards an SDP answer from the sender to the intended receiver (original caller) via the hub.
-// When answer is successfully sent, both parties transition to "in_call" state.
-// It checks if the receiver is online, marshals the answer, and sends it over a non-blocking channel.
-// Returns an error if the receiver is offline or if sending fails.
-func HandleSdpAnswer(hub *Hub, sender *Client, answer *CallSDP) error {
-	receiverId := answer.Receiver
-
-	// Look up receiver (thread-safe)
-	hub.mu.RLock()
-	receiver, ok := hub.clients[receiverId]
-	hub.mu.RUnlock()
+	// Hand over the caller's candidates that arrived while ringing, in order
+	early := session.DrainCandidates()
+	for i, frame := range early {
+		if !hub.sendTo(sender, frame) {
+			log.Warnf("Call %s: dropped %d buffered ICE candidate(s) for %s: channel full or closed", session.ID, len(early)-i, sender.UserID)
+			break
+		}
+	}
 
-	if !ok {
-		// Receiver is OFFLINE
-		log.Warnf("User %s is offline, cannot deliver answer from %s", receiverId, sender.UserID)
-		// Reset sender state
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		return fmt.Errorf("user %s is offline", receiverId)
+	// Stop ringing the callee's other devices
+	for _, device := range hub.devices(sender.UserID) {
+		if device == sender || !device.inCall(session) {
+			continue
+		}
+		device.leaveCall(session)
+		sendCallEnd(hub, device, &CallEnd{
+			CallID:     session.ID,
+			SenderID:   session.Caller,
+			ReceiverID: sender.UserID,
+			Reason:     "answered_elsewhere",
+		})
 	}
 
-	// Transition both to "in_call" state (answer accepted)
-	sender.mu.Lock()
-	sender.State = StateInCall
-	sender.mu.Unlock()
+	log.Infof("Call %s: forwarded answer from %s to %s (active on connections %s and %s, %d early ICE candidate(s) flushed)", session.ID, sender.UserID, session.Caller, sender.ID, caller.ID, len(early))
+	return nil
+}
 
-	receiver.mu.Lock()
-	receiver.State = StateInCall
-	receiver.mu.Unlock()
+// HandleIceCandidate forwards an ICE candidate from the sender to the device on the other end of its call.
+// Candidates the caller sends while the call rings are buffered in the session and flushed to the
+// answering device right after the answer; they expire with the session if nobody answers.
+// Returns an error if the sender is not in the call or if sending fails.
+// Note: ICE candidates are time-sensitive and may be sent in bursts.
+func HandleIceCandidate(hub *Hub, sender *Client, candidate *IceCandidate) error {
+	session, err := hub.sessionFor(sender, candidate.CallID, candidate.Receiver, calls.EventIceCandidate)
+	if err != nil {
+		return err
+	}
+	candidate.Sender = sender.UserID
+	candidate.Receiver = session.Peer(sender.UserID)
 
-	// Step 1: Marshal answer
-	answerJSON, err := json.Marshal(answer)
+	wrapperJSON, err := wrapMessage(MessageTypeIceCandidate, candidate)
 	if err != nil {
-		log.Errorf("Failed to marshal answer: %v", err)
-		// Reset states on error
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
+		log.Errorf("Failed to marshal ICE candidate: %v", err)
 		return err
 	}
 
-	// Step 2: Create wrapper
-	wrapper := WebSocketMessage{
-		Type:    MessageTypeCallAnswer,
-		Payload: json.RawMessage(answerJSON),
+	// The caller's candidates wait until the callee's answer is in flight
+	if sender.UserID == session.Caller {
+		buffered, err := session.BufferCandidate(wrapperJSON)
+		if err != nil {
+			log.Warnf("Call %s: dropped ICE candidate from %s: %v", session.ID, sender.UserID, err)
+			sendCallError(hub, sender, session.ID, "ice_buffer_full", candidate.Receiver)
+			return err
+		}
+		if buffered {
+			log.Infof("Call %s: buffered ICE candidate from %s until %s answers", session.ID, sender.UserID, candidate.Receiver)
+			return nil
+		}
 	}
 
-	// Step 3: Marshal wrapper
-	wrapperJSON, err := json.Marshal(wrapper)
-	if err != nil {
-		log.Errorf("Failed to marshal wrapper: %v", err)
-		// Reset states on error
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
-		return err
+	targets := hub.sessionDevices(session, candidate.Receiver)
+	if len(targets) == 0 {
+		log.Warnf("Call %s: no device of %s left, cannot deliver ICE candidate", session.ID, candidate.Receiver)
+		return fmt.Errorf("no device of %s in call %s", candidate.Receiver, session.ID)
 	}
 
-	// Step 4: Send to receiver (non-blocking)
-	select {
-	case receiver.Send <- wrapperJSON:
-		log.Infof("Forwarded answer from %s to %s (both now 'in_call')", sender.UserID, receiverId)
-		return nil // Success!
-	default:
-		log.Errorf("Failed to send answer to %s: channel full or closed", receiverId)
-		// Reset states on failure
-		sender.mu.Lock()
-		sender.State = StateIdle
-		sender.mu.Unlock()
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
+	delivered := 0
+	for _, target := range targets {
+		if hub.sendTo(target, wrapperJSON) {
+			delivered++
+		}
+	}
+
+	if delivered == 0 {
+		log.Errorf("Failed to send ICE candidate to %s: channel full or closed", candidate.Receiver)
 		return fmt.Errorf("failed to send to receiver: channel full")
 	}
+
+	log.Infof("Call %s: forwarded ICE candidate from %s to %s", session.ID, sender.UserID, candidate.Receiver)
+	return nil
 }
 
-// HandleIceCandidate forwards an ICE candidate from the sender to the intended receiver via the hub.
-// It checks if the receiver is online, marshals the candidate, and sends it over a non-blocking channel.
-// Returns an error if the receiver is offline or if sending fails.
-// Note: ICE candidates are time-sensitive and may be sent in bursts.
-func HandleIceCandidate(hub *Hub, sender *Client, candidate *IceCandidate) error {
-	receiverId := candidate.Receiver
+// HandleCallRenegotiate forwards a mid-call offer or answer to the other device of an active call.
+// Renegotiation upgrades audio to video, adds a screen-share track or restarts ICE;
+// the call's media changes once the answer comes back.
+// Returns an error if the sender is not in an active call or if sending fails.
+func HandleCallRenegotiate(hub *Hub, sender *Client, sdp *CallSDP) error {
+	session, err := hub.sessionFor(sender, sdp.CallID, sdp.Receiver, calls.EventRenegotiate)
+	if err != nil {
+		return err
+	}
+	sdp.Sender = sender.UserID
+	sdp.Receiver = session.Peer(sender.UserID)
 
-	// Look up receiver (thread-safe)
-	hub.mu.RLock()
-	receiver, ok := hub.clients[receiverId]
-	hub.mu.RUnlock()
+	media, ok := sdp.CallType.media()
+	if !ok || (sdp.SDPType != SDPTypeOffer && sdp.SDPType != SDPTypeAnswer) {
+		sendCallError(hub, sender, session.ID, "invalid_media", sdp.Receiver)
+		return fmt.Errorf("renegotiation from %s has unknown call type %d or SDP type %d", sender.UserID, sdp.CallType, sdp.SDPType)
+	}
 
-	if !ok {
-		// Receiver is OFFLINE
-		log.Warnf("User %s is offline, cannot deliver ICE candidate from %s", receiverId, sender.UserID)
-		return fmt.Errorf("user %s is offline", receiverId)
+	targets := hub.sessionDevices(session, sdp.Receiver)
+	if len(targets) == 0 {
+		log.Warnf("Call %s: no device of %s left, cannot deliver renegotiation", session.ID, sdp.Receiver)
+		sendCallError(hub, sender, session.ID, "delivery_failed", sdp.Receiver)
+		return fmt.Errorf("no device of %s in call %s", sdp.Receiver, session.ID)
 	}
 
-	// Receiver is ONLINE - forward the ICE candidate
+	// The answer settles the media of the call
+	if sdp.SDPType == SDPTypeAnswer {
+		if err := session.Renegotiate(sender.UserID, media); err != nil {
+			sendCallError(hub, sender, session.ID, callErrorReason(err), sdp.Receiver)
+			return err
+		}
+	}
 
-	// Step 1: Marshal candidate
-	candidateJSON, err := json.Marshal(candidate)
+	wrapperJSON, err := wrapMessage(MessageTypeRenegotiate, sdp)
 	if err != nil {
-		log.Errorf("Failed to marshal ICE candidate: %v", err)
+		log.Errorf("Failed to marshal renegotiation: %v", err)
 		return err
 	}
 
-	// Step 2: Create wrapper
-	wrapper := WebSocketMessage{
-		Type:    MessageTypeIceCandidate,
-		Payload: json.RawMessage(candidateJSON),
+	if !hub.sendTo(targets[0], wrapperJSON) {
+		log.Errorf("Failed to send renegotiation to %s: channel full or closed", sdp.Receiver)
+		sendCallError(hub, sender, session.ID, "delivery_failed", sdp.Receiver)
+		return fmt.Errorf("failed to send to receiver: channel full")
 	}
 
-	// Step 3: Marshal wrapper
-	wrapperJSON, err := json.Marshal(wrapper)
+	log.Infof("Call %s: forwarded renegotiation from %s to %s (%s)", session.ID, sender.UserID, sdp.Receiver, media)
+	return nil
+}
+
+// HandleCallEnd hangs up a call and returns every device in it to idle.
+// Sent while the call still rings, it counts as a cancel from the caller or a
+// decline from the callee, so the other side learns why the call ended.
+func HandleCallEnd(hub *Hub, sender *Client, callEnd *CallEnd) error {
+	session, err := hub.sessionFor(sender, callEnd.CallID, callEnd.ReceiverID, calls.EventEnd)
 	if err != nil {
-		log.Errorf("Failed to marshal wrapper: %v", err)
 		return err
 	}
+	return endCall(hub, sender, session)
+}
 
-	// Step 4: Send to receiver (non-blocking)
-	select {
-	case receiver.Send <- wrapperJSON:
-		log.Infof("Forwarded ICE candidate from %s to %s", sender.UserID, receiverId)
-		return nil // Success!
-	default:
-		log.Errorf("Failed to send ICE candidate to %s: channel full or closed", receiverId)
-		return fmt.Errorf("failed to send to receiver: channel full")
+func endCall(hub *Hub, sender *Client, session *calls.Session) error {
+	if session.State() == calls.StateRinging {
+		if sender.UserID == session.Caller {
+			return cancelCall(hub, sender, session)
+		}
+		return declineCall(hub, sender, session)
+	}
+
+	if err := session.End(sender.UserID); err != nil {
+		sendCallError(hub, sender, session.ID, callErrorReason(err), session.Peer(sender.UserID))
+		return err
 	}
+	hub.finishCall(session, sender, calls.ReasonHangup)
+	return nil
 }
 
-// HandleCallEnd resets both participants' states to idle when a call ends
-func HandleCallEnd(hub *Hub, sender *Client, callEnd *CallEnd) error {
-	// Reset sender state
-	sender.mu.Lock()
-	sender.State = StateIdle
-	sender.mu.Unlock()
-
-	// Find and reset receiver state
-	hub.mu.RLock()
-	receiver, ok := hub.clients[callEnd.ReceiverID]
-	hub.mu.RUnlock()
-
-	if ok {
-		receiver.mu.Lock()
-		receiver.State = StateIdle
-		receiver.mu.Unlock()
-
-		// Forward call-end message to receiver
-		callEndJSON, err := json.Marshal(callEnd)
-		if err != nil {
-			log.Errorf("Failed to marshal call-end: %v", err)
-		} else {
-			wrapper := WebSocketMessage{
-				Type:    MessageTypeCallEnd,
-				Payload: json.RawMessage(callEndJSON),
-			}
+// HandleCallDecline lets the callee turn down a ringing call. The caller gets a
+// call-end with reason "declined" and the callee's other devices stop ringing.
+func HandleCallDecline(hub *Hub, sender *Client, decline *CallEnd) error {
+	session, err := hub.sessionFor(sender, decline.CallID, decline.ReceiverID, calls.EventDecline)
+	if err != nil {
+		return err
+	}
+	return declineCall(hub, sender, session)
+}
 
-			wrapperJSON, err := json.Marshal(wrapper)
-			if err != nil {
-				log.Errorf("Failed to marshal wrapper: %v", err)
-			} else {
-				select {
-				case receiver.Send <- wrapperJSON:
-					log.Infof("Forwarded call-end from %s to %s", sender.UserID, callEnd.ReceiverID)
-				default:
-					log.Warnf("Failed to send call-end to %s: channel full", callEnd.ReceiverID)
-				}
-			}
+// HandleCallCancel lets the caller withdraw a call before it is answered.
+// Every ringing device of the callee gets a call-end with reason "cancelled".
+func HandleCallCancel(hub *Hub, sender *Client, cancel *CallEnd) error {
+	session, err := hub.sessionFor(sender, cancel.CallID, cancel.ReceiverID, calls.EventCancel)
+	if err != nil {
+		return err
+	}
+	return cancelCall(hub, sender, session)
+}
+
+func declineCall(hub *Hub, sender *Client, session *calls.Session) error {
+	if err := session.Decline(sender.UserID); err != nil {
+		sendCallError(hub, sender, session.ID, callErrorReason(err), session.Caller)
+		return err
+	}
+
+	// Silence the callee's other ringing devices
+	for _, device := range hub.sessionDevices(session, sender.UserID) {
+		if device == sender {
+			continue
 		}
+		device.leaveCall(session)
+		sendCallEnd(hub, device, &CallEnd{
+			CallID:     session.ID,
+			SenderID:   session.Caller,
+			ReceiverID: sender.UserID,
+			Reason:     "declined_elsewhere",
+		})
 	}
 
-	log.Infof("Call ended between %s and %s, both reset to idle", sender.UserID, callEnd.ReceiverID)
+	hub.finishCall(session, sender, calls.ReasonDeclined)
+	return nil
+}
+
+func cancelCall(hub *Hub, sender *Client, session *calls.Session) error {
+	if err := session.Cancel(sender.UserID); err != nil {
+		sendCallError(hub, sender, session.ID, callErrorReason(err), session.Callee)
+		return err
+	}
+	hub.finishCall(session, sender, calls.ReasonCancelled)
 	return nil
 }
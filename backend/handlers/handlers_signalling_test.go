@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"athena-backend/calls"
+	"athena-backend/store"
+)
+
+// Call records go to an in-memory store. It is set once, since calls that
+// end keep writing to it in the background.
+func TestMain(m *testing.M) {
+	db := store.NewMemory()
+	SetStores(Stores{
+		Profiles:      db,
+		Friends:       db,
+		Messages:      db,
+		Calls:         db,
+		Conversations: db,
+		Receipts:      db,
+	})
+	os.Exit(m.Run())
+}
+
+// newTestHub returns a hub of its own. Handlers are called directly, without
+// the run loop.
+func newTestHub() *Hub {
+	return &Hub{
+		clients: make(map[string]map[string]*Client),
+		calls:   calls.NewRegistry(),
+		rooms:   calls.NewRooms(),
+	}
+}
+
+// connect registers a device of userID with the hub
+func connect(h *Hub, userID, connID string) *Client {
+	client := &Client{ID: connID, UserID: userID, Send: make(chan []byte, 256)}
+	h.mu.Lock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = make(map[string]*Client)
+	}
+	h.clients[userID][connID] = client
+	h.mu.Unlock()
+	return client
+}
+
+type frame struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// received returns the frames queued for client since the last call
+func received(t *testing.T, client *Client) []frame {
+	t.Helper()
+	var frames []frame
+	for {
+		select {
+		case data := <-client.Send:
+			var f frame
+			if err := json.Unmarshal(data, &f); err != nil {
+				t.Fatalf("decoding frame %s: %v", data, err)
+			}
+			frames = append(frames, f)
+		default:
+			return frames
+		}
+	}
+}
+
+func frameTypes(frames []frame) []string {
+	var names []string
+	for _, f := range frames {
+		names = append(names, f.Type)
+	}
+	return names
+}
+
+// candidates returns the candidate strings of the ice-candidate frames
+func candidates(t *testing.T, frames []frame) []string {
+	t.Helper()
+	var got []string
+	for _, f := range frames {
+		if f.Type != MessageTypeIceCandidate {
+			continue
+		}
+		var c IceCandidate
+		if err := json.Unmarshal(f.Payload, &c); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c.Candidate)
+	}
+	return got
+}
+
+func callError(t *testing.T, frames []frame) string {
+	t.Helper()
+	for _, f := range frames {
+		if f.Type == MessageTypeCallError {
+			var e CallErrorResponse
+			if err := json.Unmarshal(f.Payload, &e); err != nil {
+				t.Fatal(err)
+			}
+			return e.Reason
+		}
+	}
+	return ""
+}
+
+// ringBob has alice's laptop call bob, whose phone and tablet both ring
+func ringBob(t *testing.T, h *Hub) (alice, phone, tablet *Client) {
+	t.Helper()
+	alice = connect(h, "alice", "alice-laptop")
+	phone = connect(h, "bob", "bob-phone")
+	tablet = connect(h, "bob", "bob-tablet")
+
+	if err := HandleSdpOffer(h, alice, &CallSDP{CallID: "call-1", Receiver: "bob", CallType: AudioType, SDPType: SDPTypeOffer}); err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []*Client{phone, tablet} {
+		if got := frameTypes(received(t, device)); fmt.Sprint(got) != "[call-offer]" {
+			t.Fatalf("%s got %v, want a call-offer", device.ID, got)
+		}
+	}
+	return alice, phone, tablet
+}
+
+func sendCandidates(t *testing.T, h *Hub, sender *Client, receiver string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := HandleIceCandidate(h, sender, &IceCandidate{CallID: "call-1", Receiver: receiver, Candidate: name}); err != nil {
+			t.Fatalf("sending %s: %v", name, err)
+		}
+	}
+}
+
+func TestEarlyCandidatesFlushedOnAnswer(t *testing.T) {
+	h := newTestHub()
+	alice, phone, tablet := ringBob(t, h)
+
+	sendCandidates(t, h, alice, "bob", "c1", "c2", "c3")
+	for _, device := range []*Client{phone, tablet} {
+		if got := received(t, device); len(got) != 0 {
+			t.Errorf("%s got %v while ringing, want the candidates held back", device.ID, frameTypes(got))
+		}
+	}
+
+	// The callee has nothing to send until it answers
+	if err := HandleIceCandidate(h, phone, &IceCandidate{CallID: "call-1", Receiver: "alice", Candidate: "early"}); err == nil {
+		t.Error("a ringing callee sent an ICE candidate")
+	}
+	received(t, phone)
+
+	if err := HandleSdpAnswer(h, phone, &CallSDP{CallID: "call-1", Receiver: "alice", SDPType: SDPTypeAnswer}); err != nil {
+		t.Fatal(err)
+	}
+	if got := frameTypes(received(t, alice)); fmt.Sprint(got) != "[call-answer]" {
+		t.Errorf("alice got %v, want the call-answer", got)
+	}
+
+	// The answering device gets the candidates in order; the other one stops ringing
+	phoneFrames := received(t, phone)
+	if got := candidates(t, phoneFrames); fmt.Sprint(got) != "[c1 c2 c3]" {
+		t.Errorf("phone got candidates %v, want [c1 c2 c3]", got)
+	}
+	if got := frameTypes(received(t, tablet)); fmt.Sprint(got) != "[call-end]" {
+		t.Errorf("tablet got %v, want only a call-end", got)
+	}
+
+	// Later candidates go straight through, in both directions
+	sendCandidates(t, h, alice, "bob", "c4")
+	if got := candidates(t, received(t, phone)); fmt.Sprint(got) != "[c4]" {
+		t.Errorf("phone got %v after the answer, want [c4]", got)
+	}
+	sendCandidates(t, h, phone, "alice", "b1")
+	if got := candidates(t, received(t, alice)); fmt.Sprint(got) != "[b1]" {
+		t.Errorf("alice got %v, want [b1]", got)
+	}
+	if got := received(t, tablet); len(got) != 0 {
+		t.Errorf("tablet got %v after the answer", frameTypes(got))
+	}
+}
+
+func TestEarlyCandidateBufferCap(t *testing.T) {
+	h := newTestHub()
+	alice, phone, _ := ringBob(t, h)
+
+	names := make([]string, calls.MaxEarlyCandidates)
+	for i := range names {
+		names[i] = fmt.Sprintf("c%d", i)
+	}
+	sendCandidates(t, h, alice, "bob", names...)
+	if got := received(t, alice); len(got) != 0 {
+		t.Fatalf("alice got %v within the buffer cap", frameTypes(got))
+	}
+
+	// One more is refused, and the caller is told
+	err := HandleIceCandidate(h, alice, &IceCandidate{CallID: "call-1", Receiver: "bob", Candidate: "overflow"})
+	if err == nil {
+		t.Error("buffered a candidate past the cap")
+	}
+	if reason := callError(t, received(t, alice)); reason != "ice_buffer_full" {
+		t.Errorf("got call-error %q, want ice_buffer_full", reason)
+	}
+
+	if err := HandleSdpAnswer(h, phone, &CallSDP{CallID: "call-1", Receiver: "alice", SDPType: SDPTypeAnswer}); err != nil {
+		t.Fatal(err)
+	}
+	if got := candidates(t, received(t, phone)); fmt.Sprint(got) != fmt.Sprint(names) {
+		t.Errorf("phone got %d candidates, want the %d buffered ones", len(got), len(names))
+	}
+}
+
+func TestEarlyCandidateByteCap(t *testing.T) {
+	h := newTestHub()
+	alice, _, _ := ringBob(t, h)
+
+	big := strings.Repeat("x", calls.MaxEarlyCandidateBytes)
+	if err := HandleIceCandidate(h, alice, &IceCandidate{CallID: "call-1", Receiver: "bob", Candidate: big}); err == nil {
+		t.Error("buffered a candidate larger than the byte cap")
+	}
+	if reason := callError(t, received(t, alice)); reason != "ice_buffer_full" {
+		t.Errorf("got call-error %q, want ice_buffer_full", reason)
+	}
+
+	// Small candidates still fit
+	sendCandidates(t, h, alice, "bob", "c1")
+}
+
+func TestEarlyCandidatesDiscardedOnEnd(t *testing.T) {
+	tests := []struct {
+		name   string
+		end    func(h *Hub, alice, phone *Client) error
+		reason string
+	}{
+		{
+			name: "caller cancels",
+			end: func(h *Hub, alice, phone *Client) error {
+				return HandleCallEnd(h, alice, &CallEnd{CallID: "call-1", ReceiverID: "bob"})
+			},
+			reason: calls.ReasonCancelled,
+		},
+		{
+			name: "callee declines",
+			end: func(h *Hub, alice, phone *Client) error {
+				return HandleCallDecline(h, phone, &CallEnd{CallID: "call-1", ReceiverID: "alice"})
+			},
+			reason: calls.ReasonDeclined,
+		},
+		{
+			name: "nobody answers",
+			end: func(h *Hub, alice, phone *Client) error {
+				session, err := h.calls.Get("call-1")
+				if err != nil {
+					return err
+				}
+				h.expireCall(session)
+				return nil
+			},
+			reason: calls.ReasonNoAnswer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub()
+			alice, phone, tablet := ringBob(t, h)
+			session, err := h.calls.Get("call-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sendCandidates(t, h, alice, "bob", "c1", "c2")
+			if err := tt.end(h, alice, phone); err != nil {
+				t.Fatal(err)
+			}
+			if got := session.Snapshot().EndReason; got != tt.reason {
+				t.Errorf("got end reason %q, want %q", got, tt.reason)
+			}
+
+			// Nobody gets the held-back candidates, and none are left behind
+			for _, device := range []*Client{alice, phone, tablet} {
+				if got := candidates(t, received(t, device)); len(got) != 0 {
+					t.Errorf("%s got candidates %v from an ended call", device.ID, got)
+				}
+			}
+			if left := session.DrainCandidates(); len(left) != 0 {
+				t.Errorf("%d candidates left in the ended session", len(left))
+			}
+
+			// A late candidate finds no call
+			if err := HandleIceCandidate(h, alice, &IceCandidate{CallID: "call-1", Receiver: "bob", Candidate: "late"}); err == nil {
+				t.Error("sent a candidate into an ended call")
+			}
+			if reason := callError(t, received(t, alice)); reason == "" {
+				t.Error("got no call-error for a late candidate")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"athena-backend/store"
+)
+
+// Typing indicator timing. Clients refresh typing more often than
+// typingTimeout while the user keeps typing.
+const (
+	typingRelayInterval = 2 * time.Second // least time between two relayed refreshes
+	typingTimeout       = 6 * time.Second // typing stops after this long without a refresh
+)
+
+type typingKey struct {
+	userID         string
+	conversationID string
+}
+
+type typingState struct {
+	recipients []string
+	refreshed  time.Time
+	relayed    time.Time
+	timer      *time.Timer // expires the indicator
+}
+
+// typingTracker holds who is typing where. Nothing is persisted.
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{active: make(map[typingKey]*typingState)}
+}
+
+// typingRecipients checks the sender may tell the conversation it types in
+// and returns its ID and the other participants: the friend of a direct
+// conversation or the other members of a group
+func (c *Client) typingRecipients(typing *Typing) (string, []string, error) {
+	ctx := context.Background()
+	if typing.RecipientID != "" {
+		if typing.RecipientID == c.UserID {
+			return "", nil, errors.New("cannot type to yourself")
+		}
+		friends, err := friendships.areFriends(ctx, c.UserID, typing.RecipientID)
+		if err != nil {
+			return "", nil, fmt.Errorf("checking friendship with %s: %w", typing.RecipientID, err)
+		}
+		if !friends {
+			return "", nil, fmt.Errorf("%s is not a friend of %s", typing.RecipientID, c.UserID)
+		}
+		return store.DirectConversationID(c.UserID, typing.RecipientID), []string{typing.RecipientID}, nil
+	}
+
+	if typing.ConversationID == "" {
+		return "", nil, errors.New("recipient_id or conversation_id is required")
+	}
+	members, err := conversationMembers.members(ctx, typing.ConversationID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return "", nil, fmt.Errorf("loading members of conversation %s: %w", typing.ConversationID, err)
+	}
+	if !slices.Contains(members, c.UserID) {
+		return "", nil, fmt.Errorf("%s is not a member of conversation %s", c.UserID, typing.ConversationID)
+	}
+	others := make([]string, 0, len(members)-1)
+	for _, userID := range members {
+		if userID != c.UserID {
+			others = append(others, userID)
+		}
+	}
+	return typing.ConversationID, others, nil
+}
+
+// HandleTyping relays that the sender started or stopped typing to the other
+// participants of a conversation. Refreshes are relayed at most every
+// typingRelayInterval; an indicator that is not refreshed within
+// typingTimeout is relayed as stopped.
+func HandleTyping(hub *Hub, sender *Client, typing *Typing) error {
+	conversationID, recipients, err := sender.typingRecipients(typing)
+	if err != nil {
+		return err
+	}
+
+	key := typingKey{userID: sender.UserID, conversationID: conversationID}
+	if !typing.Typing {
+		hub.stopTyping(key, true)
+		return nil
+	}
+
+	t := hub.typing
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if !ok {
+		state = &typingState{}
+		t.active[key] = state
+		state.timer = time.AfterFunc(typingTimeout, func() {
+			hub.expireTyping(key, state)
+		})
+	} else {
+		state.timer.Reset(typingTimeout)
+	}
+	state.recipients = recipients
+	state.refreshed = time.Now()
+	relay := time.Since(state.relayed) >= typingRelayInterval
+	if relay {
+		state.relayed = time.Now()
+	}
+	t.mu.Unlock()
+
+	if relay {
+		hub.relayTyping(key, recipients, true)
+	}
+	return nil
+}
+
+// stopTyping ends a user's indicator in a conversation, telling the others
+// when relay is set. A chat message ends it without a relay, since its
+// arrival already tells them.
+func (h *Hub) stopTyping(key typingKey, relay bool) {
+	h.typing.mu.Lock()
+	state, ok := h.typing.active[key]
+	if ok {
+		state.timer.Stop()
+		delete(h.typing.active, key)
+	}
+	h.typing.mu.Unlock()
+
+	if ok && relay {
+		h.relayTyping(key, state.recipients, false)
+	}
+}
+
+// expireTyping ends an indicator that was not refreshed in time. A refresh
+// racing the timer wins.
+func (h *Hub) expireTyping(key typingKey, state *typingState) {
+	h.typing.mu.Lock()
+	current := h.typing.active[key] == state && time.Since(state.refreshed) >= typingTimeout
+	if current {
+		delete(h.typing.active, key)
+	}
+	h.typing.mu.Unlock()
+
+	if current {
+		h.relayTyping(key, state.recipients, false)
+	}
+}
+
+// stopUserTyping ends every indicator of a user whose last device went away
+func (h *Hub) stopUserTyping(userID string) {
+	h.typing.mu.Lock()
+	var keys []typingKey
+	for key := range h.typing.active {
+		if key.userID == userID {
+			keys = append(keys, key)
+		}
+	}
+	h.typing.mu.Unlock()
+
+	for _, key := range keys {
+		h.stopTyping(key, true)
+	}
+}
+
+// relayTyping sends a typing frame to every connected device of the recipients
+func (h *Hub) relayTyping(key typingKey, recipients []string, typing bool) {
+	wrapperJSON, err := wrapMessage(MessageTypeTyping, Typing{
+		ConversationID: key.conversationID,
+		UserID:         key.userID,
+		Typing:         typing,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal typing: %v", err)
+		return
+	}
+
+	for _, userID := range recipients {
+		for _, device := range h.devices(userID) {
+			h.sendTo(device, wrapperJSON)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"athena-backend/auth"
+	"athena-backend/blob"
+	"athena-backend/store"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Voicemail limits
+const (
+	voicemailWindow  = 10 * time.Minute // how long after a failed call the caller may leave a voicemail
+	voicemailMaxSize = 2 << 20          // bytes per recording
+)
+
+// voicemailFormats maps the accepted recording types to the extension they are stored with
+var voicemailFormats = map[string]string{
+	"audio/webm": "webm",
+	"audio/ogg":  "ogg",
+	"audio/mp4":  "m4a",
+	"audio/mpeg": "mp3",
+	"audio/wav":  "wav",
+}
+
+// blobStore keeps voicemail recordings; nil disables voicemail
+var blobStore blob.Store
+
+// SetBlobStore sets where voicemail recordings are stored
+func SetBlobStore(b blob.Store) {
+	blobStore = b
+}
+
+// unansweredCall is a call its caller may still leave a voicemail for
+type unansweredCall struct {
+	caller  string
+	callee  string
+	expires time.Time
+}
+
+// unansweredCalls remembers calls that ended with user_offline or no_answer
+// for voicemailWindow, keyed by call ID
+type unansweredCalls struct {
+	mu      sync.Mutex
+	entries map[string]unansweredCall
+}
+
+var voicemailCalls = &unansweredCalls{entries: make(map[string]unansweredCall)}
+
+// add opens the voicemail window of a call
+func (uc *unansweredCalls) add(callID, caller, callee string) {
+	now := time.Now()
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	for id, entry := range uc.entries {
+		if now.After(entry.expires) {
+			delete(uc.entries, id)
+		}
+	}
+	uc.entries[callID] = unansweredCall{caller: caller, callee: callee, expires: now.Add(voicemailWindow)}
+}
+
+// openVoicemail opens the voicemail window of a call between friends.
+// Voicemails end up in the chat, which only friends share.
+func openVoicemail(callID, caller, callee string) {
+	friends, err := friendships.areFriends(context.Background(), caller, callee)
+	if err != nil {
+		log.Printf("Error checking friendship between %s and %s: %v", caller, callee, err)
+		return
+	}
+	if friends {
+		voicemailCalls.add(callID, caller, callee)
+	}
+}
+
+// lookup returns the call if caller may leave a voicemail for it
+func (uc *unansweredCalls) lookup(callID, caller string) (unansweredCall, bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.lookupLocked(callID, caller)
+}
+
+func (uc *unansweredCalls) lookupLocked(callID, caller string) (unansweredCall, bool) {
+	entry, ok := uc.entries[callID]
+	if !ok || entry.caller != caller || time.Now().After(entry.expires) {
+		return unansweredCall{}, false
+	}
+	return entry, true
+}
+
+// claim takes the call out of the window if caller may leave a voicemail for
+// it, so each call gets at most one voicemail
+func (uc *unansweredCalls) claim(callID, caller string) (unansweredCall, bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	entry, ok := uc.lookupLocked(callID, caller)
+	if ok {
+		delete(uc.entries, callID)
+	}
+	return entry, ok
+}
+
+// restore gives back a claimed call whose voicemail could not be stored
+func (uc *unansweredCalls) restore(callID string, entry unansweredCall) {
+	uc.mu.Lock()
+	uc.entries[callID] = entry
+	uc.mu.Unlock()
+}
+
+// HandleUploadVoicemail stores a recording the caller made for a call that
+// ended with user_offline or no_answer, and posts it to the callee's chat as a
+// voicemail message. It expects a multipart form with call_id, the recording
+// as audio and optionally its duration in seconds.
+func HandleUploadVoicemail(c *fiber.Ctx) error {
+	userID := auth.UserID(c)
+
+	if blobStore == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Voicemail is not enabled",
+		})
+	}
+
+	callID := c.FormValue("call_id")
+	file, err := c.FormFile("audio")
+	if callID == "" || err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "call_id and an audio file are required",
+		})
+	}
+	if file.Size > voicemailMaxSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("Voicemail must be at most %d bytes", voicemailMaxSize),
+		})
+	}
+
+	// Browsers send parameters such as audio/webm;codecs=opus
+	contentType, _, err := mime.ParseMediaType(file.Header.Get("Content-Type"))
+	ext, ok := voicemailFormats[contentType]
+	if err != nil || !ok {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Unsupported audio format",
+		})
+	}
+
+	duration := 0
+	if v := c.FormValue("duration"); v != "" {
+		if duration, err = strconv.Atoi(v); err != nil || duration < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "duration must be a whole number of seconds",
+			})
+		}
+	}
+
+	call, ok := voicemailCalls.lookup(callID, userID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No unanswered call to leave a voicemail for",
+		})
+	}
+
+	// The friendship may have ended since the call
+	friends, err := friendships.areFriends(c.UserContext(), userID, call.callee)
+	if err != nil {
+		log.Printf("Error checking friendship between %s and %s: %v", userID, call.callee, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check friendship",
+		})
+	}
+	if !friends {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Voicemails can only be left for friends",
+		})
+	}
+
+	call, ok = voicemailCalls.claim(callID, userID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No unanswered call to leave a voicemail for",
+		})
+	}
+
+	userID1, userID2 := store.SortedPair(call.caller, call.callee)
+	name := uuid.NewString() + "." + ext
+	key := fmt.Sprintf("voicemail/%s/%s/%s", userID1, userID2, name)
+
+	src, err := file.Open()
+	if err != nil {
+		voicemailCalls.restore(callID, call)
+		log.Printf("Error reading voicemail from %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store voicemail",
+		})
+	}
+	defer src.Close()
+
+	size, err := blobStore.Put(c.UserContext(), key, src)
+	if err != nil {
+		voicemailCalls.restore(callID, call)
+		log.Printf("Error storing voicemail from %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store voicemail",
+		})
+	}
+
+	msg := &Message{
+		ID:             uuid.NewString(),
+		ConversationID: store.DirectConversationID(userID1, userID2),
+		UserID1:        userID1,
+		UserID2:        userID2,
+		SenderID:       userID,
+		Content:        "Voicemail",
+		CreatedAt:      messageTime(),
+		Kind:           store.MessageKindVoicemail,
+		Voicemail: &store.Voicemail{
+			CallID:      callID,
+			URL:         "/api/calls/voicemail/" + strings.TrimPrefix(key, "voicemail/"),
+			ContentType: contentType,
+			Size:        size,
+			Duration:    duration,
+		},
+	}
+
+	// Stored with the API key, like the messages the hub writes
+	row := &store.Message{
+		ID:             msg.ID,
+		ConversationID: msg.ConversationID,
+		UserID1:        msg.UserID1,
+		UserID2:        msg.UserID2,
+		SenderID:       msg.SenderID,
+		Content:        msg.Content,
+		CreatedAt:      msg.CreatedAt,
+		Kind:           msg.Kind,
+		Voicemail:      msg.Voicemail,
+	}
+	if err := messageStore.InsertMessage(c.UserContext(), row); err != nil {
+		voicemailCalls.restore(callID, call)
+		if delErr := blobStore.Delete(context.Background(), key); delErr != nil {
+			log.Printf("Error removing orphaned voicemail %s: %v", key, delErr)
+		}
+		log.Printf("Error storing voicemail message from %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store voicemail",
+		})
+	}
+	msg.CreatedAt = row.CreatedAt
+
+	hub.deliver(msg)
+	log.Printf("Voicemail for call %s from %s to %s stored (%d bytes)", callID, userID, call.callee, size)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": msg,
+	})
+}
+
+// HandleGetVoicemail serves a voicemail recording to either participant of
+// the conversation it was left in
+func HandleGetVoicemail(c *fiber.Ctx) error {
+	userID := auth.UserID(c)
+
+	// The path is <user_id_1>/<user_id_2>/<file>
+	path := c.Params("*")
+	parts := strings.Split(path, "/")
+	contentType := ""
+	if len(parts) == 3 && (parts[0] == userID || parts[1] == userID) {
+		for format, ext := range voicemailFormats {
+			if strings.HasSuffix(parts[2], "."+ext) {
+				contentType = format
+			}
+		}
+	}
+	if contentType == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Voicemail not found",
+		})
+	}
+
+	if blobStore == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Voicemail is not enabled",
+		})
+	}
+
+	rc, size, err := blobStore.Open(c.UserContext(), "voicemail/"+path)
+	if errors.Is(err, blob.ErrNotFound) || errors.Is(err, blob.ErrInvalidKey) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Voicemail not found",
+		})
+	}
+	if err != nil {
+		log.Printf("Error opening voicemail %s: %v", path, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load voicemail",
+		})
+	}
+
+	// Recordings never change once stored
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	return c.SendStream(rc, int(size))
+}
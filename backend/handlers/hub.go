@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+
+	"athena-backend/calls"
+)
+
+var hub = &Hub{
+	clients:    make(map[string]map[string]*Client),
+	broadcast:  make(chan *Message),
+	register:   make(chan *Client),
+	unregister: make(chan *Client),
+	persisted:  make(chan persistResult, writerBatchSize),
+	acks:       newAckCache(),
+	recent:     newRecentMessages(),
+	typing:     newTypingTracker(),
+	calls:      calls.NewRegistry(),
+	rooms:      calls.NewRooms(),
+}
+
+// Initialize the hub and its message writer
+func init() {
+	hub.writer = newMessageWriter(hub.persisted)
+	go hub.writer.run()
+	go hub.run()
+}
+
+// Run the hub to manage clients and messages
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.mu.Lock()
+			devices, ok := h.clients[client.UserID]
+			if !ok {
+				devices = make(map[string]*Client)
+				h.clients[client.UserID] = devices
+			}
+			devices[client.ID] = client
+			count := len(devices)
+			h.mu.Unlock()
+			log.Printf("Client registered: %s (connection %s, %d active)", client.UserID, client.ID, count)
+			go h.pushMissedCalls(client)
+
+		case client := <-h.unregister:
+			// Whoever this device was calling or talking to is told it left
+			h.dropFromCall(client, calls.ReasonDisconnected)
+			h.dropFromRoom(client, calls.ReasonDisconnected)
+
+			h.mu.Lock()
+			h.removeLocked(client)
+			offline := len(h.clients[client.UserID]) == 0
+			h.mu.Unlock()
+
+			// Nobody types on a user with no device left
+			if offline {
+				h.stopUserTyping(client.UserID)
+			}
+
+		case message := <-h.broadcast:
+			// A retry of a message that was already stored gets the original ack;
+			// one still being stored will be acked when the write finishes
+			if entry, ok := h.acks.lookup(message); ok {
+				log.Printf("Dropped duplicate message %s from %s", message.ClientMsgID, message.SenderID)
+				if !entry.pending {
+					sendChatAck(h, message, entry.ack)
+				}
+				continue
+			}
+
+			// Hand the message to the writer; it is delivered once stored
+			if !h.writer.enqueue(message) {
+				log.Printf("Message writer queue full, dropping message from %s", message.SenderID)
+				sendChatAck(h, message, ChatAck{ClientMsgID: message.ClientMsgID, Status: AckFailed})
+				continue
+			}
+			h.acks.begin(message)
+
+		case result := <-h.persisted:
+			message := result.message
+			ack := ChatAck{ClientMsgID: message.ClientMsgID}
+
+			// Messages that fail to store are not delivered, so the sender can retry them
+			if result.err != nil {
+				h.acks.abandon(message)
+				ack.Status = AckFailed
+				sendChatAck(h, message, ack)
+				continue
+			}
+			ack.ID = message.ID
+			ack.CreatedAt = &message.CreatedAt
+
+			// Send to every device of the participants, except the one it came from
+			ack.Status = AckStored
+			if h.deliver(message) {
+				ack.Status = AckDelivered
+			}
+			h.recent.remember(message)
+
+			h.acks.remember(message.SenderID, ack)
+			sendChatAck(h, message, ack)
+		}
+	}
+}
+
+// deliver fans a stored message out to every device of its participants
+// (both users of a direct chat, or the members of a group) except the one
+// it came from. It reports whether any device of another participant got it.
+func (h *Hub) deliver(message *Message) bool {
+	messageJSON, _ := json.Marshal(message)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delivered := false
+	for _, userID := range message.participants() {
+		for _, client := range h.clients[userID] {
+			if client == message.origin {
+				continue
+			}
+			select {
+			case client.Send <- messageJSON:
+				if userID != message.SenderID {
+					delivered = true
+				}
+			default:
+				h.removeLocked(client)
+			}
+		}
+	}
+	return delivered
+}
+
+// removeLocked drops a connection and closes its send channel.
+// It only removes that exact connection, so a stale unregister cannot
+// remove a newer connection of the same user. Callers must hold h.mu.
+func (h *Hub) removeLocked(client *Client) {
+	devices := h.clients[client.UserID]
+	if devices[client.ID] != client {
+		return
+	}
+
+	delete(devices, client.ID)
+	if len(devices) == 0 {
+		delete(h.clients, client.UserID)
+	}
+	close(client.Send)
+	log.Printf("Client unregistered: %s (connection %s)", client.UserID, client.ID)
+}
+
+// devices returns a snapshot of a user's connections
+func (h *Hub) devices(userID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	devices := make([]*Client, 0, len(h.clients[userID]))
+	for _, client := range h.clients[userID] {
+		devices = append(devices, client)
+	}
+	return devices
+}
+
+// sendTo queues data for one connection without blocking. It returns false if
+// the connection is gone or its buffer is full.
+func (h *Hub) sendTo(client *Client, data []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// The send channel is closed once the client is removed
+	if h.clients[client.UserID][client.ID] != client {
+		return false
+	}
+
+	select {
+	case client.Send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// participants returns the distinct users of a message's conversation
+func (m *Message) participants() []string {
+	if m.UserID1 == "" {
+		return m.members
+	}
+	if m.UserID1 == m.UserID2 {
+		return []string{m.UserID1}
+	}
+	return []string{m.UserID1, m.UserID2}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"athena-backend/auth"
+	"athena-backend/outbox"
+	"athena-backend/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Storage backends shared by handlers and the hub
+var (
+	profileStore store.ProfileStore
+	friendStore  store.FriendStore
+	messageStore store.MessageStore
+	callStore    store.CallStore
+
+	conversationStore store.ConversationStore
+	receiptStore      store.ReceiptStore
+)
+
+// Stores are the storage backends used by handlers and the hub
+type Stores struct {
+	Profiles      store.ProfileStore
+	Friends       store.FriendStore
+	Messages      store.MessageStore
+	Calls         store.CallStore
+	Conversations store.ConversationStore
+	Receipts      store.ReceiptStore
+}
+
+// SetStores sets the storage backends used by handlers
+func SetStores(s Stores) {
+	profileStore = s.Profiles
+	friendStore = s.Friends
+	messageStore = s.Messages
+	callStore = s.Calls
+	conversationStore = s.Conversations
+	receiptStore = s.Receipts
+}
+
+// SetOutbox makes the hub record chat messages in ob before delivering them.
+// Call it before serving traffic.
+func SetOutbox(ob *outbox.Outbox) {
+	hub.writer.useOutbox(ob)
+}
+
+// OutboxDepth returns the number of messages waiting in the outbox for the
+// database, or -1 when no outbox is configured
+func OutboxDepth() int {
+	if hub.writer.outbox == nil {
+		return -1
+	}
+	return hub.writer.outbox.Depth()
+}
+
+// userContext returns a context that runs store calls as the authenticated user
+func userContext(c *fiber.Ctx) context.Context {
+	return store.WithToken(c.UserContext(), auth.Token(c))
+}
+
+// storeErrorStatus maps a store error to the HTTP status returned to the client
+func storeErrorStatus(err error) int {
+	var apiErr *store.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return fiber.StatusNotFound
+	}
+	return fiber.StatusInternalServerError
+}
@@ -5,6 +5,10 @@ import (
 	"sync"
 	"time"
 
+	"athena-backend/calls"
+	"athena-backend/sfu"
+	"athena-backend/store"
+
 	"github.com/gofiber/websocket/v2"
 	"github.com/supabase-community/gotrue-go"
 )
@@ -17,6 +21,85 @@ func SetAuthClient(client gotrue.Client) {
 	authClient = client
 }
 
+// WebSocketConfig controls heartbeats and limits of WebSocket connections
+type WebSocketConfig struct {
+	PingInterval   time.Duration // how often the server pings each connection
+	PongTimeout    time.Duration // a connection silent for this long is reaped
+	WriteTimeout   time.Duration // deadline for each write
+	MaxMessageSize int64         // largest frame accepted from a client, in bytes
+}
+
+var wsConfig = WebSocketConfig{
+	PingInterval:   25 * time.Second,
+	PongTimeout:    60 * time.Second,
+	WriteTimeout:   10 * time.Second,
+	MaxMessageSize: 64 * 1024,
+}
+
+// SetWebSocketConfig overrides the WebSocket defaults. Zero fields keep their default.
+func SetWebSocketConfig(cfg WebSocketConfig) {
+	if cfg.PingInterval > 0 {
+		wsConfig.PingInterval = cfg.PingInterval
+	}
+	if cfg.PongTimeout > 0 {
+		wsConfig.PongTimeout = cfg.PongTimeout
+	}
+	if cfg.WriteTimeout > 0 {
+		wsConfig.WriteTimeout = cfg.WriteTimeout
+	}
+	if cfg.MaxMessageSize > 0 {
+		wsConfig.MaxMessageSize = cfg.MaxMessageSize
+	}
+}
+
+// ICEConfig lists the STUN and TURN servers handed to clients. TURN
+// credentials are derived from TURNSecret and expire after TURNTTL.
+type ICEConfig struct {
+	STUNURLs   []string
+	TURNURLs   []string
+	TURNSecret string
+	TURNTTL    time.Duration
+}
+
+var iceConfig = ICEConfig{
+	STUNURLs: []string{"stun:stun.l.google.com:19302"},
+	TURNTTL:  time.Hour,
+}
+
+// SetICEConfig overrides the ICE server defaults. Empty fields keep their default.
+func SetICEConfig(cfg ICEConfig) {
+	if len(cfg.STUNURLs) > 0 {
+		iceConfig.STUNURLs = cfg.STUNURLs
+	}
+	if len(cfg.TURNURLs) > 0 {
+		iceConfig.TURNURLs = cfg.TURNURLs
+	}
+	if cfg.TURNSecret != "" {
+		iceConfig.TURNSecret = cfg.TURNSecret
+	}
+	if cfg.TURNTTL > 0 {
+		iceConfig.TURNTTL = cfg.TURNTTL
+	}
+}
+
+// ringTimeout is how long a call may ring before the hub ends it
+var ringTimeout = 45 * time.Second
+
+// SetRingTimeout overrides the ring timeout. Zero keeps the default.
+func SetRingTimeout(d time.Duration) {
+	if d > 0 {
+		ringTimeout = d
+	}
+}
+
+// callWaiting lets a second call ring on a busy device instead of failing with user_busy
+var callWaiting bool
+
+// SetCallWaiting turns call waiting on or off
+func SetCallWaiting(enabled bool) {
+	callWaiting = enabled
+}
+
 // Auth related types
 type SignupRequest struct {
 	Email string `json:"email"`
@@ -41,41 +124,85 @@ type ManageRequestBody struct {
 	Status    string `json:"status"` // "accepted" or "rejected"
 }
 
-// WebSocket client structure
+type CreateConversationBody struct {
+	Name      string   `json:"name"`
+	MemberIDs []string `json:"member_ids"` // friends of the creator, who becomes the owner
+}
+
+type AddMembersBody struct {
+	MemberIDs []string `json:"member_ids"`
+}
+
+type UpdateMemberRoleBody struct {
+	Role string `json:"role"` // "admin" or "member"
+}
+
+// WebSocket client structure. A user may hold several clients at once (tabs, devices).
 type Client struct {
+	ID     string // Unique per connection
 	UserID string
 	Conn   *websocket.Conn
 	Send   chan []byte
-	State  ClientState
-	mu     sync.RWMutex // protects State
+
+	call    *calls.Session // call this device is ringing for or in, nil when idle
+	waiting *calls.Session // second call ringing while the device is busy (call waiting)
+	room    *calls.Room    // group call room this device is in
+	mu      sync.RWMutex   // protects call, waiting and room
 }
 
 // Hub maintains active clients and broadcasts messages
 type Hub struct {
-	clients    map[string]*Client
+	clients    map[string]map[string]*Client // user ID -> connection ID -> client
 	broadcast  chan *Message
 	register   chan *Client
 	unregister chan *Client
+	persisted  chan persistResult // outcomes from the writer
+	writer     *messageWriter
+	acks       *ackCache
+	recent     *recentMessages // delivered lately, for receipts
+	typing     *typingTracker  // typing indicators that have not expired
+	calls      *calls.Registry // call sessions that have not ended
+	rooms      *calls.Rooms    // group call rooms with participants
 	mu         sync.RWMutex
 }
 
-// ClientState represents the current call state of a client
-type ClientState string
-
-const (
-	StateIdle    ClientState = "idle"    // Can receive calls
-	StateCalling ClientState = "calling" // Initiating or receiving a call (ringing)
-	StateInCall  ClientState = "in_call" // Currently in an active call
-)
-
 // Message type constants
 const (
 	MessageTypeChat         = "chat"
+	MessageTypeChatError    = "chat-error"
+	MessageTypeChatAck      = "chat-ack"
+	MessageTypeDelivered    = "message-delivered"
+	MessageTypeRead         = "message-read"
+	MessageTypeTyping       = "typing"
 	MessageTypeCallOffer    = "call-offer"
 	MessageTypeCallAnswer   = "call-answer"
 	MessageTypeIceCandidate = "ice-candidate"
 	MessageTypeCallError    = "call-error"
 	MessageTypeCallEnd      = "call-end"
+	MessageTypeCallDecline  = "call-decline"
+	MessageTypeCallCancel   = "call-cancel"
+	MessageTypeMissedCall   = "missed-call"
+	MessageTypeRenegotiate  = "call-renegotiate"
+	MessageTypeCallWaiting  = "call-waiting"
+
+	MessageTypeConversationUpdated = "conversation-updated"
+
+	MessageTypeRoomJoin         = "room-join"
+	MessageTypeRoomLeave        = "room-leave"
+	MessageTypeRoomState        = "room-state"
+	MessageTypeRoomStarted      = "room-started"
+	MessageTypeRoomJoined       = "room-joined"
+	MessageTypeRoomLeft         = "room-left"
+	MessageTypeRoomEnded        = "room-ended"
+	MessageTypeRoomOffer        = "room-offer"
+	MessageTypeRoomAnswer       = "room-answer"
+	MessageTypeRoomIceCandidate = "room-ice-candidate"
+	MessageTypeRoomError        = "room-error"
+
+	MessageTypeSFUOffer        = "sfu-offer"
+	MessageTypeSFUAnswer       = "sfu-answer"
+	MessageTypeSFUIceCandidate = "sfu-ice-candidate"
+	MessageTypeSFULayer        = "sfu-layer"
 )
 
 // WebSocketMessage wraps all WebSocket message types
@@ -86,19 +213,70 @@ type WebSocketMessage struct {
 
 // Message structure for WebSocket communication
 type Message struct {
-	ID        string    `json:"id,omitempty"`
-	UserID1   string    `json:"user_id_1"`
-	UserID2   string    `json:"user_id_2"`
-	SenderID  string    `json:"sender_id"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             string    `json:"id,omitempty"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	UserID1        string    `json:"user_id_1,omitempty"` // empty for group messages
+	UserID2        string    `json:"user_id_2,omitempty"`
+	SenderID       string    `json:"sender_id"`
+	Content        string    `json:"content"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	// Kind and Voicemail are only set on voicemail messages, which the server creates
+	Kind      string           `json:"kind,omitempty"`
+	Voicemail *store.Voicemail `json:"voicemail,omitempty"`
+
+	// RecipientID and, for groups, ConversationID are the only addressing
+	// fields trusted from the client; the server derives the pair and the
+	// sender from them and the connection
+	RecipientID string `json:"recipient_id,omitempty"`
+	// ClientMsgID is an optional sender-chosen ID echoed in the chat-ack and
+	// used to drop retries of a message that was already stored
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	origin  *Client  // connection the message arrived on, which already has it
+	members []string // user IDs a group message goes to
+}
+
+// MessageReceipt acknowledges the messages of a conversation up to and
+// including MessageID. Clients send it as message-delivered or message-read
+// with just the message ID; the server relays it with the other fields set.
+type MessageReceipt struct {
+	MessageID      string     `json:"message_id"`
+	ConversationID string     `json:"conversation_id,omitempty"`
+	UserID         string     `json:"user_id,omitempty"`    // who received or read the messages
+	CreatedAt      *time.Time `json:"created_at,omitempty"` // of MessageID; earlier messages are covered too
+}
+
+// Typing tells the other participants of a conversation whether a user is
+// typing. Clients send it with recipient_id (direct) or conversation_id
+// (group), with typing true repeated while the user keeps typing and false
+// once they stop. The server relays it with conversation_id and user_id.
+type Typing struct {
+	RecipientID    string `json:"recipient_id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	UserID         string `json:"user_id,omitempty"`
+	Typing         bool   `json:"typing"`
+}
+
+// Receipt statuses of messages in history
+const (
+	StatusSent      = "sent"      // stored, not yet received by everyone else
+	StatusDelivered = "delivered" // received by everyone else in the conversation
+	StatusRead      = "read"      // read by everyone else in the conversation
+)
+
+// HistoryMessage is a stored message with its receipt status
+type HistoryMessage struct {
+	store.Message
+	Status string `json:"status"`
 }
 
 // Message history request
 type MessageHistoryRequest struct {
-	FriendID string `json:"friend_id"`
-	Limit    int    `json:"limit"`
-	Offset   int    `json:"offset"`
+	FriendID       string `json:"friend_id"`
+	ConversationID string `json:"conversation_id"`
+	Limit          int    `json:"limit"`
+	Offset         int    `json:"offset"`
 }
 
 type CallType int
@@ -108,16 +286,42 @@ type SDPType int
 const (
 	AudioType CallType = iota
 	VideoType
+	ScreenShareType // video with a shared screen
 )
 
+// media maps a call type to the media of a call session
+func (t CallType) media() (calls.Media, bool) {
+	switch t {
+	case AudioType:
+		return calls.MediaAudio, true
+	case VideoType:
+		return calls.MediaVideo, true
+	case ScreenShareType:
+		return calls.MediaScreen, true
+	}
+	return "", false
+}
+
+// callTypeOf maps the media of a call session back to its call type
+func callTypeOf(media calls.Media) CallType {
+	switch media {
+	case calls.MediaVideo:
+		return VideoType
+	case calls.MediaScreen:
+		return ScreenShareType
+	}
+	return AudioType
+}
+
 const (
 	SDPTypeOffer SDPType = iota
 	SDPTypeAnswer
 )
 
 type CallSDP struct {
-	CallType  CallType  `json:"call_type"`
-	SDPType   SDPType   `json:"sdp_type"` // offer or answer
+	CallID    string    `json:"call_id"`   // chosen by the caller in the offer
+	CallType  CallType  `json:"call_type"` // media of the call; in call-renegotiate, the media being negotiated
+	SDPType   SDPType   `json:"sdp_type"`  // offer or answer
 	Sender    string    `json:"sender_id"`
 	Receiver  string    `json:"receiver_id"`
 	SdpString string    `json:"sdp_string"`
@@ -131,6 +335,7 @@ sdpIndex - exact index in SDP so browser can place it correctly
 */
 // As SdpMid and SdpIndex are optional fields in WEBRTC, we use pointers to understand " " vs null.
 type IceCandidate struct {
+	CallID    string  `json:"call_id"`
 	Sender    string  `json:"sender_id"`
 	Receiver  string  `json:"receiver_id"`
 	Candidate string  `json:"candidate"`
@@ -138,14 +343,130 @@ type IceCandidate struct {
 	SdpIndex  *uint16 `json:"sdpIndex,omitempty"`
 }
 
+// ICEServer is one entry of RTCConfiguration.iceServers
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// RoomJoin asks to join the call room of a group conversation, opening it if
+// the group has none
+type RoomJoin struct {
+	ConversationID string         `json:"conversation_id"`
+	CallType       CallType       `json:"call_type"`          // media of the room, if this opens it
+	Topology       calls.Topology `json:"topology,omitempty"` // likewise; mesh unless "sfu"
+}
+
+type RoomLeave struct {
+	RoomID string `json:"room_id"`
+}
+
+// RoomState is sent to a device that joined a room. Participants includes
+// the device's own user.
+type RoomState struct {
+	RoomID         string              `json:"room_id"`
+	ConversationID string              `json:"conversation_id"`
+	CallType       CallType            `json:"call_type"`
+	Topology       calls.Topology      `json:"topology"`
+	Participants   []calls.Participant `json:"participants"`
+}
+
+// RoomEvent announces a room opening or closing to the group's members, and
+// participants joining or leaving to the rest of the room
+type RoomEvent struct {
+	RoomID         string         `json:"room_id"`
+	ConversationID string         `json:"conversation_id"`
+	UserID         string         `json:"user_id,omitempty"` // who opened, joined or left
+	CallType       CallType       `json:"call_type"`
+	Topology       calls.Topology `json:"topology"`
+	Reason         string         `json:"reason,omitempty"` // why a participant left: "left", "peer_disconnected", "removed"
+}
+
+// RoomSignal is an SDP offer or answer, or an ICE candidate, between two
+// participants of a room
+type RoomSignal struct {
+	RoomID    string  `json:"room_id"`
+	Sender    string  `json:"sender_id"`
+	Receiver  string  `json:"receiver_id"`
+	SdpString string  `json:"sdp_string,omitempty"`
+	Candidate string  `json:"candidate,omitempty"`
+	SdpMid    *string `json:"sdpMid,omitempty"`
+	SdpIndex  *uint16 `json:"sdpIndex,omitempty"`
+}
+
+// SFUSignal is an SDP offer or answer, or an ICE candidate, between a
+// participant of an SFU room and the server. Target names the peer
+// connection it is for: the participant offers its "publisher" connection,
+// the server offers the "subscriber" one.
+type SFUSignal struct {
+	RoomID    string     `json:"room_id"`
+	Target    sfu.Target `json:"target"`
+	SdpString string     `json:"sdp_string,omitempty"`
+	Candidate string     `json:"candidate,omitempty"`
+	SdpMid    *string    `json:"sdpMid,omitempty"`
+	SdpIndex  *uint16    `json:"sdpIndex,omitempty"`
+}
+
+// SFULayer picks the simulcast layer ("q", "h" or "f") forwarded from a
+// publisher in an SFU room
+type SFULayer struct {
+	RoomID      string `json:"room_id"`
+	PublisherID string `json:"publisher_id"`
+	Layer       string `json:"layer"`
+}
+
+// RoomErrorResponse is sent back when a room request or signalling frame is rejected
+type RoomErrorResponse struct {
+	RoomID         string `json:"room_id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	Reason         string `json:"reason"` // "not_member", "room_full", "already_in_call", "unknown_room", "not_participant", ...
+	ReceiverID     string `json:"receiver_id,omitempty"`
+}
+
 // CallErrorResponse represents error messages sent back to clients
 type CallErrorResponse struct {
-	Reason     string `json:"reason"`      // "user_offline", "user_busy", "delivery_failed"
+	CallID     string `json:"call_id,omitempty"`
+	Reason     string `json:"reason"`      // "user_offline", "user_busy", "delivery_failed", "unknown_call", "not_participant", "invalid_state", ...
 	ReceiverID string `json:"receiver_id"` // Who we tried to call
 }
 
-// CallEnd represents a call termination message
+// ConversationUpdate tells members that a group changed. Conversation is
+// nil once the group is gone; Removed lists users who just left or were
+// removed, who get the update too.
+type ConversationUpdate struct {
+	ConversationID string              `json:"conversation_id"`
+	Conversation   *store.Conversation `json:"conversation,omitempty"`
+	Removed        []string            `json:"removed,omitempty"`
+}
+
+// ChatErrorResponse is sent back when a chat message is rejected
+type ChatErrorResponse struct {
+	Reason         string `json:"reason"` // "invalid_recipient", "empty_message", "not_friends", "not_member", "unavailable"
+	RecipientID    string `json:"recipient_id"`
+	ConversationID string `json:"conversation_id,omitempty"`
+}
+
+// Chat ack statuses
+const (
+	AckStored    = "stored"    // persisted (in the database or the local outbox), no device of the recipient was online
+	AckDelivered = "delivered" // persisted and pushed to at least one device of the recipient
+	AckFailed    = "failed"    // not persisted and not delivered; safe to retry
+)
+
+// ChatAck confirms a chat message to the connection that sent it
+type ChatAck struct {
+	ClientMsgID string     `json:"client_msg_id"`
+	ID          string     `json:"id,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Status      string     `json:"status"`
+}
+
+// CallEnd represents a call termination message. call-decline and call-cancel
+// carry the same payload.
 type CallEnd struct {
+	CallID     string `json:"call_id"`
 	SenderID   string `json:"sender_id"`
 	ReceiverID string `json:"receiver_id"`
+	Reason     string `json:"reason,omitempty"` // set by the server, e.g. "declined", "no_answer" or "peer_disconnected"
 }
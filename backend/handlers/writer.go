@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"athena-backend/outbox"
+	"athena-backend/store"
+
+	"github.com/google/uuid"
+)
+
+// Message writer tuning
+const (
+	writerQueueSize    = 1024                   // messages waiting to be persisted
+	writerBatchSize    = 50                     // max rows per insert
+	writerLinger       = 20 * time.Millisecond  // how long a batch waits to fill up
+	writerMaxAttempts  = 5                      // inserts tried per batch
+	writerBackoff      = 200 * time.Millisecond // first retry delay, doubled each attempt
+	writerMaxBackoff   = 5 * time.Second
+	writerFlushTimeout = 10 * time.Second // per insert attempt
+	drainMaxBackoff    = 30 * time.Second // longest wait between outbox replays
+)
+
+// persistResult reports the outcome of storing one message
+type persistResult struct {
+	message *Message
+	err     error
+}
+
+// messageWriter persists chat messages off the hub goroutine. Messages are
+// batched and each outcome is sent on done so the hub can deliver and
+// acknowledge.
+//
+// With an outbox, a batch counts as persisted once it is synced to local disk;
+// drain then copies it to the store in the background, retrying until the
+// store is back. Without one, batches go straight to the store as array
+// inserts, retried with backoff.
+type messageWriter struct {
+	queue  chan *Message
+	done   chan<- persistResult
+	outbox *outbox.Outbox
+	wake   chan struct{} // signals drain that the outbox has new messages
+}
+
+func newMessageWriter(done chan<- persistResult) *messageWriter {
+	return &messageWriter{
+		queue: make(chan *Message, writerQueueSize),
+		done:  done,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// useOutbox makes the writer record messages in ob and starts draining it.
+// Messages recovered from a previous run are replayed first.
+func (w *messageWriter) useOutbox(ob *outbox.Outbox) {
+	w.outbox = ob
+	go w.drain()
+	w.signal()
+}
+
+// signal wakes drain without blocking
+func (w *messageWriter) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue hands a message to the writer without blocking. It returns false
+// when the queue is full.
+func (w *messageWriter) enqueue(msg *Message) bool {
+	select {
+	case w.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// run collects batches from the queue and flushes them
+func (w *messageWriter) run() {
+	for msg := range w.queue {
+		batch := []*Message{msg}
+		linger := time.NewTimer(writerLinger)
+
+	fill:
+		for len(batch) < writerBatchSize {
+			select {
+			case next := <-w.queue:
+				batch = append(batch, next)
+			case <-linger.C:
+				break fill
+			}
+		}
+		linger.Stop()
+
+		w.flush(batch)
+	}
+}
+
+// flush persists a batch and reports every message
+func (w *messageWriter) flush(batch []*Message) {
+	// IDs are assigned here so replays from the outbox are idempotent
+	rows := make([]*store.Message, len(batch))
+	for i, msg := range batch {
+		if msg.ID == "" {
+			msg.ID = uuid.NewString()
+		}
+		rows[i] = &store.Message{
+			ID:             msg.ID,
+			ConversationID: msg.ConversationID,
+			UserID1:        msg.UserID1,
+			UserID2:        msg.UserID2,
+			SenderID:       msg.SenderID,
+			Content:        msg.Content,
+			CreatedAt:      msg.CreatedAt,
+		}
+	}
+
+	var err error
+	if w.outbox != nil {
+		if err = w.record(rows); err != nil {
+			log.Printf("Error recording %d message(s) in the outbox, storing directly: %v", len(batch), err)
+		}
+	}
+	if w.outbox == nil || err != nil {
+		err = w.insert(rows)
+	}
+
+	for i, msg := range batch {
+		if err == nil {
+			msg.CreatedAt = rows[i].CreatedAt
+		}
+		w.done <- persistResult{message: msg, err: err}
+	}
+}
+
+// record appends rows to the outbox and wakes drain
+func (w *messageWriter) record(rows []*store.Message) error {
+	msgs := make([]store.Message, len(rows))
+	for i, row := range rows {
+		msgs[i] = *row
+	}
+	if err := w.outbox.Append(msgs); err != nil {
+		return err
+	}
+
+	w.signal()
+	return nil
+}
+
+// insert stores rows, retrying transient failures
+func (w *messageWriter) insert(rows []*store.Message) error {
+	var err error
+	backoff := writerBackoff
+	for attempt := 1; attempt <= writerMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), writerFlushTimeout)
+		err = messageStore.InsertMessages(ctx, rows)
+		cancel()
+		if err == nil || !retryable(err) || attempt == writerMaxAttempts {
+			break
+		}
+
+		log.Printf("Error storing %d message(s), retrying in %s (attempt %d/%d): %v", len(rows), backoff, attempt, writerMaxAttempts, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, writerMaxBackoff)
+	}
+	if err != nil {
+		log.Printf("Error storing %d message(s): %v", len(rows), err)
+	}
+	return err
+}
+
+// drain copies messages from the outbox to the store, oldest first. While the
+// store is failing it backs off, up to drainMaxBackoff between attempts.
+func (w *messageWriter) drain() {
+	backoff := writerBackoff
+	for {
+		pending := w.outbox.Pending(writerBatchSize)
+		if len(pending) == 0 {
+			<-w.wake
+			continue
+		}
+
+		if err := w.replay(pending); err != nil {
+			log.Printf("Error replaying outbox (%d message(s) waiting), retrying in %s: %v", w.outbox.Depth(), backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, drainMaxBackoff)
+			continue
+		}
+		backoff = writerBackoff
+	}
+}
+
+// replay stores a batch from the outbox and acknowledges it. If the store
+// rejects the batch, rows are retried one by one: a row that already exists
+// was stored by an earlier attempt, and a row rejected for any other reason
+// is dropped so it cannot block the outbox.
+func (w *messageWriter) replay(pending []store.Message) error {
+	rows := make([]*store.Message, len(pending))
+	ids := make([]string, len(pending))
+	for i := range pending {
+		rows[i] = &pending[i]
+		ids[i] = pending[i].ID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writerFlushTimeout)
+	err := messageStore.InsertMessages(ctx, rows)
+	cancel()
+	if err == nil {
+		return w.outbox.Ack(ids)
+	}
+	if retryable(err) {
+		return err
+	}
+
+	for _, row := range rows {
+		ctx, cancel := context.WithTimeout(context.Background(), writerFlushTimeout)
+		err := messageStore.InsertMessage(ctx, row)
+		cancel()
+
+		var apiErr *store.APIError
+		switch {
+		case err == nil:
+		case errors.As(err, &apiErr) && apiErr.StatusCode == 409:
+			// Stored by an attempt that crashed before acknowledging
+		case retryable(err):
+			return err
+		default:
+			log.Printf("Dropping message %s from the outbox, rejected by the store: %v", row.ID, err)
+		}
+
+		if err := w.outbox.Ack([]string{row.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryable reports whether a store error may succeed on retry. Requests the
+// database rejected outright are not retried.
+func retryable(err error) bool {
+	var apiErr *store.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == 429
+	}
+	return true
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"athena-backend/auth"
+	"athena-backend/blob"
 	"athena-backend/config"
 	"athena-backend/handlers"
+	"athena-backend/outbox"
 	"athena-backend/server"
+	"athena-backend/sfu"
+	"athena-backend/store"
+	"athena-backend/turn"
 	"athena-backend/utils"
+	"github.com/pion/webrtc/v4"
 	"github.com/supabase-community/gotrue-go"
 	"log"
 )
@@ -22,13 +29,118 @@ func main() {
 	authClient = gotrue.New(cfg.SupabaseURL, cfg.SupabaseKey)
 	authClient = authClient.WithCustomGoTrueURL(cfg.SupabaseURL + "/auth/v1")
 
-	// Set the auth client for handlers and utils
+	// Set the auth client for handlers
 	handlers.SetAuthClient(authClient)
-	utils.SetAuthClient(authClient)
-	server.SetAuthClient(authClient)
+
+	// Access tokens are verified locally; GoTrue is only asked when configured
+	server.SetAuthConfig(auth.Config{
+		JWTSecret:        cfg.JWTSecret,
+		JWKSURL:          cfg.JWKSURL,
+		Audience:         "authenticated",
+		FallbackToGoTrue: cfg.AuthFallback,
+		AuthClient:       authClient,
+	})
 
 	log.Println("GoTrue Auth client initialized successfully")
 
+	// Set the storage backends for handlers and utils
+	db := store.NewSupabase(cfg.SupabaseURL, cfg.SupabaseKey)
+	handlers.SetStores(handlers.Stores{
+		Profiles:      db,
+		Friends:       db,
+		Messages:      db,
+		Calls:         db,
+		Conversations: db,
+		Receipts:      db,
+	})
+	utils.SetProfileStore(db)
+
+	// Chat messages go through a local outbox so a database outage loses none
+	if cfg.OutboxDir != "" {
+		ob, err := outbox.Open(cfg.OutboxDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handlers.SetOutbox(ob)
+		log.Printf("Message outbox enabled in %s", cfg.OutboxDir)
+	}
+
+	// Voicemail recordings are kept on local disk
+	if cfg.BlobDir != "" {
+		disk, err := blob.NewDisk(cfg.BlobDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handlers.SetBlobStore(disk)
+		log.Printf("Voicemail storage enabled in %s", cfg.BlobDir)
+	}
+
+	handlers.SetWebSocketConfig(handlers.WebSocketConfig{
+		PingInterval:   cfg.WSPingInterval,
+		PongTimeout:    cfg.WSPongTimeout,
+		WriteTimeout:   cfg.WSWriteTimeout,
+		MaxMessageSize: cfg.WSMaxMessageSize,
+	})
+	handlers.SetRingTimeout(cfg.RingTimeout)
+	handlers.SetCallWaiting(cfg.CallWaiting)
+
+	// Self-hosted deployments can relay media through the embedded TURN server
+	stunURLs, turnURLs := cfg.STUNURLs, cfg.TURNURLs
+	if cfg.TURNEmbedded {
+		turnCfg := turn.ServerConfig{
+			ListenAddr:            cfg.TURNListenAddr,
+			PublicIP:              cfg.TURNPublicIP,
+			Realm:                 cfg.TURNRealm,
+			Secret:                cfg.TURNSecret,
+			RelayPortMin:          cfg.TURNRelayPortMin,
+			RelayPortMax:          cfg.TURNRelayPortMax,
+			MaxAllocationsPerUser: cfg.TURNMaxAllocsPerUser,
+			Authorize:             handlers.UserInCall,
+		}
+		turnServer, err := turn.NewServer(turnCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handlers.SetTURNServer(turnServer)
+
+		embeddedSTUN, embeddedTURN, err := turnCfg.URLs()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(stunURLs) == 0 {
+			stunURLs = embeddedSTUN
+		}
+		if len(turnURLs) == 0 {
+			turnURLs = embeddedTURN
+		}
+		log.Printf("Embedded TURN server listening on %s (relays on %s)", cfg.TURNListenAddr, cfg.TURNPublicIP)
+	}
+
+	handlers.SetICEConfig(handlers.ICEConfig{
+		STUNURLs:   stunURLs,
+		TURNURLs:   turnURLs,
+		TURNSecret: cfg.TURNSecret,
+		TURNTTL:    cfg.TURNTTL,
+	})
+
+	// Group call rooms can forward their media through the built-in SFU
+	if cfg.SFUEnabled {
+		sfuCfg := sfu.Config{
+			PublicIP: cfg.SFUPublicIP,
+			PortMin:  cfg.SFUPortMin,
+			PortMax:  cfg.SFUPortMax,
+		}
+		if len(stunURLs) > 0 {
+			sfuCfg.ICEServers = []webrtc.ICEServer{{URLs: stunURLs}}
+		}
+		sfuServer, err := sfu.New(sfuCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handlers.SetSFU(sfuServer, cfg.SFUMaxParticipants)
+		log.Printf("SFU enabled for rooms of up to %d participants", cfg.SFUMaxParticipants)
+	}
+
 	// Initialize server and get Fiber app
 	srv := server.New(cfg)
 	app := srv.App()
@@ -0,0 +1,395 @@
+// Package outbox is a write-ahead log of chat messages on local disk.
+// Messages are appended before they are delivered and acknowledged once the
+// database has them, so an outage of the database does not lose messages.
+//
+// The log is a directory of append-only segment files holding one JSON record
+// per line. A "put" record carries a message and an "ack" record marks one as
+// stored. Compaction rewrites the messages still pending into a fresh segment
+// and removes the older ones.
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"athena-backend/store"
+)
+
+const (
+	opPut = "put"
+	opAck = "ack"
+
+	segmentExt = ".log"
+
+	// Compaction runs after this many acks, or once nothing is pending and
+	// the active segment has grown past compactIdleSize
+	compactAfter    = 1000
+	compactIdleSize = 1 << 20
+)
+
+type record struct {
+	Op      string         `json:"op"`
+	Message *store.Message `json:"message,omitempty"`
+	ID      string         `json:"id,omitempty"`
+}
+
+// Outbox is safe for concurrent use
+type Outbox struct {
+	dir string
+
+	mu         sync.Mutex
+	active     *os.File
+	activeSeq  int
+	activeSize int64
+	pending    map[string]store.Message // message ID -> message
+	order      []string                 // pending IDs in append order, may hold acked IDs
+	acked      int                      // acks written since the last compaction
+}
+
+// Open opens the outbox in dir, creating it if needed. Messages left pending
+// by a previous run are recovered and returned by Pending.
+func Open(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+
+	o := &Outbox{
+		dir:     dir,
+		pending: make(map[string]store.Message),
+	}
+	if err := o.recover(); err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.compactLocked(); err != nil {
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		log.Printf("Outbox recovered %d pending message(s) from %s", len(o.pending), dir)
+	}
+	return o, nil
+}
+
+// recover replays every segment in order to rebuild the pending set
+func (o *Outbox) recover() error {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+
+	var seqs []int
+	for _, entry := range entries {
+		name := entry.Name()
+		// Leftovers of an interrupted compaction
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(o.dir, name))
+			continue
+		}
+		if seq, ok := parseSegmentName(name); ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		if err := o.replaySegment(seq); err != nil {
+			return err
+		}
+		o.activeSeq = seq
+	}
+	return nil
+}
+
+func (o *Outbox) replaySegment(seq int) error {
+	path := o.segmentPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without its newline is a write torn by a crash
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Outbox ignoring torn record at the end of %s", path)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("outbox: %w", err)
+		}
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("Outbox ignoring corrupt record in %s: %v", path, err)
+			continue
+		}
+		o.apply(rec)
+	}
+}
+
+// apply updates the in-memory state with one record
+func (o *Outbox) apply(rec record) {
+	switch rec.Op {
+	case opPut:
+		if rec.Message == nil || rec.Message.ID == "" {
+			return
+		}
+		if _, ok := o.pending[rec.Message.ID]; !ok {
+			o.order = append(o.order, rec.Message.ID)
+		}
+		o.pending[rec.Message.ID] = *rec.Message
+	case opAck:
+		delete(o.pending, rec.ID)
+	}
+}
+
+// Append durably records messages. Every message must have an ID.
+// It returns once the records are synced to disk.
+func (o *Outbox) Append(msgs []store.Message) error {
+	records := make([]record, len(msgs))
+	for i := range msgs {
+		if msgs[i].ID == "" {
+			return fmt.Errorf("outbox: message without ID")
+		}
+		records[i] = record{Op: opPut, Message: &msgs[i]}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.writeLocked(records); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		o.apply(rec)
+	}
+	return nil
+}
+
+// Ack marks messages as stored in the database
+func (o *Outbox) Ack(ids []string) error {
+	records := make([]record, len(ids))
+	for i, id := range ids {
+		records[i] = record{Op: opAck, ID: id}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.writeLocked(records); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		o.apply(rec)
+	}
+	o.acked += len(ids)
+
+	if o.acked >= compactAfter || (len(o.pending) == 0 && o.activeSize >= compactIdleSize) {
+		return o.compactLocked()
+	}
+	return nil
+}
+
+// Pending returns up to n messages not yet acknowledged, oldest first
+func (o *Outbox) Pending(n int) []store.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Drop acked IDs from the front so the scan stays short
+	for len(o.order) > 0 {
+		if _, ok := o.pending[o.order[0]]; ok {
+			break
+		}
+		o.order = o.order[1:]
+	}
+
+	var msgs []store.Message
+	for _, id := range o.order {
+		if len(msgs) == n {
+			break
+		}
+		if msg, ok := o.pending[id]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// Depth returns the number of messages waiting to be stored
+func (o *Outbox) Depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Close closes the active segment
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.active == nil {
+		return nil
+	}
+	err := o.active.Close()
+	o.active = nil
+	return err
+}
+
+// writeLocked appends records to the active segment and syncs it
+func (o *Outbox) writeLocked(records []record) error {
+	if o.active == nil {
+		return fmt.Errorf("outbox: closed")
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return fmt.Errorf("outbox: %w", err)
+		}
+	}
+
+	if _, err := o.active.Write(buf.Bytes()); err != nil {
+		return o.discardLocked(err)
+	}
+	if err := o.active.Sync(); err != nil {
+		return o.discardLocked(err)
+	}
+	o.activeSize += int64(buf.Len())
+	return nil
+}
+
+// discardLocked undoes a failed write, which may have left part of a record
+// behind. The active segment is cut back to its last whole record so the
+// next append does not land after a torn line; if that fails, the pending
+// messages move on to a fresh segment instead.
+func (o *Outbox) discardLocked(cause error) error {
+	if err := o.active.Truncate(o.activeSize); err != nil {
+		log.Printf("Outbox cannot truncate segment %d after a failed write: %v", o.activeSeq, err)
+		if err := o.compactLocked(); err != nil {
+			log.Printf("Outbox cannot roll over to a new segment: %v", err)
+		}
+	}
+	return fmt.Errorf("outbox: %w", cause)
+}
+
+// compactLocked writes the pending messages into a new segment, makes it the
+// active one and removes the older segments. The new segment only appears
+// under its final name once complete, so a crash midway leaves the old
+// segments in charge.
+func (o *Outbox) compactLocked() error {
+	seq := o.activeSeq + 1
+	path := o.segmentPath(seq)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	var order []string
+	for _, id := range o.order {
+		msg, ok := o.pending[id]
+		if !ok {
+			continue
+		}
+		if err := encoder.Encode(record{Op: opPut, Message: &msg}); err != nil {
+			f.Close()
+			return fmt.Errorf("outbox: %w", err)
+		}
+		order = append(order, id)
+	}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := o.syncDir(); err != nil {
+		return err
+	}
+
+	active, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if o.active != nil {
+		o.active.Close()
+	}
+	o.active = active
+	o.activeSize = int64(buf.Len())
+	o.order = order
+	o.acked = 0
+	o.activeSeq = seq
+
+	// The new segment holds everything still pending; older ones can go
+	return o.removeSegmentsBefore(seq)
+}
+
+// removeSegmentsBefore deletes every segment older than seq
+func (o *Outbox) removeSegmentsBefore(seq int) error {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	for _, entry := range entries {
+		if old, ok := parseSegmentName(entry.Name()); ok && old < seq {
+			if err := os.Remove(filepath.Join(o.dir, entry.Name())); err != nil {
+				return fmt.Errorf("outbox: %w", err)
+			}
+		}
+	}
+	return o.syncDir()
+}
+
+// syncDir makes renames and removals in the outbox directory durable
+func (o *Outbox) syncDir() error {
+	d, err := os.Open(o.dir)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return nil
+}
+
+func (o *Outbox) segmentPath(seq int) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%08d%s", seq, segmentExt))
+}
+
+func parseSegmentName(name string) (int, bool) {
+	if !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+	if err != nil || seq <= 0 {
+		return 0, false
+	}
+	return seq, true
+}
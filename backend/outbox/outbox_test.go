@@ -0,0 +1,272 @@
+package outbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"athena-backend/store"
+)
+
+func messages(ids ...string) []store.Message {
+	msgs := make([]store.Message, len(ids))
+	for i, id := range ids {
+		msgs[i] = store.Message{
+			ID:        id,
+			SenderID:  "sender",
+			Content:   "message " + id,
+			CreatedAt: time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC),
+		}
+	}
+	return msgs
+}
+
+func open(t *testing.T, dir string) *Outbox {
+	t.Helper()
+	o, err := Open(dir)
+	if err != nil {
+		t.Fatalf("opening outbox: %v", err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func pendingIDs(o *Outbox) []string {
+	var ids []string
+	for _, msg := range o.Pending(100) {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func assertPending(t *testing.T, o *Outbox, want ...string) {
+	t.Helper()
+	got := pendingIDs(o)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got pending %v, want %v", got, want)
+	}
+	if o.Depth() != len(want) {
+		t.Errorf("got depth %d, want %d", o.Depth(), len(want))
+	}
+}
+
+// segments returns the segment files in dir
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if _, ok := parseSegmentName(entry.Name()); ok {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestAppendAckReopen(t *testing.T) {
+	dir := t.TempDir()
+	o := open(t, dir)
+
+	if err := o.Append(messages("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Ack([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	assertPending(t, o, "a", "c")
+	if got := o.Pending(1); len(got) != 1 || got[0].ID != "a" || got[0].Content != "message a" {
+		t.Errorf("got first pending %+v, want message a", got)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPending(t, open(t, dir), "a", "c")
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	o := open(t, dir)
+	if err := o.Append(messages("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Ack([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Append(messages("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second outbox on the same directory sees what a restart after a
+	// crash would: the first one is never closed
+	assertPending(t, open(t, dir), "b", "c")
+}
+
+func TestTornFinalRecord(t *testing.T) {
+	dir := t.TempDir()
+	o := open(t, dir)
+	if err := o.Append(messages("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	// A crash in the middle of a write leaves a record without its newline
+	names := segments(t, dir)
+	f, err := os.OpenFile(filepath.Join(dir, names[len(names)-1]), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"op":"put","message":{"id":"c","cont`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	o = open(t, dir)
+	assertPending(t, o, "a", "b")
+
+	// Appending after recovery is not disturbed by the torn record
+	if err := o.Append(messages("d")); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	assertPending(t, open(t, dir), "a", "b", "d")
+}
+
+func TestFailedWriteIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	o := open(t, dir)
+	if err := o.Append(messages("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Part of a record made it to disk before the write failed
+	o.mu.Lock()
+	if _, err := o.active.WriteString(`{"op":"put","message":{"id":"b"`); err != nil {
+		t.Fatal(err)
+	}
+	err := o.discardLocked(errors.New("no space left on device"))
+	o.mu.Unlock()
+	if err == nil {
+		t.Fatal("got no error for a failed write")
+	}
+
+	if err := o.Append(messages("c")); err != nil {
+		t.Fatal(err)
+	}
+	assertPending(t, o, "a", "c")
+	o.Close()
+
+	// Every line left in the segment is a whole record
+	names := segments(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("got segments %v, want one", names)
+	}
+	f, err := os.Open(filepath.Join(dir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Errorf("segment holds a broken record %q: %v", scanner.Text(), err)
+		}
+	}
+
+	assertPending(t, open(t, dir), "a", "c")
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	o := open(t, dir)
+	first := segments(t, dir)
+	if len(first) != 1 {
+		t.Fatalf("got segments %v after opening, want one", first)
+	}
+
+	ids := make([]string, compactAfter)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%04d", i)
+	}
+	if err := o.Append(messages(ids...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Append(messages("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Acks below the threshold leave the segment alone
+	if err := o.Ack(ids[:compactAfter-1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := segments(t, dir); fmt.Sprint(got) != fmt.Sprint(first) {
+		t.Fatalf("got segments %v before the threshold, want %v", got, first)
+	}
+
+	// The last one rolls the log over to a new segment holding only what
+	// is still pending
+	if err := o.Ack(ids[compactAfter-1:]); err != nil {
+		t.Fatal(err)
+	}
+	rolled := segments(t, dir)
+	if len(rolled) != 1 || rolled[0] == first[0] {
+		t.Fatalf("got segments %v after compaction, want one replacing %v", rolled, first)
+	}
+	info, err := os.Stat(filepath.Join(dir, rolled[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 200 {
+		t.Errorf("compacted segment holds %d bytes, want only the pending message", info.Size())
+	}
+	assertPending(t, o, "kept")
+
+	// Appends go to the new segment
+	if err := o.Append(messages("after")); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	assertPending(t, open(t, dir), "kept", "after")
+}
+
+func TestDepth(t *testing.T) {
+	o := open(t, t.TempDir())
+	if o.Depth() != 0 {
+		t.Fatalf("got depth %d for a new outbox, want 0", o.Depth())
+	}
+
+	if err := o.Append(messages("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	// A message appended again, say by a retry, counts once
+	if err := o.Append(messages("a")); err != nil {
+		t.Fatal(err)
+	}
+	if o.Depth() != 2 {
+		t.Errorf("got depth %d, want 2", o.Depth())
+	}
+
+	// Acks of unknown messages change nothing
+	if err := o.Ack([]string{"a", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Depth() != 1 {
+		t.Errorf("got depth %d, want 1", o.Depth())
+	}
+
+	if err := o.Append([]store.Message{{Content: "no ID"}}); err == nil {
+		t.Error("got no error appending a message without ID")
+	}
+	if o.Depth() != 1 {
+		t.Errorf("got depth %d after a rejected append, want 1", o.Depth())
+	}
+}
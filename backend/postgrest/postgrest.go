@@ -0,0 +1,147 @@
+package postgrest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout bounds every request that is not given a deadline by its context
+const DefaultTimeout = 10 * time.Second
+
+// Client talks to the PostgREST API of a Supabase project
+type Client struct {
+	baseURL    string
+	apiKey     string
+	token      string
+	httpClient *http.Client
+	Timeout    time.Duration
+}
+
+// New creates a client for the project at baseURL (without the /rest/v1 suffix).
+// Requests are authorized with apiKey until WithToken is used.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		baseURL:    baseURL + "/rest/v1",
+		apiKey:     apiKey,
+		token:      apiKey,
+		httpClient: &http.Client{},
+		Timeout:    DefaultTimeout,
+	}
+}
+
+// WithToken returns a copy of the client that authorizes requests with a user's
+// access token, so row level security is evaluated as that user
+func (c *Client) WithToken(token string) *Client {
+	clone := *c
+	clone.token = token
+	return &clone
+}
+
+// From starts a query against table
+func (c *Client) From(table string) *Query {
+	return &Query{client: c, path: "/" + table}
+}
+
+// RPC calls a database function and decodes its result into out
+func (c *Client) RPC(ctx context.Context, function string, args interface{}, out interface{}) error {
+	return c.do(ctx, http.MethodPost, "/rpc/"+function, "", args, "", out)
+}
+
+// Error is the body PostgREST returns for failed requests
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Details    string `json:"details"`
+	Hint       string `json:"hint"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("postgrest: status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Details != "" {
+		msg += ": " + e.Details
+	}
+	return msg
+}
+
+// parseError builds an Error from a non-2xx response. Bodies that are not
+// PostgREST errors (e.g. from a gateway) are kept whole in Message.
+func parseError(statusCode int, body []byte) *Error {
+	pgErr := &Error{}
+	if err := json.Unmarshal(body, pgErr); err != nil || (pgErr.Code == "" && pgErr.Message == "") {
+		pgErr = &Error{Message: string(body)}
+	}
+	pgErr.StatusCode = statusCode
+	return pgErr
+}
+
+func (c *Client) do(ctx context.Context, method, path, query string, body interface{}, prefer string, out interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("postgrest: encode body: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	url := c.baseURL + path
+	if query != "" {
+		url += "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("apikey", c.apiKey)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if prefer != "" {
+		req.Header.Set("Prefer", prefer)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return parseError(resp.StatusCode, respBody)
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("postgrest: decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package postgrest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Filter is a condition on a column, or a logical combination of filters.
+// Values are always quoted, so user input cannot add operators to a query.
+type Filter struct {
+	column   string
+	operator string
+	values   []string // one value, or the list for in; none for is
+
+	logic   string // "and" or "or" for combined filters
+	filters []Filter
+}
+
+// Eq matches rows where column equals value
+func Eq(column, value string) Filter {
+	return Filter{column: column, operator: "eq", values: []string{value}}
+}
+
+// Neq matches rows where column does not equal value
+func Neq(column, value string) Filter {
+	return Filter{column: column, operator: "neq", values: []string{value}}
+}
+
+// Gt matches rows where column is greater than value
+func Gt(column, value string) Filter {
+	return Filter{column: column, operator: "gt", values: []string{value}}
+}
+
+// Lt matches rows where column is less than value
+func Lt(column, value string) Filter {
+	return Filter{column: column, operator: "lt", values: []string{value}}
+}
+
+// IsNull matches rows where column is null
+func IsNull(column string) Filter {
+	return Filter{column: column, operator: "is"}
+}
+
+// In matches rows where column equals one of values
+func In(column string, values ...string) Filter {
+	return Filter{column: column, operator: "in", values: values}
+}
+
+// And matches rows satisfying every filter
+func And(filters ...Filter) Filter {
+	return Filter{logic: "and", filters: filters}
+}
+
+// Or matches rows satisfying at least one filter
+func Or(filters ...Filter) Filter {
+	return Filter{logic: "or", filters: filters}
+}
+
+// quote wraps a value in double quotes, escaping backslashes and quotes, so
+// reserved characters like , . : ( ) are taken literally
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+// nested renders a filter inside a logic tree, e.g. and(a.eq."1",b.eq."2")
+func (f Filter) nested() string {
+	if f.logic != "" {
+		parts := make([]string, len(f.filters))
+		for i, child := range f.filters {
+			parts[i] = child.nested()
+		}
+		return f.logic + "(" + strings.Join(parts, ",") + ")"
+	}
+	quoted := make([]string, len(f.values))
+	for i, v := range f.values {
+		quoted[i] = quote(v)
+	}
+	switch f.operator {
+	case "is":
+		return f.column + ".is.null"
+	case "in":
+		return f.column + ".in.(" + strings.Join(quoted, ",") + ")"
+	}
+	return f.column + "." + f.operator + "." + quoted[0]
+}
+
+// Query is a request against a single table, built up by chaining
+type Query struct {
+	client *Client
+	path   string
+	params url.Values
+}
+
+func (q *Query) add(key, value string) *Query {
+	if q.params == nil {
+		q.params = url.Values{}
+	}
+	q.params.Add(key, value)
+	return q
+}
+
+// Select sets the columns (and embedded resources) to return
+func (q *Query) Select(columns string) *Query {
+	return q.add("select", columns)
+}
+
+// Where adds a filter. A single condition is sent as a one-element and=(...)
+// tree, since PostgREST only unquotes values inside logic trees and lists,
+// so every value goes through quote the same way.
+func (q *Query) Where(f Filter) *Query {
+	if f.logic == "" {
+		f = And(f)
+	}
+	parts := make([]string, len(f.filters))
+	for i, child := range f.filters {
+		parts[i] = child.nested()
+	}
+	return q.add(f.logic, "("+strings.Join(parts, ",")+")")
+}
+
+// Eq is shorthand for Where(Eq(column, value))
+func (q *Query) Eq(column, value string) *Query {
+	return q.Where(Eq(column, value))
+}
+
+// Order sorts the results by column
+func (q *Query) Order(column string, ascending bool) *Query {
+	direction := "desc"
+	if ascending {
+		direction = "asc"
+	}
+	return q.add("order", column+"."+direction)
+}
+
+// Limit caps the number of rows returned
+func (q *Query) Limit(n int) *Query {
+	return q.add("limit", strconv.Itoa(n))
+}
+
+// Offset skips the first n rows
+func (q *Query) Offset(n int) *Query {
+	return q.add("offset", strconv.Itoa(n))
+}
+
+// String returns the encoded query string
+func (q *Query) String() string {
+	return q.params.Encode()
+}
+
+// Get runs the query and decodes the matching rows into out
+func (q *Query) Get(ctx context.Context, out interface{}) error {
+	return q.client.do(ctx, http.MethodGet, q.path, q.String(), nil, "", out)
+}
+
+// Insert adds rows. When out is non-nil the inserted rows are returned into it.
+func (q *Query) Insert(ctx context.Context, rows interface{}, out interface{}) error {
+	return q.client.do(ctx, http.MethodPost, q.path, q.String(), rows, returnPreference(out), out)
+}
+
+// Update patches the rows matched by the query's filters. When out is non-nil
+// the updated rows are returned into it.
+func (q *Query) Update(ctx context.Context, values interface{}, out interface{}) error {
+	return q.client.do(ctx, http.MethodPatch, q.path, q.String(), values, returnPreference(out), out)
+}
+
+// Delete removes the rows matched by the query's filters
+func (q *Query) Delete(ctx context.Context) error {
+	return q.client.do(ctx, http.MethodDelete, q.path, q.String(), nil, "", nil)
+}
+
+func returnPreference(out interface{}) string {
+	if out == nil {
+		return "return=minimal"
+	}
+	return "return=representation"
+}
+
+// Rows runs q and returns the matching rows decoded as T
+func Rows[T any](ctx context.Context, q *Query) ([]T, error) {
+	var rows []T
+	if err := q.Get(ctx, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
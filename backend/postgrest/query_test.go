@@ -0,0 +1,100 @@
+package postgrest
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", `"plain"`},
+		{"", `""`},
+		{"a,b", `"a,b"`},
+		{"a.eq.b", `"a.eq.b"`},
+		{"f(x)", `"f(x)"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{`\"`, `"\\\""`},
+	}
+	for _, tt := range tests {
+		if got := quote(tt.value); got != tt.want {
+			t.Errorf("quote(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		key    string
+		want   string
+	}{
+		{"eq", Eq("id", "abc"), "and", `(id.eq."abc")`},
+		{"eq with comma", Eq("id", "a,id.neq.b"), "and", `(id.eq."a,id.neq.b")`},
+		{"eq with dots", Eq("name", "x.y.z"), "and", `(name.eq."x.y.z")`},
+		{"eq with parentheses", Eq("name", "a),or(id.gt.0"), "and", `(name.eq."a),or(id.gt.0")`},
+		{"eq with quotes", Eq("name", `a",id.eq."b`), "and", `(name.eq."a\",id.eq.\"b")`},
+		{"neq", Neq("status", "pending"), "and", `(status.neq."pending")`},
+		{"gt", Gt("created_at", "2026-01-01T00:00:00Z"), "and", `(created_at.gt."2026-01-01T00:00:00Z")`},
+		{"lt", Lt("seq", "10"), "and", `(seq.lt."10")`},
+		{"is null", IsNull("read_at"), "and", `(read_at.is.null)`},
+		{"in", In("id", "a", "b"), "and", `(id.in.("a","b"))`},
+		{"in with reserved characters", In("id", "a,b", "c)", `d"e`), "and", `(id.in.("a,b","c)","d\"e"))`},
+		{"in with no values", In("id"), "and", `(id.in.())`},
+		{
+			"or",
+			Or(Eq("a", "1"), Eq("b", "2")),
+			"or", `(a.eq."1",b.eq."2")`,
+		},
+		{
+			"or with reserved characters",
+			Or(Eq("a", "x,y"), Eq("b", "(z)"), Eq("c", `"q"`)),
+			"or", `(a.eq."x,y",b.eq."(z)",c.eq."\"q\"")`,
+		},
+		{
+			"or of ands",
+			Or(And(Eq("from", "u1"), Eq("to", "u2")), And(Eq("from", "u2"), Eq("to", "u1"))),
+			"or", `(and(from.eq."u1",to.eq."u2"),and(from.eq."u2",to.eq."u1"))`,
+		},
+		{
+			"or with null and in",
+			Or(IsNull("read_at"), Lt("read_at", "t.1"), In("id", "a,b")),
+			"or", `(read_at.is.null,read_at.lt."t.1",id.in.("a,b"))`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := (&Query{}).Where(tt.filter)
+			if len(q.params) != 1 {
+				t.Fatalf("got params %v, want only %s", q.params, tt.key)
+			}
+			if got := q.params.Get(tt.key); got != tt.want {
+				t.Errorf("got %s=%s, want %s", tt.key, got, tt.want)
+			}
+
+			// The encoded query decodes back to the same single parameter
+			decoded, err := url.ParseQuery(q.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decoded.Get(tt.key); got != tt.want || len(decoded) != 1 {
+				t.Errorf("got %v after encoding, want %s=%s", decoded, tt.key, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhereCombinesFilters(t *testing.T) {
+	q := (&Query{}).Eq("user_id", "u1").Where(In("id", "a", "b")).Where(Or(Eq("x", "1"), IsNull("x")))
+
+	if got := q.params["and"]; len(got) != 2 || got[0] != `(user_id.eq."u1")` || got[1] != `(id.in.("a","b"))` {
+		t.Errorf("got and=%v, want one tree per filter", got)
+	}
+	if got := q.params.Get("or"); got != `(x.eq."1",x.is.null)` {
+		t.Errorf("got or=%s", got)
+	}
+}
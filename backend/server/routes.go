@@ -1,82 +1,83 @@
 package server
 
 import (
+	"athena-backend/auth"
 	"athena-backend/handlers"
 	"athena-backend/utils"
-	"log"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
-	"github.com/supabase-community/gotrue-go"
 )
 
-var authClient gotrue.Client
+var authConfig auth.Config
 
-// SetAuthClient sets the auth client for use in utils
-func SetAuthClient(client gotrue.Client) {
-	authClient = client
+// SetAuthConfig sets how routes verify access tokens
+func SetAuthConfig(cfg auth.Config) {
+	authConfig = cfg
 }
 
 func SetupRoutes(app *fiber.App) {
+	requireAuth := auth.New(authConfig)
+
 	// Auth routes
 	app.Post("/api/auth/signup", handlers.HandleSignup)
 	app.Post("/api/auth/refresh", handlers.HandleRefreshToken)
-	app.Get("/api/auth/me", handlers.HandleGetUser)
-	app.Post("/api/auth/logout", handlers.HandleLogout)
+	app.Get("/api/auth/me", requireAuth, handlers.HandleGetUser)
+	app.Post("/api/auth/logout", requireAuth, handlers.HandleLogout)
 
 	// Profile routes
-	app.Post("/api/user/create-profile", handlers.HandleCreateProfile)
-	app.Get("/api/user/check-profile", handlers.HandleCheckProfile)
-	app.Get("/api/user/get-name/:id", handlers.HandleCheckId) // Path parameter
-	app.Get("/api/user/get-name", handlers.HandleCheckId)     // Query parameter
+	app.Post("/api/user/create-profile", requireAuth, handlers.HandleCreateProfile)
+	app.Get("/api/user/check-profile", requireAuth, handlers.HandleCheckProfile)
+	app.Get("/api/user/get-name/:id", requireAuth, handlers.HandleCheckId) // Path parameter
+	app.Get("/api/user/get-name", requireAuth, handlers.HandleCheckId)     // Query parameter
 
 	// User search
-	app.Get("/api/user/search-by-uid/:uid", utils.HandleSearchByUID)
+	app.Get("/api/user/search-by-uid/:uid", requireAuth, utils.HandleSearchByUID)
 
 	// Friend routes
-	app.Post("/api/friends/send-request", handlers.HandleSendFriendRequest)
-	app.Get("/api/friends/requests", handlers.HandleViewFriendRequests)
-	app.Put("/api/friends/manage-request", handlers.HandleManageFriendRequest)
-	app.Get("/api/friends/list", handlers.HandleLoadFriends)
+	app.Post("/api/friends/send-request", requireAuth, handlers.HandleSendFriendRequest)
+	app.Get("/api/friends/requests", requireAuth, handlers.HandleViewFriendRequests)
+	app.Put("/api/friends/manage-request", requireAuth, handlers.HandleManageFriendRequest)
+	app.Get("/api/friends/list", requireAuth, handlers.HandleLoadFriends)
+
+	// Conversation routes
+	app.Get("/api/conversations", requireAuth, handlers.HandleListConversations)
+	app.Post("/api/conversations", requireAuth, handlers.HandleCreateConversation)
+	app.Get("/api/conversations/:id", requireAuth, handlers.HandleGetConversation)
+	app.Post("/api/conversations/:id/members", requireAuth, handlers.HandleAddMembers)
+	app.Put("/api/conversations/:id/members/:userId", requireAuth, handlers.HandleUpdateMemberRole)
+	app.Delete("/api/conversations/:id/members/:userId", requireAuth, handlers.HandleRemoveMember)
+	app.Post("/api/conversations/:id/leave", requireAuth, handlers.HandleLeaveConversation)
 
 	// Message routes
-	app.Get("/api/messages/history", handlers.HandleGetMessageHistory)
-
-	app.Get("/ws", func(c *fiber.Ctx) error {
-		// Check if WebSocket upgrade
-		if !websocket.IsWebSocketUpgrade(c) {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "WebSocket upgrade required",
-			})
-		}
-
-		// Get token from query parameter
-		token := c.Query("token")
-		if token == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Authentication token required",
-			})
-		}
-
-		// Verify token and get user (same as your HTTP calls)
-		client := authClient.WithToken(token)
-		user, err := client.GetUser()
-		if err != nil {
-			log.Printf("WebSocket auth failed: %v", err)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid or expired token",
-			})
-		}
-
-		// Store authenticated user_id in context
-		c.Locals("authenticated_user_id", user.ID.String())
-
-		// Upgrade to WebSocket
-		return websocket.New(handlers.HandleWebSocket)(c)
-	})
+	app.Get("/api/messages/history", requireAuth, handlers.HandleGetMessageHistory)
+
+	// Call routes
+	app.Get("/api/calls/history", requireAuth, handlers.HandleGetCallHistory)
+	app.Get("/api/calls/ice-servers", requireAuth, handlers.HandleGetICEServers)
+	app.Post("/api/calls/voicemail", requireAuth, handlers.HandleUploadVoicemail)
+	app.Get("/api/calls/voicemail/*", requireAuth, handlers.HandleGetVoicemail)
+
+	// Browsers cannot set headers on the WebSocket upgrade, so the token comes from the query
+	wsAuthConfig := authConfig
+	wsAuthConfig.TokenQuery = "token"
+
+	app.Get("/ws", requireWebSocketUpgrade, auth.New(wsAuthConfig), websocket.New(handlers.HandleWebSocket))
 
 	// Health check
 	app.Get("/api/health", handleHealth)
+
+	// Operational numbers are only for signed-in users
+	app.Get("/api/metrics", requireAuth, handleMetrics)
+}
+
+func requireWebSocketUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "WebSocket upgrade required",
+		})
+	}
+	return c.Next()
 }
 
 func handleHealth(c *fiber.Ctx) error {
@@ -85,3 +86,16 @@ func handleHealth(c *fiber.Ctx) error {
 		"message": "Server is running",
 	})
 }
+
+func handleMetrics(c *fiber.Ctx) error {
+	metrics := fiber.Map{}
+	// Messages waiting in the local outbox for the database
+	if depth := handlers.OutboxDepth(); depth >= 0 {
+		metrics["outbox_depth"] = depth
+	}
+	// Relay usage of the embedded TURN server
+	if usage, ok := handlers.TURNUsage(); ok {
+		metrics["turn"] = usage
+	}
+	return c.JSON(metrics)
+}
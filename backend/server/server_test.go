@@ -0,0 +1,372 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"athena-backend/testsupport"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The handlers keep their dependencies in package state, so none of these
+// tests may run in parallel
+
+func newApp(t *testing.T) (*testsupport.FakeSupabase, *fiber.App) {
+	t.Helper()
+	f := testsupport.NewFakeSupabase()
+	t.Cleanup(f.Close)
+	return f, testsupport.NewApp(f)
+}
+
+// do sends a request to app, with token as bearer token if set, and decodes
+// the JSON response into out if it is not nil
+func do(t *testing.T, app *fiber.App, method, path, token string, body, out interface{}) int {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// newUser signs up a user with a profile and returns its ID and access token
+func newUser(t *testing.T, f *testsupport.FakeSupabase, app *fiber.App, email, name string) (string, string) {
+	t.Helper()
+	userID := f.CreateUser(email)
+	token := f.AccessToken(userID)
+	if status := do(t, app, "POST", "/api/user/create-profile", token, fiber.Map{"name": name}, nil); status != http.StatusOK {
+		t.Fatalf("creating profile of %s: status %d", email, status)
+	}
+	return userID, token
+}
+
+type friendRequest struct {
+	ID       string `json:"id"`
+	UserName string `json:"user_name"`
+	Status   string `json:"status"`
+}
+
+type friend struct {
+	ID   string `json:"fid"`
+	Name string `json:"name"`
+}
+
+// befriend has fromToken's user send toID a friend request that toToken accepts
+func befriend(t *testing.T, app *fiber.App, fromToken, toID, toToken string) {
+	t.Helper()
+	if status := do(t, app, "POST", "/api/friends/send-request", fromToken, fiber.Map{"receiver_id": toID}, nil); status != http.StatusOK {
+		t.Fatalf("sending friend request: status %d", status)
+	}
+
+	var requests struct {
+		Received []friendRequest `json:"received"`
+	}
+	do(t, app, "GET", "/api/friends/requests?type=received&status=pending", toToken, nil, &requests)
+	if len(requests.Received) != 1 {
+		t.Fatalf("got %d pending requests, want 1", len(requests.Received))
+	}
+
+	body := fiber.Map{"request_id": requests.Received[0].ID, "status": "accepted"}
+	if status := do(t, app, "PUT", "/api/friends/manage-request", toToken, body, nil); status != http.StatusOK {
+		t.Fatalf("accepting friend request: status %d", status)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	f, app := newApp(t)
+	userID := f.CreateUser("alice@example.com")
+
+	if status := do(t, app, "GET", "/api/auth/me", "", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("without token: status %d, want 401", status)
+	}
+	if status := do(t, app, "GET", "/api/auth/me", "not-a-token", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("with malformed token: status %d, want 401", status)
+	}
+
+	var me struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if status := do(t, app, "GET", "/api/auth/me", f.AccessToken(userID), nil, &me); status != http.StatusOK {
+		t.Fatalf("with token: status %d, want 200", status)
+	}
+	if me.User.ID != userID {
+		t.Errorf("got user %q, want %q", me.User.ID, userID)
+	}
+}
+
+func TestHealthAndMetrics(t *testing.T) {
+	f, app := newApp(t)
+
+	var health map[string]interface{}
+	if status := do(t, app, "GET", "/api/health", "", nil, &health); status != http.StatusOK {
+		t.Fatalf("health: status %d, want 200", status)
+	}
+	if len(health) != 2 || health["status"] != "ok" {
+		t.Errorf("got health %v, want only status and message", health)
+	}
+
+	if status := do(t, app, "GET", "/api/metrics", "", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("metrics without token: status %d, want 401", status)
+	}
+	token := f.AccessToken(f.CreateUser("alice@example.com"))
+	if status := do(t, app, "GET", "/api/metrics", token, nil, nil); status != http.StatusOK {
+		t.Errorf("metrics with token: status %d, want 200", status)
+	}
+}
+
+func TestFriendRequests(t *testing.T) {
+	f, app := newApp(t)
+	aliceID, aliceToken := newUser(t, f, app, "alice@example.com", "Alice")
+	bobID, bobToken := newUser(t, f, app, "bob@example.com", "Bob")
+
+	if status := do(t, app, "POST", "/api/friends/send-request", aliceToken, fiber.Map{"receiver_id": bobID}, nil); status != http.StatusOK {
+		t.Fatalf("sending request: status %d", status)
+	}
+	if status := do(t, app, "POST", "/api/friends/send-request", aliceToken, fiber.Map{"receiver_id": bobID}, nil); status != http.StatusConflict {
+		t.Errorf("sending it again: status %d, want 409", status)
+	}
+	if status := do(t, app, "POST", "/api/friends/send-request", aliceToken, fiber.Map{"receiver_id": aliceID}, nil); status != http.StatusBadRequest {
+		t.Errorf("sending one to herself: status %d, want 400", status)
+	}
+
+	var requests struct {
+		Received []friendRequest `json:"received"`
+		Sent     []friendRequest `json:"sent"`
+	}
+	do(t, app, "GET", "/api/friends/requests", bobToken, nil, &requests)
+	if len(requests.Received) != 1 || len(requests.Sent) != 0 {
+		t.Fatalf("bob has %d received and %d sent requests, want 1 and 0", len(requests.Received), len(requests.Sent))
+	}
+	if got := requests.Received[0]; got.UserName != "Alice" || got.Status != "pending" {
+		t.Errorf("got request from %q in status %q, want Alice and pending", got.UserName, got.Status)
+	}
+
+	// Only the receiver may answer the request
+	body := fiber.Map{"request_id": requests.Received[0].ID, "status": "accepted"}
+	if status := do(t, app, "PUT", "/api/friends/manage-request", aliceToken, body, nil); status != http.StatusNotFound {
+		t.Errorf("accepting as sender: status %d, want 404", status)
+	}
+	if status := do(t, app, "PUT", "/api/friends/manage-request", bobToken, body, nil); status != http.StatusOK {
+		t.Fatalf("accepting: status %d", status)
+	}
+
+	for _, user := range []struct{ token, friendID, friendName string }{
+		{aliceToken, bobID, "Bob"},
+		{bobToken, aliceID, "Alice"},
+	} {
+		var list struct {
+			Friends []friend `json:"friends"`
+		}
+		do(t, app, "GET", "/api/friends/list", user.token, nil, &list)
+		if len(list.Friends) != 1 || list.Friends[0].ID != user.friendID || list.Friends[0].Name != user.friendName {
+			t.Errorf("got friends %+v, want only %s", list.Friends, user.friendName)
+		}
+	}
+
+	if status := do(t, app, "POST", "/api/friends/send-request", bobToken, fiber.Map{"receiver_id": aliceID}, nil); status != http.StatusConflict {
+		t.Errorf("sending a request to a friend: status %d, want 409", status)
+	}
+}
+
+type frame struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type chatMessage struct {
+	ID             string    `json:"id"`
+	ConversationID string    `json:"conversation_id"`
+	SenderID       string    `json:"sender_id"`
+	Content        string    `json:"content"`
+	CreatedAt      time.Time `json:"created_at"`
+	Status         string    `json:"status"`
+}
+
+type wsClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// listen serves app on a local port and returns its address
+func listen(t *testing.T, app *fiber.App) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	return ln.Addr().String()
+}
+
+// connect opens a WebSocket for token and returns once the hub has
+// registered it: the chat error for an empty message only comes back from a
+// connection past registration.
+func connect(t *testing.T, addr, token string) *wsClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &wsClient{t: t, conn: conn}
+	c.send("chat", fiber.Map{})
+	c.expect("chat-error")
+	return c
+}
+
+func (c *wsClient) send(msgType string, payload interface{}) {
+	c.t.Helper()
+	b, err := json.Marshal(payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteJSON(frame{Type: msgType, Payload: b}); err != nil {
+		c.t.Fatalf("sending %s: %v", msgType, err)
+	}
+}
+
+// next reads one frame. Chat messages arrive without a type.
+func (c *wsClient) next() (string, json.RawMessage) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("reading: %v", err)
+	}
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		c.t.Fatalf("decoding %s: %v", data, err)
+	}
+	if f.Type == "" {
+		return "", data
+	}
+	return f.Type, f.Payload
+}
+
+// expect reads the next frame and fails unless it has msgType
+func (c *wsClient) expect(msgType string) json.RawMessage {
+	c.t.Helper()
+	got, payload := c.next()
+	if got != msgType {
+		c.t.Fatalf("got frame %q (%s), want %q", got, payload, msgType)
+	}
+	return payload
+}
+
+func TestWebSocketRequiresToken(t *testing.T) {
+	_, app := newApp(t)
+	addr := listen(t, app)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if !errors.Is(err, websocket.ErrBadHandshake) {
+		t.Fatalf("got error %v, want a refused handshake", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestChatRoundTrip(t *testing.T) {
+	f, app := newApp(t)
+	aliceID, aliceToken := newUser(t, f, app, "alice@example.com", "Alice")
+	bobID, bobToken := newUser(t, f, app, "bob@example.com", "Bob")
+	carolID, _ := newUser(t, f, app, "carol@example.com", "Carol")
+	befriend(t, app, aliceToken, bobID, bobToken)
+
+	addr := listen(t, app)
+	alice := connect(t, addr, aliceToken)
+	bob := connect(t, addr, bobToken)
+
+	var ids []string
+	for i, content := range []string{"hi bob", "how are you?"} {
+		clientMsgID := []string{"m1", "m2"}[i]
+		alice.send("chat", fiber.Map{"recipient_id": bobID, "content": content, "client_msg_id": clientMsgID})
+
+		var ack struct {
+			ClientMsgID string `json:"client_msg_id"`
+			ID          string `json:"id"`
+			Status      string `json:"status"`
+		}
+		if err := json.Unmarshal(alice.expect("chat-ack"), &ack); err != nil {
+			t.Fatal(err)
+		}
+		if ack.ClientMsgID != clientMsgID || ack.ID == "" || ack.Status != "delivered" {
+			t.Fatalf("got ack %+v, want %s delivered", ack, clientMsgID)
+		}
+
+		var msg chatMessage
+		if err := json.Unmarshal(bob.expect(""), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != ack.ID || msg.SenderID != aliceID || msg.Content != content {
+			t.Fatalf("bob got %+v, want %q from alice", msg, content)
+		}
+		ids = append(ids, ack.ID)
+	}
+
+	// Messages to users who are not friends are refused
+	alice.send("chat", fiber.Map{"recipient_id": carolID, "content": "hi carol"})
+	alice.expect("chat-error")
+
+	type history struct {
+		Messages []chatMessage `json:"messages"`
+	}
+	var all history
+	if status := do(t, app, "GET", "/api/messages/history?friend_id="+aliceID, bobToken, nil, &all); status != http.StatusOK {
+		t.Fatalf("fetching history: status %d", status)
+	}
+	if len(all.Messages) != 2 || all.Messages[0].ID != ids[0] || all.Messages[1].ID != ids[1] {
+		t.Fatalf("got history %+v, want messages %v in order", all.Messages, ids)
+	}
+	if !all.Messages[0].CreatedAt.Before(all.Messages[1].CreatedAt) {
+		t.Errorf("message times %v and %v are not increasing", all.Messages[0].CreatedAt, all.Messages[1].CreatedAt)
+	}
+
+	var page history
+	do(t, app, "GET", "/api/messages/history?friend_id="+bobID+"&limit=1&offset=1", aliceToken, nil, &page)
+	if len(page.Messages) != 1 || page.Messages[0].Content != "how are you?" {
+		t.Errorf("got page %+v, want the second message", page.Messages)
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", "offset=-1"} {
+		if status := do(t, app, "GET", "/api/messages/history?friend_id="+bobID+"&"+query, aliceToken, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("history with %s: status %d, want 400", query, status)
+		}
+	}
+}
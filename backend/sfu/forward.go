@@ -0,0 +1,308 @@
+package sfu
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Simulcast layers, named by the RID publishers give their encodings
+const (
+	LayerLow    = "q" // quarter resolution
+	LayerMedium = "h" // half resolution
+	LayerHigh   = "f" // full resolution
+
+	// DefaultLayer is forwarded until a subscriber picks one
+	DefaultLayer = LayerMedium
+)
+
+// layerRanks orders the known layers, lowest first
+var layerRanks = map[string]int{LayerLow: 0, LayerMedium: 1, LayerHigh: 2}
+
+// keyframeInterval is the least time between two keyframe requests for a layer
+const keyframeInterval = 500 * time.Millisecond
+
+// publication is a track one participant publishes, in one or more
+// simulcast layers, and the copies of it forwarded to the others
+type publication struct {
+	key       string
+	publisher *Peer
+	trackID   string
+	kind      webrtc.RTPCodecType
+	codec     webrtc.RTPCodecCapability
+
+	mu           sync.RWMutex
+	layers       map[string]*webrtc.TrackRemote // by RID, "" without simulcast
+	downTracks   map[*Peer]*downTrack           // by subscriber
+	lastKeyframe map[string]time.Time           // when a keyframe was last requested, by RID
+}
+
+func newPublication(key string, publisher *Peer, track *webrtc.TrackRemote) *publication {
+	return &publication{
+		key:          key,
+		publisher:    publisher,
+		trackID:      track.ID(),
+		kind:         track.Kind(),
+		codec:        track.Codec().RTPCodecCapability,
+		layers:       make(map[string]*webrtc.TrackRemote),
+		downTracks:   make(map[*Peer]*downTrack),
+		lastKeyframe: make(map[string]time.Time),
+	}
+}
+
+// subscribe adds the track to sub's subscriber connection, which then needs
+// renegotiating. The room's lock must be held.
+func (pub *publication) subscribe(sub *Peer) error {
+	// The stream ID tells the subscriber whose track it is
+	local, err := webrtc.NewTrackLocalStaticRTP(pub.codec, pub.trackID, pub.publisher.ID)
+	if err != nil {
+		return err
+	}
+	sender, err := sub.subscriber.AddTrack(local)
+	if err != nil {
+		return err
+	}
+
+	d := &downTrack{
+		pub:        pub,
+		subscriber: sub,
+		track:      local,
+		sender:     sender,
+		want:       sub.layer(pub.publisher.ID),
+		frameTicks: pub.codec.ClockRate / 30,
+	}
+	pub.mu.Lock()
+	pub.downTracks[sub] = d
+	d.target = pub.resolve(d.want)
+	pub.mu.Unlock()
+
+	go d.readRTCP()
+	pub.requestKeyframe(d.target)
+	return nil
+}
+
+// unsubscribe stops forwarding to a subscriber that is leaving
+func (pub *publication) unsubscribe(sub *Peer) {
+	pub.mu.Lock()
+	delete(pub.downTracks, sub)
+	pub.mu.Unlock()
+}
+
+// close stops forwarding to everyone and takes the track off their
+// subscriber connections. It returns the subscribers to renegotiate.
+func (pub *publication) close() []*Peer {
+	pub.mu.Lock()
+	downTracks := pub.downTracks
+	pub.downTracks = make(map[*Peer]*downTrack)
+	pub.mu.Unlock()
+
+	subscribers := make([]*Peer, 0, len(downTracks))
+	for sub, d := range downTracks {
+		if err := sub.subscriber.RemoveTrack(d.sender); err == nil {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	return subscribers
+}
+
+// addLayer starts receiving a simulcast layer, which subscribers waiting
+// for it switch to
+func (pub *publication) addLayer(track *webrtc.TrackRemote) {
+	pub.mu.Lock()
+	pub.layers[track.RID()] = track
+	pub.retarget()
+	pub.mu.Unlock()
+
+	pub.requestKeyframe(track.RID())
+}
+
+// removeLayer drops a layer that stopped and returns how many remain
+func (pub *publication) removeLayer(rid string) int {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	delete(pub.layers, rid)
+	pub.retarget()
+	return len(pub.layers)
+}
+
+// retarget points every subscriber at the layer closest to the one it
+// wants, among those published. The publication's lock must be held.
+func (pub *publication) retarget() {
+	for _, d := range pub.downTracks {
+		d.mu.Lock()
+		d.target = pub.resolve(d.want)
+		d.mu.Unlock()
+	}
+}
+
+// selectLayer changes the layer sub wants
+func (pub *publication) selectLayer(sub *Peer, rid string) {
+	pub.mu.Lock()
+	d, ok := pub.downTracks[sub]
+	if !ok {
+		pub.mu.Unlock()
+		return
+	}
+	target := pub.resolve(rid)
+	d.mu.Lock()
+	d.want = rid
+	changed := d.target != target
+	d.target = target
+	d.mu.Unlock()
+	pub.mu.Unlock()
+
+	if changed {
+		pub.requestKeyframe(target)
+	}
+}
+
+// resolve picks the published layer for a subscriber wanting want: that
+// layer, else the best one below it, else the lowest one. The publication's
+// lock must be held.
+func (pub *publication) resolve(want string) string {
+	if _, ok := pub.layers[want]; ok {
+		return want
+	}
+
+	wantRank, ok := layerRanks[want]
+	if !ok {
+		wantRank = layerRanks[DefaultLayer]
+	}
+	best, bestRank := "", -1
+	lowest, lowestRank := "", math.MaxInt
+	for rid := range pub.layers {
+		rank, known := layerRanks[rid]
+		if !known {
+			rank = len(layerRanks)
+		}
+		if rank <= wantRank && rank > bestRank {
+			best, bestRank = rid, rank
+		}
+		if rank < lowestRank || (rank == lowestRank && rid < lowest) {
+			lowest, lowestRank = rid, rank
+		}
+	}
+	if bestRank >= 0 {
+		return best
+	}
+	return lowest
+}
+
+// requestKeyframe asks the publisher for a keyframe on a video layer, so a
+// subscriber can start decoding it
+func (pub *publication) requestKeyframe(rid string) {
+	if pub.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	pub.mu.Lock()
+	track, ok := pub.layers[rid]
+	if !ok || time.Since(pub.lastKeyframe[rid]) < keyframeInterval {
+		pub.mu.Unlock()
+		return
+	}
+	pub.lastKeyframe[rid] = time.Now()
+	pub.mu.Unlock()
+
+	_ = pub.publisher.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+	})
+}
+
+// forward reads one layer until it ends and hands each packet to the
+// subscribers
+func (pub *publication) forward(track *webrtc.TrackRemote) {
+	rid := track.RID()
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		keyframe := pub.kind == webrtc.RTPCodecTypeAudio || isKeyframe(pub.codec.MimeType, pkt.Payload)
+
+		pub.mu.RLock()
+		for _, d := range pub.downTracks {
+			d.write(rid, pkt, keyframe)
+		}
+		pub.mu.RUnlock()
+	}
+}
+
+// downTrack forwards one layer of a publication to one subscriber. Layers
+// number their packets independently, so on a switch the sequence numbers
+// and timestamps are shifted to carry on from the last packet sent.
+type downTrack struct {
+	pub        *publication
+	subscriber *Peer
+	track      *webrtc.TrackLocalStaticRTP
+	sender     *webrtc.RTPSender
+	frameTicks uint32 // timestamp gap left at a switch, about one frame
+
+	mu         sync.Mutex
+	want       string // layer the subscriber asked for
+	target     string // published layer closest to want
+	current    string // layer being forwarded
+	forwarding bool   // false until the first keyframe of target
+	sent       bool   // lastSeq and lastTS are set
+	seqOffset  uint16
+	tsOffset   uint32
+	lastSeq    uint16
+	lastTS     uint32
+}
+
+// write forwards pkt if it belongs to the layer being forwarded, switching
+// to the target layer on its next keyframe
+func (d *downTrack) write(rid string, pkt *rtp.Packet, keyframe bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.forwarding || rid != d.current {
+		if rid != d.target || !keyframe {
+			return
+		}
+		if d.forwarding {
+			d.seqOffset = d.lastSeq + 1 - pkt.SequenceNumber
+			d.tsOffset = d.lastTS + d.frameTicks - pkt.Timestamp
+		}
+		d.current = rid
+		d.forwarding = true
+	}
+
+	out := *pkt
+	// The publisher's header extension IDs mean nothing on the subscriber's
+	// connection, whose interceptors add their own
+	out.Header.Extension = false
+	out.Header.Extensions = nil
+	out.SequenceNumber = pkt.SequenceNumber + d.seqOffset
+	out.Timestamp = pkt.Timestamp + d.tsOffset
+	if int16(out.SequenceNumber-d.lastSeq) > 0 || !d.sent {
+		d.lastSeq = out.SequenceNumber
+		d.lastTS = out.Timestamp
+		d.sent = true
+	}
+	_ = d.track.WriteRTP(&out)
+}
+
+// readRTCP passes the subscriber's keyframe requests on to the publisher.
+// Reading also lets the interceptors process the subscriber's reports.
+func (d *downTrack) readRTCP() {
+	for {
+		pkts, _, err := d.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				d.mu.Lock()
+				layer := d.target
+				d.mu.Unlock()
+				d.pub.requestKeyframe(layer)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package sfu
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// isKeyframe reports whether an RTP payload starts a frame that decodes on
+// its own, which is where a subscriber can switch to another simulcast layer.
+// Payloads of codecs it does not know count as keyframes.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return vp8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return vp9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264Keyframe(payload)
+	default:
+		return true
+	}
+}
+
+// vp8Keyframe parses the payload descriptor of RFC 7741 and checks the
+// inverse key frame flag of the first partition
+func vp8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	start := payload[0]&0x10 != 0
+	partition := payload[0] & 0x07
+	if !start || partition != 0 {
+		return false
+	}
+
+	i := 1
+	if payload[0]&0x80 != 0 { // extended control bits
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 { // picture ID, one or two bytes
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // TID and KEYIDX share a byte
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// vp9Keyframe checks the descriptor of RFC 9628: the start of a frame that
+// is not inter-picture predicted
+func vp9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	predicted := payload[0]&0x40 != 0
+	begin := payload[0]&0x08 != 0
+	return !predicted && begin
+}
+
+// h264Keyframe looks for an IDR slice or SPS in single NAL units, STAP-A
+// aggregates and the first fragment of FU-A units (RFC 6184)
+func h264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		t := payload[1] & 0x1f
+		return start && (t == 5 || t == 7)
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package sfu
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// maxPendingCandidates caps the candidates kept for a peer connection that
+// has no remote description yet
+const maxPendingCandidates = 50
+
+// Peer is a participant of a room and its two peer connections to the SFU
+type Peer struct {
+	ID string
+
+	room       *room
+	signal     func(Signal)
+	publisher  *webrtc.PeerConnection
+	subscriber *webrtc.PeerConnection
+	layers     map[string]string // layer wanted from each publisher, guarded by the room
+
+	mu          sync.Mutex // orders the signals sent, so no candidate overtakes its SDP
+	negotiating bool       // an offer on the subscriber connection awaits its answer
+	renegotiate bool       // subscriptions changed while negotiating
+	closed      bool
+	pending     map[Target][]webrtc.ICECandidateInit // received before the remote description
+}
+
+func newPeer(s *SFU, r *room, id string, signal func(Signal)) (*Peer, error) {
+	publisher, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		return nil, fmt.Errorf("sfu: %w", err)
+	}
+	subscriber, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		publisher.Close()
+		return nil, fmt.Errorf("sfu: %w", err)
+	}
+
+	p := &Peer{
+		ID:         id,
+		room:       r,
+		signal:     signal,
+		publisher:  publisher,
+		subscriber: subscriber,
+		layers:     make(map[string]string),
+		pending:    make(map[Target][]webrtc.ICECandidateInit),
+	}
+	publisher.OnICECandidate(p.sendCandidate(TargetPublisher))
+	subscriber.OnICECandidate(p.sendCandidate(TargetSubscriber))
+	publisher.OnTrack(p.published)
+	publisher.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("SFU room %s: publisher connection of %s is %s", r.id, id, state)
+	})
+	return p, nil
+}
+
+// Offer answers the participant's offer for its publisher connection. The
+// answer goes out as a signal.
+func (p *Peer) Offer(sdp string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrUnknownPeer
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err := p.publisher.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("sfu: %w", err)
+	}
+	p.addPending(TargetPublisher)
+
+	answer, err := p.publisher.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("sfu: %w", err)
+	}
+	if err := p.publisher.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("sfu: %w", err)
+	}
+	p.signal(Signal{Type: SignalAnswer, Target: TargetPublisher, SDP: answer.SDP})
+	return nil
+}
+
+// Answer applies the participant's answer to the last offer on its
+// subscriber connection
+func (p *Peer) Answer(sdp string) error {
+	p.mu.Lock()
+	if p.closed || !p.negotiating {
+		p.mu.Unlock()
+		return ErrNoOffer
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}
+	err := p.subscriber.SetRemoteDescription(answer)
+	if err == nil {
+		p.addPending(TargetSubscriber)
+	}
+	p.negotiating = false
+	again := p.renegotiate
+	p.renegotiate = false
+	p.mu.Unlock()
+
+	// A failed answer leaves the connection in have-local-offer; the next
+	// offer rolls it back
+	if again || err != nil {
+		p.negotiate()
+	}
+	if err != nil {
+		return fmt.Errorf("sfu: %w", err)
+	}
+	return nil
+}
+
+// AddCandidate adds one of the participant's ICE candidates to a connection
+func (p *Peer) AddCandidate(target Target, candidate webrtc.ICECandidateInit) error {
+	pc, err := p.connection(target)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrUnknownPeer
+	}
+	if pc.RemoteDescription() == nil {
+		if len(p.pending[target]) < maxPendingCandidates {
+			p.pending[target] = append(p.pending[target], candidate)
+		}
+		return nil
+	}
+	if err := pc.AddICECandidate(candidate); err != nil {
+		return fmt.Errorf("sfu: %w", err)
+	}
+	return nil
+}
+
+// SelectLayer picks the simulcast layer forwarded from a publisher. Until
+// the publisher sends that layer, the closest lower one is forwarded.
+func (p *Peer) SelectLayer(publisherID, layer string) error {
+	r := p.room
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.peers[publisherID]; !ok || publisherID == p.ID {
+		return ErrUnknownPublisher
+	}
+	p.layers[publisherID] = layer
+	for _, pub := range r.publications {
+		if pub.publisher.ID == publisherID && pub.kind == webrtc.RTPCodecTypeVideo {
+			pub.selectLayer(p, layer)
+		}
+	}
+	return nil
+}
+
+// layer returns the layer wanted from a publisher. The room's lock must be held.
+func (p *Peer) layer(publisherID string) string {
+	if layer, ok := p.layers[publisherID]; ok {
+		return layer
+	}
+	return DefaultLayer
+}
+
+func (p *Peer) connection(target Target) (*webrtc.PeerConnection, error) {
+	switch target {
+	case TargetPublisher:
+		return p.publisher, nil
+	case TargetSubscriber:
+		return p.subscriber, nil
+	default:
+		return nil, ErrUnknownTarget
+	}
+}
+
+// addPending adds the candidates that came before the remote description.
+// The peer's lock must be held.
+func (p *Peer) addPending(target Target) {
+	pc, _ := p.connection(target)
+	for _, candidate := range p.pending[target] {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			log.Printf("SFU room %s: dropped %s candidate of %s: %v", p.room.id, target, p.ID, err)
+		}
+	}
+	delete(p.pending, target)
+}
+
+// negotiate offers the current set of forwarded tracks on the subscriber
+// connection. While an offer is outstanding, another one follows its answer.
+func (p *Peer) negotiate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	if p.negotiating {
+		p.renegotiate = true
+		return
+	}
+
+	if p.subscriber.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}
+		if err := p.subscriber.SetLocalDescription(rollback); err != nil {
+			log.Printf("SFU room %s: cannot roll back offer to %s: %v", p.room.id, p.ID, err)
+			return
+		}
+	}
+	offer, err := p.subscriber.CreateOffer(nil)
+	if err == nil {
+		err = p.subscriber.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("SFU room %s: cannot offer tracks to %s: %v", p.room.id, p.ID, err)
+		return
+	}
+
+	p.negotiating = true
+	p.signal(Signal{Type: SignalOffer, Target: TargetSubscriber, SDP: offer.SDP})
+}
+
+// sendCandidate signals the SFU's own candidates for a connection
+func (p *Peer) sendCandidate(target Target) func(*webrtc.ICECandidate) {
+	return func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if !p.closed {
+			p.signal(Signal{Type: SignalCandidate, Target: target, Candidate: c.ToJSON()})
+		}
+	}
+}
+
+// published forwards a track layer the participant sends, for as long as
+// it keeps sending it
+func (p *Peer) published(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	log.Printf("SFU room %s: %s publishes %s track %s (layer %q, %s)", p.room.id, p.ID, track.Kind(), track.ID(), track.RID(), track.Codec().MimeType)
+
+	pub := p.room.publish(p, track)
+	if pub == nil {
+		return
+	}
+	pub.forward(track)
+	if pub.removeLayer(track.RID()) == 0 {
+		p.room.unpublish(pub)
+	}
+}
+
+// close stops the peer's signals at once and ends both peer connections in
+// the background, as closing waits for their transports to shut down
+func (p *Peer) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	go func() {
+		p.publisher.Close()
+		p.subscriber.Close()
+	}()
+}
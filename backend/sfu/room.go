@@ -0,0 +1,123 @@
+package sfu
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// room is the participants of one group call and the tracks they publish
+type room struct {
+	id string
+
+	mu           sync.Mutex // also guards Peer.layers
+	peers        map[string]*Peer
+	publications map[string]*publication // keyed by publisher ID, kind and track ID
+}
+
+func newRoom(id string) *room {
+	return &room{
+		id:           id,
+		peers:        make(map[string]*Peer),
+		publications: make(map[string]*publication),
+	}
+}
+
+func (r *room) peer(id string) (*Peer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[id]
+	return p, ok
+}
+
+// join adds p and subscribes it to everything already published
+func (r *room) join(p *Peer) {
+	r.mu.Lock()
+	r.peers[p.ID] = p
+	subscribed := false
+	for _, pub := range r.publications {
+		if pub.subscribe(p) == nil {
+			subscribed = true
+		}
+	}
+	r.mu.Unlock()
+
+	if subscribed {
+		p.negotiate()
+	}
+}
+
+// leave removes p, its publications and its subscriptions, and returns how
+// many participants remain
+func (r *room) leave(p *Peer) int {
+	r.mu.Lock()
+	delete(r.peers, p.ID)
+	renegotiate := make(map[*Peer]bool)
+	for key, pub := range r.publications {
+		if pub.publisher != p {
+			pub.unsubscribe(p)
+			continue
+		}
+		delete(r.publications, key)
+		for _, sub := range pub.close() {
+			renegotiate[sub] = true
+		}
+	}
+	for _, other := range r.peers {
+		delete(other.layers, p.ID)
+	}
+	remaining := len(r.peers)
+	r.mu.Unlock()
+
+	for sub := range renegotiate {
+		sub.negotiate()
+	}
+	return remaining
+}
+
+// publish records one layer of a track p sends. The first layer of a track
+// starts forwarding it to everyone else in the room. It returns nil once p
+// has left.
+func (r *room) publish(p *Peer, track *webrtc.TrackRemote) *publication {
+	key := p.ID + "/" + track.Kind().String() + "/" + track.ID()
+
+	r.mu.Lock()
+	if r.peers[p.ID] != p {
+		r.mu.Unlock()
+		return nil
+	}
+	pub, ok := r.publications[key]
+	var subscribers []*Peer
+	if !ok {
+		pub = newPublication(key, p, track)
+		r.publications[key] = pub
+		for _, other := range r.peers {
+			if other != p && pub.subscribe(other) == nil {
+				subscribers = append(subscribers, other)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	pub.addLayer(track)
+	for _, sub := range subscribers {
+		sub.negotiate()
+	}
+	return pub
+}
+
+// unpublish stops forwarding a track whose layers have all ended
+func (r *room) unpublish(pub *publication) {
+	r.mu.Lock()
+	if r.publications[pub.key] != pub {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.publications, pub.key)
+	subscribers := pub.close()
+	r.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.negotiate()
+	}
+}
@@ -0,0 +1,156 @@
+// Package sfu is a selective forwarding unit for group calls. Every
+// participant of a room publishes its media once, on a publisher peer
+// connection it offers to the server, and receives everyone else's on a
+// subscriber peer connection the server offers to it. Video published in
+// several simulcast layers reaches each subscriber in the layer it picked.
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrInRoom           = errors.New("sfu: already in the room")
+	ErrUnknownPeer      = errors.New("sfu: not in the room")
+	ErrUnknownTarget    = errors.New("sfu: unknown peer connection")
+	ErrNoOffer          = errors.New("sfu: no offer awaits an answer")
+	ErrUnknownPublisher = errors.New("sfu: publisher is not in the room")
+)
+
+// Config configures the peer connections the SFU opens
+type Config struct {
+	PublicIP        string // announced instead of the host's address, when behind a 1:1 NAT
+	PortMin         uint16 // UDP ports media is exchanged on; zero lets the OS pick
+	PortMax         uint16
+	IncludeLoopback bool // also gather 127.0.0.1 candidates, for clients on the same host
+	ICEServers      []webrtc.ICEServer
+}
+
+// Target names one of a participant's two peer connections
+type Target string
+
+const (
+	TargetPublisher  Target = "publisher"  // carries the participant's own media to the server
+	TargetSubscriber Target = "subscriber" // carries everyone else's media to the participant
+)
+
+// Kinds of Signal
+const (
+	SignalOffer     = "offer"
+	SignalAnswer    = "answer"
+	SignalCandidate = "candidate"
+)
+
+// Signal is an SDP or ICE candidate the SFU sends a participant
+type Signal struct {
+	Type      string
+	Target    Target
+	SDP       string                  // offer or answer
+	Candidate webrtc.ICECandidateInit // candidate
+}
+
+// SFU holds the rooms that have participants
+type SFU struct {
+	api    *webrtc.API
+	config webrtc.Configuration
+
+	mu    sync.Mutex
+	rooms map[string]*room // keyed by room ID
+}
+
+// New sets up the media engine shared by all peer connections: the default
+// codecs, NACK, RTCP reports, TWCC and the simulcast header extensions
+func New(cfg Config) (*SFU, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("sfu: %w", err)
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, fmt.Errorf("sfu: %w", err)
+	}
+
+	se := webrtc.SettingEngine{}
+	if cfg.PortMin != 0 || cfg.PortMax != 0 {
+		if err := se.SetEphemeralUDPPortRange(cfg.PortMin, cfg.PortMax); err != nil {
+			return nil, fmt.Errorf("sfu: %w", err)
+		}
+	}
+	if cfg.PublicIP != "" {
+		se.SetNAT1To1IPs([]string{cfg.PublicIP}, webrtc.ICECandidateTypeHost)
+	}
+	se.SetIncludeLoopbackCandidate(cfg.IncludeLoopback)
+
+	return &SFU{
+		api:    webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se)),
+		config: webrtc.Configuration{ICEServers: cfg.ICEServers},
+		rooms:  make(map[string]*room),
+	}, nil
+}
+
+// Join adds peerID to a room, opening it if needed. Signals for the
+// participant go to signal, which must not block.
+func (s *SFU) Join(roomID, peerID string, signal func(Signal)) (*Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		r = newRoom(roomID)
+	}
+	if _, ok := r.peer(peerID); ok {
+		return nil, ErrInRoom
+	}
+
+	p, err := newPeer(s, r, peerID, signal)
+	if err != nil {
+		return nil, err
+	}
+	s.rooms[roomID] = r
+	r.join(p)
+	return p, nil
+}
+
+// Peer returns a participant of a room
+func (s *SFU) Peer(roomID, peerID string) (*Peer, error) {
+	s.mu.Lock()
+	r, ok := s.rooms[roomID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+
+	p, ok := r.peer(peerID)
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	return p, nil
+}
+
+// Leave stops forwarding a participant's media and closes its peer
+// connections. The last one out closes the room. It does not wait for the
+// connections to finish closing, so the hub can call it.
+func (s *SFU) Leave(roomID, peerID string) {
+	s.mu.Lock()
+	r, ok := s.rooms[roomID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	p, ok := r.peer(peerID)
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	if r.leave(p) == 0 {
+		delete(s.rooms, roomID)
+	}
+	s.mu.Unlock()
+
+	p.close()
+}
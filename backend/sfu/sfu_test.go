@@ -0,0 +1,326 @@
+package sfu_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"athena-backend/sfu"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Header extensions a simulcast publisher tags its packets with, so the
+// receiving side can tell the layers apart
+const (
+	midExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	ridExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+)
+
+// testClient is a headless participant: a publisher and a subscriber peer
+// connection signalled straight through the SFU's API
+type testClient struct {
+	t          *testing.T
+	peer       *sfu.Peer
+	publisher  *webrtc.PeerConnection
+	subscriber *webrtc.PeerConnection
+	signals    chan sfu.Signal
+	handled    chan struct{}    // closed once signals is closed and drained
+	answered   chan struct{}    // closed once the publisher's offer is answered
+	received   chan receivedRTP // packets forwarded to the subscriber
+}
+
+type receivedRTP struct {
+	streamID string
+	layer    byte // third payload byte, which the test publisher sets to the RID
+	seq      uint16
+	ts       uint32
+}
+
+func newClientAPI(t *testing.T) *webrtc.API {
+	t.Helper()
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		t.Fatal(err)
+	}
+	se := webrtc.SettingEngine{}
+	se.SetIncludeLoopbackCandidate(true)
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se))
+}
+
+// join adds a headless participant to a room of s
+func join(t *testing.T, s *sfu.SFU, roomID, peerID string) *testClient {
+	t.Helper()
+	api := newClientAPI(t)
+	c := &testClient{
+		t:        t,
+		signals:  make(chan sfu.Signal, 100),
+		handled:  make(chan struct{}),
+		answered: make(chan struct{}),
+		received: make(chan receivedRTP, 1000),
+	}
+
+	var err error
+	if c.publisher, err = api.NewPeerConnection(webrtc.Configuration{}); err != nil {
+		t.Fatal(err)
+	}
+	if c.subscriber, err = api.NewPeerConnection(webrtc.Configuration{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.publisher.Close()
+		c.subscriber.Close()
+	})
+
+	// Signals may come before Join returns, so they wait in a queue
+	if c.peer, err = s.Join(roomID, peerID, func(sig sfu.Signal) { c.signals <- sig }); err != nil {
+		t.Fatal(err)
+	}
+	// Once Leave returns the peer sends no more signals
+	t.Cleanup(func() {
+		s.Leave(roomID, peerID)
+		close(c.signals)
+		<-c.handled
+	})
+
+	for target, pc := range map[sfu.Target]*webrtc.PeerConnection{
+		sfu.TargetPublisher:  c.publisher,
+		sfu.TargetSubscriber: c.subscriber,
+	} {
+		pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+			if candidate == nil {
+				return
+			}
+			// Gathering may outlast the peer at the end of the test
+			if err := c.peer.AddCandidate(target, candidate.ToJSON()); err != nil && !errors.Is(err, sfu.ErrUnknownPeer) {
+				t.Errorf("adding %s candidate: %v", target, err)
+			}
+		})
+	}
+	c.subscriber.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if len(pkt.Payload) > 2 {
+				c.received <- receivedRTP{track.StreamID(), pkt.Payload[2], pkt.SequenceNumber, pkt.Timestamp}
+			}
+		}
+	})
+
+	go c.handleSignals()
+	return c
+}
+
+// handleSignals applies what the SFU sends, in order
+func (c *testClient) handleSignals() {
+	defer close(c.handled)
+	for sig := range c.signals {
+		pc := c.publisher
+		if sig.Target == sfu.TargetSubscriber {
+			pc = c.subscriber
+		}
+
+		switch sig.Type {
+		case sfu.SignalAnswer:
+			if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sig.SDP}); err != nil {
+				c.t.Errorf("applying answer: %v", err)
+				continue
+			}
+			close(c.answered)
+		case sfu.SignalOffer:
+			if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sig.SDP}); err != nil {
+				c.t.Errorf("applying offer: %v", err)
+				continue
+			}
+			answer, err := pc.CreateAnswer(nil)
+			if err == nil {
+				err = pc.SetLocalDescription(answer)
+			}
+			if err == nil {
+				err = c.peer.Answer(answer.SDP)
+			}
+			if err != nil {
+				c.t.Errorf("answering: %v", err)
+			}
+		case sfu.SignalCandidate:
+			if err := pc.AddICECandidate(sig.Candidate); err != nil {
+				c.t.Errorf("adding candidate: %v", err)
+			}
+		}
+	}
+}
+
+// publishSimulcast sends a VP8 video track in the three layers until the
+// test ends. Every layer numbers its packets and stamps its times from its
+// own base and sends a keyframe every 15 frames. pion leaves tagging the
+// packets with their MID and RID to the application.
+func (c *testClient) publishSimulcast() {
+	c.t.Helper()
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	rids := []string{sfu.LayerLow, sfu.LayerMedium, sfu.LayerHigh}
+	tracks := make([]*webrtc.TrackLocalStaticRTP, len(rids))
+	for i, rid := range rids {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "camera", webrtc.WithRTPStreamID(rid))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		tracks[i] = track
+	}
+	sender, err := c.publisher.AddTrack(tracks[0])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for _, track := range tracks[1:] {
+		if err := sender.AddEncoding(track); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	go func() {
+		for {
+			if _, _, err := sender.ReadRTCP(); err != nil {
+				return
+			}
+		}
+	}()
+
+	offer, err := c.publisher.CreateOffer(nil)
+	if err == nil {
+		err = c.publisher.SetLocalDescription(offer)
+	}
+	if err == nil {
+		err = c.peer.Offer(offer.SDP)
+	}
+	if err != nil {
+		c.t.Fatalf("offering: %v", err)
+	}
+	select {
+	case <-c.answered:
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("publisher offer not answered")
+	}
+
+	var midID, ridID uint8
+	for _, ext := range sender.GetParameters().HeaderExtensions {
+		switch ext.URI {
+		case midExtensionURI:
+			midID = uint8(ext.ID)
+		case ridExtensionURI:
+			ridID = uint8(ext.ID)
+		}
+	}
+	if midID == 0 || ridID == 0 {
+		c.t.Fatal("simulcast header extensions not negotiated")
+	}
+	var mid string
+	for _, tr := range c.publisher.GetTransceivers() {
+		if tr.Sender() == sender {
+			mid = tr.Mid()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			vp8 := byte(0x01) // inverse key frame flag
+			if frame%15 == 0 {
+				vp8 = 0x00
+			}
+			for i, track := range tracks {
+				pkt := &rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						Marker:         true,
+						SequenceNumber: uint16(10000*(i+1) + frame),
+						Timestamp:      uint32(1000000*(i+1) + 3000*frame),
+					},
+					// Payload descriptor with the start bit, then the frame header
+					Payload: []byte{0x10, vp8, rids[i][0], 0, 0, 0},
+				}
+				if pkt.Header.SetExtension(midID, []byte(mid)) != nil || pkt.Header.SetExtension(ridID, []byte(track.RID())) != nil {
+					return
+				}
+				if err := track.WriteRTP(pkt); err != nil {
+					return
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// next returns the next packet forwarded to the subscriber
+func (c *testClient) next() receivedRTP {
+	c.t.Helper()
+	select {
+	case pkt := <-c.received:
+		return pkt
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no packet forwarded")
+		return receivedRTP{}
+	}
+}
+
+func TestForwardSimulcast(t *testing.T) {
+	s, err := sfu.New(sfu.Config{IncludeLoopback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := join(t, s, "room", "alice")
+	bob := join(t, s, "room", "bob")
+	alice.publishSimulcast()
+
+	// Bob gets the default layer, on a stream named after alice
+	last := bob.next()
+	if last.streamID != "alice" {
+		t.Fatalf("got stream %q, want alice", last.streamID)
+	}
+	if last.layer != sfu.DefaultLayer[0] {
+		t.Fatalf("got layer %q, want %q", last.layer, sfu.DefaultLayer)
+	}
+	for range 20 {
+		pkt := bob.next()
+		if pkt.layer != last.layer || pkt.seq != last.seq+1 || pkt.ts != last.ts+3000 {
+			t.Fatalf("got %+v after %+v, want the next packet of the layer", pkt, last)
+		}
+		last = pkt
+	}
+
+	// After a switch, the packets of the new layer carry on the numbering
+	// and timing of the old one, a frame later
+	if err := bob.peer.SelectLayer("alice", sfu.LayerHigh); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		pkt := bob.next()
+		if pkt.seq != last.seq+1 || pkt.ts != last.ts+3000 {
+			t.Fatalf("got %+v after %+v, want no gap across the switch", pkt, last)
+		}
+		last = pkt
+		if pkt.layer == sfu.LayerHigh[0] {
+			break
+		}
+		if pkt.layer != sfu.DefaultLayer[0] {
+			t.Fatalf("got layer %q while switching", pkt.layer)
+		}
+	}
+	for range 20 {
+		pkt := bob.next()
+		if pkt.layer != sfu.LayerHigh[0] || pkt.seq != last.seq+1 || pkt.ts != last.ts+3000 {
+			t.Fatalf("got %+v after %+v, want the next packet of the high layer", pkt, last)
+		}
+		last = pkt
+	}
+
+	if err := bob.peer.SelectLayer("carol", sfu.LayerLow); !errors.Is(err, sfu.ErrUnknownPublisher) {
+		t.Errorf("selecting a layer of someone not in the room: got %v, want %v", err, sfu.ErrUnknownPublisher)
+	}
+}
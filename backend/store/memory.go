@@ -0,0 +1,534 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ ProfileStore = (*Memory)(nil)
+	_ FriendStore  = (*Memory)(nil)
+	_ MessageStore = (*Memory)(nil)
+	_ CallStore    = (*Memory)(nil)
+
+	_ ConversationStore = (*Memory)(nil)
+	_ ReceiptStore      = (*Memory)(nil)
+)
+
+// Memory implements the stores in process. It is meant for tests and local development.
+type Memory struct {
+	mu             sync.RWMutex
+	profiles       map[string]*Profile       // keyed by user ID
+	friendRequests map[string]*FriendRequest // keyed by request ID
+	friendships    map[[2]string]time.Time   // keyed by sorted user pair
+	messages       []Message
+	calls          []CallRecord
+	conversations  map[string]*Conversation // keyed by ID, members included
+	receipts       map[[2]string]*Receipt   // keyed by conversation and user ID
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		profiles:       make(map[string]*Profile),
+		friendRequests: make(map[string]*FriendRequest),
+		friendships:    make(map[[2]string]time.Time),
+		conversations:  make(map[string]*Conversation),
+		receipts:       make(map[[2]string]*Receipt),
+	}
+}
+
+func (m *Memory) GetProfile(ctx context.Context, userID string) (*Profile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	profile, ok := m.profiles[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	p := *profile
+	return &p, nil
+}
+
+func (m *Memory) GetProfileByUID(ctx context.Context, uid string) (*Profile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, profile := range m.profiles {
+		if profile.UID == uid {
+			p := *profile
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CreateProfile assigns a random numeric UID, mirroring create_user_profile
+func (m *Memory) CreateProfile(ctx context.Context, userID, name string) (*Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[userID]; ok {
+		return nil, &APIError{StatusCode: 409, Body: "profile already exists"}
+	}
+
+	profile := &Profile{
+		ID:        userID,
+		UID:       m.newUIDLocked(),
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	m.profiles[userID] = profile
+
+	p := *profile
+	return &p, nil
+}
+
+func (m *Memory) newUIDLocked() string {
+	for {
+		uid := fmt.Sprintf("%08d", rand.Intn(100000000))
+		taken := false
+		for _, profile := range m.profiles {
+			if profile.UID == uid {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return uid
+		}
+	}
+}
+
+func (m *Memory) FindFriendRequest(ctx context.Context, userA, userB string) (*FriendRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, req := range m.friendRequests {
+		if (req.FromUserID == userA && req.ToUserID == userB) || (req.FromUserID == userB && req.ToUserID == userA) {
+			r := *req
+			return &r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) CreateFriendRequest(ctx context.Context, fromUserID, toUserID string) (*FriendRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	req := &FriendRequest{
+		ID:         uuid.NewString(),
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Status:     StatusPending,
+		CreatedAt:  time.Now(),
+	}
+	m.friendRequests[req.ID] = req
+
+	r := *req
+	return &r, nil
+}
+
+func (m *Memory) ListFriendRequests(ctx context.Context, q FriendRequestQuery) ([]FriendRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var requests []FriendRequest
+	for _, req := range m.friendRequests {
+		var otherID string
+		switch {
+		case q.Direction == DirectionSent && req.FromUserID == q.UserID:
+			otherID = req.ToUserID
+		case q.Direction != DirectionSent && req.ToUserID == q.UserID:
+			otherID = req.FromUserID
+		default:
+			continue
+		}
+		if q.Status != "" && req.Status != q.Status {
+			continue
+		}
+
+		r := *req
+		if profile, ok := m.profiles[otherID]; ok {
+			r.UserName = profile.Name
+		}
+		requests = append(requests, r)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.After(requests[j].CreatedAt)
+	})
+	return paginate(requests, q.Offset, q.Limit), nil
+}
+
+func (m *Memory) RespondToFriendRequest(ctx context.Context, requestID, toUserID, status string) (*FriendRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	req, ok := m.friendRequests[requestID]
+	if !ok || req.ToUserID != toUserID || req.Status != StatusPending {
+		return nil, ErrNotFound
+	}
+	req.Status = status
+
+	r := *req
+	return &r, nil
+}
+
+func (m *Memory) CreateFriendship(ctx context.Context, userA, userB string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userID1, userID2 := SortedPair(userA, userB)
+	key := [2]string{userID1, userID2}
+	if _, ok := m.friendships[key]; ok {
+		return &APIError{StatusCode: 409, Body: "friendship already exists"}
+	}
+	m.friendships[key] = time.Now()
+	return nil
+}
+
+func (m *Memory) AreFriends(ctx context.Context, userA, userB string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	userID1, userID2 := SortedPair(userA, userB)
+	_, ok := m.friendships[[2]string{userID1, userID2}]
+	return ok, nil
+}
+
+func (m *Memory) ListFriends(ctx context.Context, userID string) ([]Friend, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var friends []Friend
+	for pair, createdAt := range m.friendships {
+		var friendID string
+		switch userID {
+		case pair[0]:
+			friendID = pair[1]
+		case pair[1]:
+			friendID = pair[0]
+		default:
+			continue
+		}
+
+		friend := Friend{
+			FriendshipID: pair[0] + ":" + pair[1],
+			FriendID:     friendID,
+			CreatedAt:    createdAt,
+		}
+		if profile, ok := m.profiles[friendID]; ok {
+			friend.Name = profile.Name
+			friend.UID = profile.UID
+		}
+		friends = append(friends, friend)
+	}
+
+	sort.Slice(friends, func(i, j int) bool {
+		return friends[i].CreatedAt.After(friends[j].CreatedAt)
+	})
+	return friends, nil
+}
+
+func (m *Memory) InsertMessage(ctx context.Context, msg *Message) error {
+	return m.InsertMessages(ctx, []*Message{msg})
+}
+
+func (m *Memory) InsertMessages(ctx context.Context, msgs []*Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, msg := range msgs {
+		for _, existing := range m.messages {
+			if msg.ID != "" && existing.ID == msg.ID {
+				return &APIError{StatusCode: 409, Body: "message already exists"}
+			}
+		}
+	}
+	now := time.Now()
+	for _, msg := range msgs {
+		if msg.ID == "" {
+			msg.ID = uuid.NewString()
+		}
+		// created_at defaults to now() in the database
+		if msg.CreatedAt.IsZero() {
+			msg.CreatedAt = now
+		}
+		m.messages = append(m.messages, *msg)
+	}
+	return nil
+}
+
+func (m *Memory) GetMessage(ctx context.Context, id string) (*Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, msg := range m.messages {
+		if msg.ID == id {
+			found := msg
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) ListMessages(ctx context.Context, q MessageQuery) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var messages []Message
+	for _, msg := range m.messages {
+		if q.ConversationID != "" && msg.ConversationID != q.ConversationID {
+			continue
+		}
+		if q.ConversationID == "" && (msg.UserID1 != q.UserID1 || msg.UserID2 != q.UserID2) {
+			continue
+		}
+		if q.Since != nil && !msg.CreatedAt.After(*q.Since) {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+	if q.Since != nil {
+		return paginate(messages, 0, q.Limit), nil
+	}
+	return paginate(messages, q.Offset, q.Limit), nil
+}
+
+func (m *Memory) InsertCall(ctx context.Context, call *CallRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	call.ID = uuid.NewString()
+	m.calls = append(m.calls, *call)
+	return nil
+}
+
+func (m *Memory) ListCalls(ctx context.Context, q CallQuery) ([]CallRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var records []CallRecord
+	for _, call := range m.calls {
+		if call.CallerID != q.UserID && call.CalleeID != q.UserID {
+			continue
+		}
+		if q.FriendID != "" && call.CallerID != q.FriendID && call.CalleeID != q.FriendID {
+			continue
+		}
+		records = append(records, call)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+	return paginate(records, q.Offset, q.Limit), nil
+}
+
+func (m *Memory) ListUnnotifiedMissedCalls(ctx context.Context, userID string) ([]CallRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var records []CallRecord
+	for _, call := range m.calls {
+		if call.CalleeID == userID && call.Missed && !call.Notified {
+			records = append(records, call)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.Before(records[j].StartedAt)
+	})
+	return records, nil
+}
+
+func (m *Memory) MarkCallsNotified(ctx context.Context, calleeID string, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.calls {
+		for _, id := range ids {
+			if m.calls[i].ID == id && m.calls[i].CalleeID == calleeID {
+				m.calls[i].Notified = true
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateConversation(ctx context.Context, conv *Conversation, members []Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	conv.ID = uuid.NewString()
+	conv.CreatedAt = now
+	for i := range members {
+		members[i].ConversationID = conv.ID
+		members[i].JoinedAt = now
+	}
+	conv.Members = members
+
+	m.conversations[conv.ID] = copyConversation(conv)
+	return nil
+}
+
+func (m *Memory) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conv, ok := m.conversations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyConversation(conv), nil
+}
+
+func (m *Memory) ListConversations(ctx context.Context, userID string) ([]Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	convs := []Conversation{}
+	for _, conv := range m.conversations {
+		if _, ok := conv.FindMember(userID); ok {
+			convs = append(convs, *copyConversation(conv))
+		}
+	}
+
+	sort.Slice(convs, func(i, j int) bool {
+		return convs[i].CreatedAt.After(convs[j].CreatedAt)
+	})
+	return convs, nil
+}
+
+func (m *Memory) AddMembers(ctx context.Context, members []Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, member := range members {
+		conv, ok := m.conversations[member.ConversationID]
+		if !ok {
+			return &APIError{StatusCode: 409, Body: "conversation does not exist"}
+		}
+		if _, ok := conv.FindMember(member.UserID); ok {
+			return &APIError{StatusCode: 409, Body: "member already exists"}
+		}
+	}
+
+	now := time.Now()
+	for i := range members {
+		members[i].JoinedAt = now
+		conv := m.conversations[members[i].ConversationID]
+		conv.Members = append(conv.Members, members[i])
+	}
+	return nil
+}
+
+func (m *Memory) UpdateMemberRole(ctx context.Context, conversationID, userID, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv, ok := m.conversations[conversationID]
+	if !ok {
+		return ErrNotFound
+	}
+	member, ok := conv.FindMember(userID)
+	if !ok {
+		return ErrNotFound
+	}
+	member.Role = role
+	return nil
+}
+
+func (m *Memory) RemoveMember(ctx context.Context, conversationID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv, ok := m.conversations[conversationID]
+	if !ok {
+		return nil
+	}
+	for i, member := range conv.Members {
+		if member.UserID == userID {
+			conv.Members = append(conv.Members[:i:i], conv.Members[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Memory) DeleteConversation(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.conversations, id)
+	return nil
+}
+
+// AdvanceReceipt only ever moves a watermark forward: a message created at or
+// before the current one leaves the receipt as it is
+func (m *Memory) AdvanceReceipt(ctx context.Context, conversationID, userID, watermark, messageID string, createdAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{conversationID, userID}
+	receipt, ok := m.receipts[key]
+	if !ok {
+		receipt = &Receipt{ConversationID: conversationID, UserID: userID}
+		m.receipts[key] = receipt
+	}
+
+	id, at := &receipt.LastDeliveredID, &receipt.LastDeliveredAt
+	if watermark == ReceiptRead {
+		id, at = &receipt.LastReadID, &receipt.LastReadAt
+	}
+	if *at != nil && !(*at).Before(createdAt) {
+		return false, nil
+	}
+	*id, *at = messageID, &createdAt
+	return true, nil
+}
+
+func (m *Memory) ListReceipts(ctx context.Context, conversationID string) ([]Receipt, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var receipts []Receipt
+	for _, receipt := range m.receipts {
+		if receipt.ConversationID == conversationID {
+			receipts = append(receipts, *receipt)
+		}
+	}
+	return receipts, nil
+}
+
+// copyConversation copies conv along with its member list
+func copyConversation(conv *Conversation) *Conversation {
+	c := *conv
+	c.Members = append([]Member(nil), conv.Members...)
+	return &c
+}
+
+// paginate applies offset and limit the way PostgREST does. A limit of zero means no limit.
+func paginate[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
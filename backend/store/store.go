@@ -0,0 +1,318 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when a lookup matches no rows
+var ErrNotFound = errors.New("store: not found")
+
+// Friend request statuses
+const (
+	StatusPending  = "pending"
+	StatusAccepted = "accepted"
+	StatusRejected = "rejected"
+)
+
+// Friend request directions, relative to the user listing them
+const (
+	DirectionReceived = "received"
+	DirectionSent     = "sent"
+)
+
+// Profile is a row of the user_profiles table
+type Profile struct {
+	ID        string    `json:"id"`
+	UID       string    `json:"uid"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// FriendRequest is a row of the friend_requests table
+type FriendRequest struct {
+	ID         string    `json:"id"`
+	FromUserID string    `json:"from_user_id"`
+	ToUserID   string    `json:"to_user_id"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// UserName is the other party's name. Only filled in by ListFriendRequests.
+	UserName string `json:"-"`
+}
+
+// Friend is an accepted friendship seen from one of its two members
+type Friend struct {
+	FriendshipID string    `json:"id"`
+	FriendID     string    `json:"fid"`
+	Name         string    `json:"name"`
+	UID          string    `json:"uid"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Message kinds. Text messages leave Kind empty.
+const (
+	MessageKindVoicemail = "voicemail"
+)
+
+// Message is a row of the messages table. Direct messages carry the pair of
+// users, UserID1 always being the smaller of the two IDs; group messages
+// leave the pair empty. Both kinds set ConversationID, except for direct
+// messages stored before conversations existed.
+type Message struct {
+	ID             string    `json:"id,omitempty"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	UserID1        string    `json:"user_id_1,omitempty"`
+	UserID2        string    `json:"user_id_2,omitempty"`
+	SenderID       string    `json:"sender_id"`
+	Content        string    `json:"content"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	Kind      string     `json:"kind,omitempty"`
+	Voicemail *Voicemail `json:"voicemail,omitempty"` // set for MessageKindVoicemail
+}
+
+// Voicemail is the playback metadata of a voicemail message. The recording
+// itself lives in the blob store.
+type Voicemail struct {
+	CallID      string `json:"call_id"` // the call nobody answered
+	URL         string `json:"url"`     // API path serving the recording
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`     // bytes
+	Duration    int    `json:"duration"` // seconds, as reported by the caller
+}
+
+// Conversation kinds
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+// Member roles. A group has exactly one owner; admins may add and remove members.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Conversation is a row of the conversations table. Only groups are stored:
+// every pair of friends implicitly has a direct conversation whose ID is
+// DirectConversationID.
+type Conversation struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Members is filled in by GetConversation and ListConversations
+	Members []Member `json:"members,omitempty"`
+}
+
+// Member is a row of the conversation_members table
+type Member struct {
+	ConversationID string    `json:"conversation_id"`
+	UserID         string    `json:"user_id"`
+	Role           string    `json:"role"`
+	JoinedAt       time.Time `json:"joined_at"`
+}
+
+// FindMember returns the member with the given user ID, if any
+func (c *Conversation) FindMember(userID string) (*Member, bool) {
+	for i := range c.Members {
+		if c.Members[i].UserID == userID {
+			return &c.Members[i], true
+		}
+	}
+	return nil, false
+}
+
+// directNamespace scopes the name-based UUIDs of direct conversations
+var directNamespace = uuid.MustParse("6f1c3a52-8d0e-4b7a-9f25-3c4d8e9a0b17")
+
+// DirectConversationID returns the ID of the direct conversation between two
+// users. It is derived from the pair, so it needs no lookup and is the same
+// for messages stored before conversations existed.
+func DirectConversationID(userA, userB string) string {
+	userID1, userID2 := SortedPair(userA, userB)
+	return uuid.NewSHA1(directNamespace, []byte(userID1+":"+userID2)).String()
+}
+
+// Receipt watermarks
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Receipt is a row of the conversation_receipts table: how far one user has
+// received and read a conversation. Each watermark is the last message
+// acknowledged and its created_at; every earlier message counts as well.
+type Receipt struct {
+	ConversationID  string     `json:"conversation_id"`
+	UserID          string     `json:"user_id"`
+	LastDeliveredID string     `json:"last_delivered_id,omitempty"`
+	LastDeliveredAt *time.Time `json:"last_delivered_at,omitempty"`
+	LastReadID      string     `json:"last_read_id,omitempty"`
+	LastReadAt      *time.Time `json:"last_read_at,omitempty"`
+}
+
+// CallRecord is a row of the calls table, written once a call is over
+type CallRecord struct {
+	ID         string     `json:"id,omitempty"`
+	CallerID   string     `json:"caller_id"`
+	CalleeID   string     `json:"callee_id"`
+	CallType   string     `json:"call_type"` // "audio" or "video"
+	StartedAt  time.Time  `json:"started_at"`
+	AnsweredAt *time.Time `json:"answered_at"` // nil if never answered
+	EndedAt    time.Time  `json:"ended_at"`
+	Duration   int        `json:"duration"` // seconds from answer to end
+	EndReason  string     `json:"end_reason"`
+	// Missed is set for calls the callee never picked up nor declined.
+	// Notified records whether the callee has been told about it.
+	Missed   bool `json:"missed"`
+	Notified bool `json:"notified"`
+}
+
+// FriendRequestQuery filters ListFriendRequests
+type FriendRequestQuery struct {
+	UserID    string
+	Direction string // DirectionReceived or DirectionSent
+	Status    string // empty means all statuses
+	Offset    int
+	Limit     int // zero means no limit
+}
+
+// MessageQuery filters ListMessages. Group history is selected by
+// ConversationID, direct history by the pair of users. When Since is set,
+// Offset is ignored.
+type MessageQuery struct {
+	ConversationID string
+	UserID1        string
+	UserID2        string
+	Since          *time.Time
+	Limit          int // zero means no limit
+	Offset         int
+}
+
+// CallQuery filters ListCalls. FriendID limits the result to calls with that user.
+type CallQuery struct {
+	UserID   string
+	FriendID string
+	Limit    int // zero means no limit
+	Offset   int
+}
+
+// ProfileStore reads and creates user profiles
+type ProfileStore interface {
+	GetProfile(ctx context.Context, userID string) (*Profile, error)
+	GetProfileByUID(ctx context.Context, uid string) (*Profile, error)
+	CreateProfile(ctx context.Context, userID, name string) (*Profile, error)
+}
+
+// FriendStore manages friend requests and friendships
+type FriendStore interface {
+	// FindFriendRequest returns the request between two users in either direction
+	FindFriendRequest(ctx context.Context, userA, userB string) (*FriendRequest, error)
+	CreateFriendRequest(ctx context.Context, fromUserID, toUserID string) (*FriendRequest, error)
+	ListFriendRequests(ctx context.Context, q FriendRequestQuery) ([]FriendRequest, error)
+	// RespondToFriendRequest updates a pending request addressed to toUserID.
+	// It returns ErrNotFound if no such pending request exists.
+	RespondToFriendRequest(ctx context.Context, requestID, toUserID, status string) (*FriendRequest, error)
+	CreateFriendship(ctx context.Context, userA, userB string) error
+	// AreFriends reports whether two users have an accepted friendship
+	AreFriends(ctx context.Context, userA, userB string) (bool, error)
+	ListFriends(ctx context.Context, userID string) ([]Friend, error)
+}
+
+// MessageStore persists and reads chat messages
+type MessageStore interface {
+	// InsertMessage stores msg and fills in its server ID, unless one is set,
+	// and created_at. Inserting an ID that already exists fails with a 409.
+	InsertMessage(ctx context.Context, msg *Message) error
+	// InsertMessages stores msgs in one request, filling in each one like InsertMessage
+	InsertMessages(ctx context.Context, msgs []*Message) error
+	// GetMessage returns a message by ID, or ErrNotFound
+	GetMessage(ctx context.Context, id string) (*Message, error)
+	ListMessages(ctx context.Context, q MessageQuery) ([]Message, error)
+}
+
+// ReceiptStore keeps the delivered and read watermarks of conversations
+type ReceiptStore interface {
+	// AdvanceReceipt moves a user's watermark (ReceiptDelivered or
+	// ReceiptRead) in a conversation to the given message, unless it is
+	// already there or later. It reports whether the watermark moved.
+	AdvanceReceipt(ctx context.Context, conversationID, userID, watermark, messageID string, createdAt time.Time) (bool, error)
+	// ListReceipts returns the watermarks of everyone who acknowledged messages of a conversation
+	ListReceipts(ctx context.Context, conversationID string) ([]Receipt, error)
+}
+
+// CallStore persists call records
+type CallStore interface {
+	// InsertCall stores call and fills in its ID
+	InsertCall(ctx context.Context, call *CallRecord) error
+	// ListCalls returns calls the user took part in, newest first
+	ListCalls(ctx context.Context, q CallQuery) ([]CallRecord, error)
+	// ListUnnotifiedMissedCalls returns missed calls to userID it has not been told about, oldest first
+	ListUnnotifiedMissedCalls(ctx context.Context, userID string) ([]CallRecord, error)
+	// MarkCallsNotified records that the callee has been told about the given missed calls
+	MarkCallsNotified(ctx context.Context, calleeID string, ids []string) error
+}
+
+// ConversationStore manages group conversations and their members
+type ConversationStore interface {
+	// CreateConversation stores a group with its first members, filling in
+	// the conversation's ID and created_at and the members' joined_at
+	CreateConversation(ctx context.Context, conv *Conversation, members []Member) error
+	// GetConversation returns a group with its members, or ErrNotFound
+	GetConversation(ctx context.Context, id string) (*Conversation, error)
+	// ListConversations returns the groups userID is a member of, with their members
+	ListConversations(ctx context.Context, userID string) ([]Conversation, error)
+	// AddMembers adds members to a group, filling in their joined_at
+	AddMembers(ctx context.Context, members []Member) error
+	// UpdateMemberRole changes a member's role. It returns ErrNotFound if the user is not a member.
+	UpdateMemberRole(ctx context.Context, conversationID, userID, role string) error
+	RemoveMember(ctx context.Context, conversationID, userID string) error
+	// DeleteConversation removes a group and its members. Messages are kept.
+	DeleteConversation(ctx context.Context, id string) error
+}
+
+// APIError is returned when the backing service rejects a request
+type APIError struct {
+	StatusCode int
+	Body       string
+	Err        error // underlying error from the backend client, if any
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("store: status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// SortedPair orders two user IDs so the smaller one comes first
+func SortedPair(a, b string) (string, string) {
+	if a < b {
+		return a, b
+	}
+	return b, a
+}
+
+type tokenKey struct{}
+
+// WithToken attaches a user's access token to ctx so row level security
+// is evaluated as that user
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFromContext returns the access token set by WithToken
+func TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	return token, ok && token != ""
+}
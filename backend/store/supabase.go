@@ -0,0 +1,659 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"athena-backend/postgrest"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ ProfileStore = (*Supabase)(nil)
+	_ FriendStore  = (*Supabase)(nil)
+	_ MessageStore = (*Supabase)(nil)
+	_ CallStore    = (*Supabase)(nil)
+
+	_ ConversationStore = (*Supabase)(nil)
+	_ ReceiptStore      = (*Supabase)(nil)
+)
+
+// Supabase implements the stores on top of the Supabase REST API (PostgREST)
+type Supabase struct {
+	db *postgrest.Client
+}
+
+// NewSupabase creates a store for the project at url using the given API key
+func NewSupabase(url, key string) *Supabase {
+	return &Supabase{db: postgrest.New(url, key)}
+}
+
+// client returns a PostgREST client authorized as the caller when the context
+// carries an access token, otherwise with the API key
+func (s *Supabase) client(ctx context.Context) *postgrest.Client {
+	if token, ok := TokenFromContext(ctx); ok {
+		return s.db.WithToken(token)
+	}
+	return s.db
+}
+
+// limit caps the rows a query returns. A limit of zero means no limit, as in
+// Memory, so it is left out rather than sent as limit=0.
+func limit(query *postgrest.Query, n int) {
+	if n > 0 {
+		query.Limit(n)
+	}
+}
+
+// wrapError converts PostgREST errors into APIError so handlers can map status codes
+func wrapError(err error) error {
+	var pgErr *postgrest.Error
+	if errors.As(err, &pgErr) {
+		return &APIError{StatusCode: pgErr.StatusCode, Body: pgErr.Message, Err: pgErr}
+	}
+	return err
+}
+
+func (s *Supabase) GetProfile(ctx context.Context, userID string) (*Profile, error) {
+	profiles, err := postgrest.Rows[Profile](ctx, s.client(ctx).From("user_profiles").
+		Eq("id", userID))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(profiles) == 0 {
+		return nil, ErrNotFound
+	}
+	return &profiles[0], nil
+}
+
+func (s *Supabase) GetProfileByUID(ctx context.Context, uid string) (*Profile, error) {
+	profiles, err := postgrest.Rows[Profile](ctx, s.client(ctx).From("user_profiles").
+		Select("id,name,uid").
+		Eq("uid", uid))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(profiles) == 0 {
+		return nil, ErrNotFound
+	}
+	return &profiles[0], nil
+}
+
+// CreateProfile calls the create_user_profile database function, which assigns the UID
+func (s *Supabase) CreateProfile(ctx context.Context, userID, name string) (*Profile, error) {
+	args := map[string]interface{}{
+		"p_user_id": userID,
+		"p_name":    name,
+	}
+
+	var profiles []Profile
+	if err := s.client(ctx).RPC(ctx, "create_user_profile", args, &profiles); err != nil {
+		return nil, wrapError(err)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("store: create_user_profile returned no rows")
+	}
+	return &profiles[0], nil
+}
+
+func (s *Supabase) FindFriendRequest(ctx context.Context, userA, userB string) (*FriendRequest, error) {
+	requests, err := postgrest.Rows[FriendRequest](ctx, s.client(ctx).From("friend_requests").
+		Select("*").
+		Where(postgrest.Or(
+			postgrest.And(postgrest.Eq("from_user_id", userA), postgrest.Eq("to_user_id", userB)),
+			postgrest.And(postgrest.Eq("from_user_id", userB), postgrest.Eq("to_user_id", userA)),
+		)))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(requests) == 0 {
+		return nil, ErrNotFound
+	}
+	return &requests[0], nil
+}
+
+func (s *Supabase) CreateFriendRequest(ctx context.Context, fromUserID, toUserID string) (*FriendRequest, error) {
+	row := map[string]interface{}{
+		"from_user_id": fromUserID,
+		"to_user_id":   toUserID,
+		"status":       StatusPending,
+	}
+
+	var created []FriendRequest
+	if err := s.client(ctx).From("friend_requests").Insert(ctx, row, &created); err != nil {
+		return nil, wrapError(err)
+	}
+	if len(created) == 0 {
+		return nil, fmt.Errorf("store: friend request insert returned no rows")
+	}
+	return &created[0], nil
+}
+
+// friendRequestRow is a friend_requests row with the other party's profile embedded
+type friendRequestRow struct {
+	FriendRequest
+	FromUser *Profile `json:"from_user"`
+	ToUser   *Profile `json:"to_user"`
+}
+
+func (s *Supabase) ListFriendRequests(ctx context.Context, q FriendRequestQuery) ([]FriendRequest, error) {
+	query := s.client(ctx).From("friend_requests")
+	if q.Direction == DirectionSent {
+		query.Select("id,from_user_id,to_user_id,status,created_at,to_user:user_profiles!friend_requests_to_user_id_fkey1(name)").
+			Eq("from_user_id", q.UserID)
+	} else {
+		query.Select("id,from_user_id,to_user_id,status,created_at,from_user:user_profiles!friend_requests_from_user_id_fkey1(name)").
+			Eq("to_user_id", q.UserID)
+	}
+	if q.Status != "" {
+		query.Eq("status", q.Status)
+	}
+	query.Order("created_at", false).Offset(q.Offset)
+	limit(query, q.Limit)
+
+	rows, err := postgrest.Rows[friendRequestRow](ctx, query)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	requests := make([]FriendRequest, 0, len(rows))
+	for _, row := range rows {
+		req := row.FriendRequest
+		if row.FromUser != nil {
+			req.UserName = row.FromUser.Name
+		} else if row.ToUser != nil {
+			req.UserName = row.ToUser.Name
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+// RespondToFriendRequest filters on recipient and pending status so the check and update happen in one query
+func (s *Supabase) RespondToFriendRequest(ctx context.Context, requestID, toUserID, status string) (*FriendRequest, error) {
+	values := map[string]interface{}{
+		"status": status,
+	}
+
+	var updated []FriendRequest
+	err := s.client(ctx).From("friend_requests").
+		Eq("id", requestID).
+		Eq("to_user_id", toUserID).
+		Eq("status", StatusPending).
+		Update(ctx, values, &updated)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(updated) == 0 {
+		return nil, ErrNotFound
+	}
+	return &updated[0], nil
+}
+
+func (s *Supabase) CreateFriendship(ctx context.Context, userA, userB string) error {
+	userID1, userID2 := SortedPair(userA, userB)
+	row := map[string]interface{}{
+		"user_id_1": userID1,
+		"user_id_2": userID2,
+	}
+	return wrapError(s.client(ctx).From("friendships").Insert(ctx, row, nil))
+}
+
+func (s *Supabase) AreFriends(ctx context.Context, userA, userB string) (bool, error) {
+	userID1, userID2 := SortedPair(userA, userB)
+	rows, err := postgrest.Rows[struct {
+		ID string `json:"id"`
+	}](ctx, s.client(ctx).From("friendships").
+		Select("id").
+		Eq("user_id_1", userID1).
+		Eq("user_id_2", userID2).
+		Limit(1))
+	if err != nil {
+		return false, wrapError(err)
+	}
+	return len(rows) > 0, nil
+}
+
+// friendshipRow is a friendships row with the friend's profile embedded
+type friendshipRow struct {
+	ID        string    `json:"id"`
+	FriendID  string    `json:"fid"`
+	CreatedAt time.Time `json:"created_at"`
+	Friend    *Profile  `json:"friend"`
+}
+
+// ListFriends queries both sides of the friendships table in parallel and merges the results
+func (s *Supabase) ListFriends(ctx context.Context, userID string) ([]Friend, error) {
+	client := s.client(ctx)
+
+	// Query 1: current user is user_id_1 (friend is user_id_2)
+	query1 := client.From("friendships").
+		Select("id,fid:user_id_2,created_at,friend:user_profiles!friendships_user_id_2_fkey1(name,uid)").
+		Eq("user_id_1", userID).
+		Order("created_at", false)
+
+	// Query 2: current user is user_id_2 (friend is user_id_1)
+	query2 := client.From("friendships").
+		Select("id,fid:user_id_1,created_at,friend:user_profiles!friendships_user_id_1_fkey1(name,uid)").
+		Eq("user_id_2", userID).
+		Order("created_at", false)
+
+	var rows1, rows2 []friendshipRow
+	var err1, err2 error
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		rows1, err1 = postgrest.Rows[friendshipRow](ctx, query1)
+	}()
+	go func() {
+		defer wg.Done()
+		rows2, err2 = postgrest.Rows[friendshipRow](ctx, query2)
+	}()
+	wg.Wait()
+
+	if err1 != nil {
+		return nil, wrapError(err1)
+	}
+	if err2 != nil {
+		return nil, wrapError(err2)
+	}
+
+	friends := make([]Friend, 0, len(rows1)+len(rows2))
+	for _, row := range append(rows1, rows2...) {
+		friend := Friend{
+			FriendshipID: row.ID,
+			FriendID:     row.FriendID,
+			CreatedAt:    row.CreatedAt,
+		}
+		if row.Friend != nil {
+			friend.Name = row.Friend.Name
+			friend.UID = row.Friend.UID
+		}
+		friends = append(friends, friend)
+	}
+	return friends, nil
+}
+
+func (s *Supabase) InsertMessage(ctx context.Context, msg *Message) error {
+	return s.InsertMessages(ctx, []*Message{msg})
+}
+
+func (s *Supabase) InsertMessages(ctx context.Context, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	rows := make([]map[string]interface{}, len(msgs))
+	for i, msg := range msgs {
+		// Every row needs the same keys for a bulk insert, so the columns a
+		// message does not use are sent as null
+		rows[i] = map[string]interface{}{
+			"conversation_id": nullable(msg.ConversationID),
+			"user_id_1":       nullable(msg.UserID1),
+			"user_id_2":       nullable(msg.UserID2),
+			"sender_id":       msg.SenderID,
+			"content":         msg.Content,
+			"created_at":      msg.CreatedAt.UTC().Format(time.RFC3339Nano),
+		}
+		// IDs assigned up front make replays idempotent
+		if msg.ID != "" {
+			rows[i]["id"] = msg.ID
+		}
+		if msg.Kind != "" {
+			rows[i]["kind"] = msg.Kind
+			rows[i]["voicemail"] = msg.Voicemail
+		}
+	}
+
+	// PostgREST returns the inserted rows in the order they were sent
+	var inserted []Message
+	if err := s.client(ctx).From("messages").Insert(ctx, rows, &inserted); err != nil {
+		return wrapError(err)
+	}
+	for i := range inserted {
+		if i < len(msgs) {
+			msgs[i].ID = inserted[i].ID
+			msgs[i].CreatedAt = inserted[i].CreatedAt
+		}
+	}
+	return nil
+}
+
+// nullable maps an empty string to a SQL null
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (s *Supabase) GetMessage(ctx context.Context, id string) (*Message, error) {
+	messages, err := postgrest.Rows[Message](ctx, s.client(ctx).From("messages").
+		Eq("id", id))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(messages) == 0 {
+		return nil, ErrNotFound
+	}
+	return &messages[0], nil
+}
+
+func (s *Supabase) ListMessages(ctx context.Context, q MessageQuery) ([]Message, error) {
+	query := s.client(ctx).From("messages")
+	if q.ConversationID != "" {
+		query.Eq("conversation_id", q.ConversationID)
+	} else {
+		// Direct history is read by pair, which also covers messages
+		// stored before they had a conversation_id
+		query.Eq("user_id_1", q.UserID1).Eq("user_id_2", q.UserID2)
+	}
+	if q.Since != nil {
+		// Incremental sync: only messages created after 'since'
+		query.Where(postgrest.Gt("created_at", q.Since.UTC().Format(time.RFC3339Nano))).
+			Order("created_at", true)
+	} else {
+		query.Order("created_at", true).Offset(q.Offset)
+	}
+	limit(query, q.Limit)
+
+	messages, err := postgrest.Rows[Message](ctx, query)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return messages, nil
+}
+
+func (s *Supabase) InsertCall(ctx context.Context, call *CallRecord) error {
+	row := map[string]interface{}{
+		"caller_id":  call.CallerID,
+		"callee_id":  call.CalleeID,
+		"call_type":  call.CallType,
+		"started_at": call.StartedAt.Format(time.RFC3339Nano),
+		"ended_at":   call.EndedAt.Format(time.RFC3339Nano),
+		"duration":   call.Duration,
+		"end_reason": call.EndReason,
+		"missed":     call.Missed,
+		"notified":   call.Notified,
+	}
+	if call.AnsweredAt != nil {
+		row["answered_at"] = call.AnsweredAt.Format(time.RFC3339Nano)
+	}
+
+	var inserted []CallRecord
+	if err := s.client(ctx).From("calls").Insert(ctx, row, &inserted); err != nil {
+		return wrapError(err)
+	}
+	if len(inserted) == 0 {
+		return fmt.Errorf("store: call insert returned no rows")
+	}
+	call.ID = inserted[0].ID
+	return nil
+}
+
+func (s *Supabase) ListCalls(ctx context.Context, q CallQuery) ([]CallRecord, error) {
+	query := s.client(ctx).From("calls")
+	if q.FriendID != "" {
+		query.Where(postgrest.Or(
+			postgrest.And(postgrest.Eq("caller_id", q.UserID), postgrest.Eq("callee_id", q.FriendID)),
+			postgrest.And(postgrest.Eq("caller_id", q.FriendID), postgrest.Eq("callee_id", q.UserID)),
+		))
+	} else {
+		query.Where(postgrest.Or(
+			postgrest.Eq("caller_id", q.UserID),
+			postgrest.Eq("callee_id", q.UserID),
+		))
+	}
+	query.Order("started_at", false).Offset(q.Offset)
+	limit(query, q.Limit)
+
+	records, err := postgrest.Rows[CallRecord](ctx, query)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return records, nil
+}
+
+func (s *Supabase) ListUnnotifiedMissedCalls(ctx context.Context, userID string) ([]CallRecord, error) {
+	records, err := postgrest.Rows[CallRecord](ctx, s.client(ctx).From("calls").
+		Eq("callee_id", userID).
+		Eq("missed", "true").
+		Eq("notified", "false").
+		Order("started_at", true))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return records, nil
+}
+
+func (s *Supabase) MarkCallsNotified(ctx context.Context, calleeID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	values := map[string]interface{}{
+		"notified": true,
+	}
+	return wrapError(s.client(ctx).From("calls").
+		Eq("callee_id", calleeID).
+		Where(postgrest.In("id", ids...)).
+		Update(ctx, values, nil))
+}
+
+// CreateConversation assigns the ID itself so the members can be inserted
+// right after the group. If that fails, the group is removed again.
+func (s *Supabase) CreateConversation(ctx context.Context, conv *Conversation, members []Member) error {
+	conv.ID = uuid.NewString()
+	row := map[string]interface{}{
+		"id":         conv.ID,
+		"kind":       conv.Kind,
+		"name":       conv.Name,
+		"created_by": conv.CreatedBy,
+	}
+
+	var inserted []Conversation
+	if err := s.client(ctx).From("conversations").Insert(ctx, row, &inserted); err != nil {
+		return wrapError(err)
+	}
+	if len(inserted) == 0 {
+		return fmt.Errorf("store: conversation insert returned no rows")
+	}
+	conv.CreatedAt = inserted[0].CreatedAt
+
+	for i := range members {
+		members[i].ConversationID = conv.ID
+	}
+	if err := s.AddMembers(ctx, members); err != nil {
+		if delErr := s.DeleteConversation(ctx, conv.ID); delErr != nil {
+			return fmt.Errorf("%w (removing conversation: %v)", err, delErr)
+		}
+		return err
+	}
+	conv.Members = members
+	return nil
+}
+
+func (s *Supabase) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	convs, err := postgrest.Rows[Conversation](ctx, s.client(ctx).From("conversations").
+		Eq("id", id))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(convs) == 0 {
+		return nil, ErrNotFound
+	}
+	if err := s.attachMembers(ctx, convs); err != nil {
+		return nil, err
+	}
+	return &convs[0], nil
+}
+
+func (s *Supabase) ListConversations(ctx context.Context, userID string) ([]Conversation, error) {
+	memberships, err := postgrest.Rows[Member](ctx, s.client(ctx).From("conversation_members").
+		Select("conversation_id").
+		Eq("user_id", userID))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(memberships) == 0 {
+		return []Conversation{}, nil
+	}
+
+	ids := make([]string, len(memberships))
+	for i, m := range memberships {
+		ids[i] = m.ConversationID
+	}
+	convs, err := postgrest.Rows[Conversation](ctx, s.client(ctx).From("conversations").
+		Where(postgrest.In("id", ids...)).
+		Order("created_at", false))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if err := s.attachMembers(ctx, convs); err != nil {
+		return nil, err
+	}
+	return convs, nil
+}
+
+// attachMembers loads the members of convs in one query, oldest first
+func (s *Supabase) attachMembers(ctx context.Context, convs []Conversation) error {
+	if len(convs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(convs))
+	for i, conv := range convs {
+		ids[i] = conv.ID
+	}
+
+	members, err := postgrest.Rows[Member](ctx, s.client(ctx).From("conversation_members").
+		Where(postgrest.In("conversation_id", ids...)).
+		Order("joined_at", true))
+	if err != nil {
+		return wrapError(err)
+	}
+
+	byConversation := make(map[string][]Member, len(convs))
+	for _, m := range members {
+		byConversation[m.ConversationID] = append(byConversation[m.ConversationID], m)
+	}
+	for i := range convs {
+		convs[i].Members = byConversation[convs[i].ID]
+	}
+	return nil
+}
+
+func (s *Supabase) AddMembers(ctx context.Context, members []Member) error {
+	if len(members) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	rows := make([]map[string]interface{}, len(members))
+	for i := range members {
+		members[i].JoinedAt = now
+		rows[i] = map[string]interface{}{
+			"conversation_id": members[i].ConversationID,
+			"user_id":         members[i].UserID,
+			"role":            members[i].Role,
+			"joined_at":       now.Format(time.RFC3339Nano),
+		}
+	}
+	return wrapError(s.client(ctx).From("conversation_members").Insert(ctx, rows, nil))
+}
+
+func (s *Supabase) UpdateMemberRole(ctx context.Context, conversationID, userID, role string) error {
+	values := map[string]interface{}{
+		"role": role,
+	}
+
+	var updated []Member
+	err := s.client(ctx).From("conversation_members").
+		Eq("conversation_id", conversationID).
+		Eq("user_id", userID).
+		Update(ctx, values, &updated)
+	if err != nil {
+		return wrapError(err)
+	}
+	if len(updated) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Supabase) RemoveMember(ctx context.Context, conversationID, userID string) error {
+	return wrapError(s.client(ctx).From("conversation_members").
+		Eq("conversation_id", conversationID).
+		Eq("user_id", userID).
+		Delete(ctx))
+}
+
+// DeleteConversation removes the members first in case the foreign key does not cascade
+func (s *Supabase) DeleteConversation(ctx context.Context, id string) error {
+	if err := s.client(ctx).From("conversation_members").Eq("conversation_id", id).Delete(ctx); err != nil {
+		return wrapError(err)
+	}
+	return wrapError(s.client(ctx).From("conversations").Eq("id", id).Delete(ctx))
+}
+
+// AdvanceReceipt only updates a watermark that is behind the message, so
+// acknowledgements arriving out of order never move it back. A user's first
+// acknowledgement in a conversation creates the row.
+func (s *Supabase) AdvanceReceipt(ctx context.Context, conversationID, userID, watermark, messageID string, createdAt time.Time) (bool, error) {
+	idColumn, atColumn := "last_"+watermark+"_id", "last_"+watermark+"_at"
+	at := createdAt.UTC().Format(time.RFC3339Nano)
+	values := map[string]interface{}{
+		idColumn: messageID,
+		atColumn: at,
+	}
+
+	var updated []Receipt
+	err := s.client(ctx).From("conversation_receipts").
+		Eq("conversation_id", conversationID).
+		Eq("user_id", userID).
+		Where(postgrest.Or(postgrest.IsNull(atColumn), postgrest.Lt(atColumn, at))).
+		Update(ctx, values, &updated)
+	if err != nil {
+		return false, wrapError(err)
+	}
+	if len(updated) > 0 {
+		return true, nil
+	}
+
+	// Nothing moved: the watermark is already there, or there is no row yet
+	existing, err := postgrest.Rows[Receipt](ctx, s.client(ctx).From("conversation_receipts").
+		Eq("conversation_id", conversationID).
+		Eq("user_id", userID))
+	if err != nil {
+		return false, wrapError(err)
+	}
+	if len(existing) > 0 {
+		return false, nil
+	}
+
+	values["conversation_id"] = conversationID
+	values["user_id"] = userID
+	err = wrapError(s.client(ctx).From("conversation_receipts").Insert(ctx, values, nil))
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 409 {
+		// Another device created the row in the meantime; move it instead
+		return s.AdvanceReceipt(ctx, conversationID, userID, watermark, messageID, createdAt)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Supabase) ListReceipts(ctx context.Context, conversationID string) ([]Receipt, error) {
+	receipts, err := postgrest.Rows[Receipt](ctx, s.client(ctx).From("conversation_receipts").
+		Eq("conversation_id", conversationID))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return receipts, nil
+}
@@ -0,0 +1,58 @@
+package testsupport
+
+import (
+	"athena-backend/auth"
+	"athena-backend/config"
+	"athena-backend/handlers"
+	"athena-backend/server"
+	"athena-backend/store"
+	"athena-backend/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/supabase-community/gotrue-go"
+)
+
+// Config returns a backend config pointing at the fake project
+func (f *FakeSupabase) Config() *config.Config {
+	return &config.Config{
+		SupabaseURL: f.URL,
+		SupabaseKey: f.AnonKey,
+		Port:        "0",
+		FrontendURL: "http://localhost:3000",
+		JWTSecret:   f.JWTSecret,
+		JWKSURL:     f.URL + "/auth/v1/.well-known/jwks.json",
+	}
+}
+
+// NewApp builds the real Fiber app with server.NewApp and SetupRoutes, wired
+// the same way main does but against the fake. Handlers keep their
+// dependencies in package state, so tests using NewApp must not run in parallel.
+func NewApp(f *FakeSupabase) *fiber.App {
+	cfg := f.Config()
+
+	authClient := gotrue.New(cfg.SupabaseURL, cfg.SupabaseKey).
+		WithCustomGoTrueURL(cfg.SupabaseURL + "/auth/v1")
+	handlers.SetAuthClient(authClient)
+
+	db := store.NewSupabase(cfg.SupabaseURL, cfg.SupabaseKey)
+	handlers.SetStores(handlers.Stores{
+		Profiles:      db,
+		Friends:       db,
+		Messages:      db,
+		Calls:         db,
+		Conversations: db,
+		Receipts:      db,
+	})
+	utils.SetProfileStore(db)
+
+	server.SetAuthConfig(auth.Config{
+		JWTSecret:  cfg.JWTSecret,
+		JWKSURL:    cfg.JWKSURL,
+		Audience:   "authenticated",
+		AuthClient: authClient,
+	})
+
+	app := server.NewApp(cfg)
+	server.SetupRoutes(app)
+	return app
+}
@@ -0,0 +1,673 @@
+package testsupport
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// row is a table row as decoded from JSON
+type row map[string]interface{}
+
+// Insert seeds rows into table, filling in id and created_at like the database defaults
+func (f *FakeSupabase) Insert(table string, rows ...map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range rows {
+		f.insertLocked(table, row(r))
+	}
+}
+
+// Rows returns a copy of every row in table
+func (f *FakeSupabase) Rows(table string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rows := make([]map[string]interface{}, 0, len(f.tables[table]))
+	for _, r := range f.tables[table] {
+		rows = append(rows, copyRow(r))
+	}
+	return rows
+}
+
+func (f *FakeSupabase) insertLocked(table string, r row) row {
+	r = copyRow(r)
+	if _, ok := r["id"]; !ok {
+		r["id"] = uuid.NewString()
+	}
+	if _, ok := r["created_at"]; !ok {
+		r["created_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	f.tables[table] = append(f.tables[table], r)
+	return r
+}
+
+// hasRowLocked reports whether table has a row with the given id
+func (f *FakeSupabase) hasRowLocked(table string, id interface{}) bool {
+	for _, existing := range f.tables[table] {
+		if fmt.Sprint(existing["id"]) == fmt.Sprint(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyRow(r row) row {
+	c := make(row, len(r))
+	for k, v := range r {
+		c[k] = v
+	}
+	return c
+}
+
+// writePostgrestError writes an error body shaped like PostgREST's
+func writePostgrestError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":    code,
+		"message": message,
+		"details": nil,
+		"hint":    nil,
+	})
+}
+
+func (f *FakeSupabase) handleREST(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/rest/v1/")
+	if strings.HasPrefix(path, "rpc/") {
+		f.handleRPC(w, r, strings.TrimPrefix(path, "rpc/"))
+		return
+	}
+
+	table := path
+	query, err := parseQuery(r.URL.RawQuery)
+	if err != nil {
+		writePostgrestError(w, http.StatusBadRequest, "PGRST100", err.Error())
+		return
+	}
+
+	returnRows := strings.Contains(r.Header.Get("Prefer"), "return=representation")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		matched := f.selectLocked(table, query)
+		writeJSON(w, http.StatusOK, f.projectLocked(table, matched, query.selects))
+
+	case http.MethodPost:
+		rows, err := decodeRows(r)
+		if err != nil {
+			writePostgrestError(w, http.StatusBadRequest, "PGRST102", err.Error())
+			return
+		}
+		// The whole insert fails on a duplicate primary key, as in Postgres
+		for _, newRow := range rows {
+			if id, ok := newRow["id"]; ok && f.hasRowLocked(table, id) {
+				writePostgrestError(w, http.StatusConflict, "23505", fmt.Sprintf(`duplicate key value violates unique constraint "%s_pkey"`, table))
+				return
+			}
+		}
+		inserted := make([]row, 0, len(rows))
+		for _, newRow := range rows {
+			inserted = append(inserted, f.insertLocked(table, newRow))
+		}
+		if returnRows {
+			writeJSON(w, http.StatusCreated, f.projectLocked(table, inserted, query.selects))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodPatch:
+		var values row
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			writePostgrestError(w, http.StatusBadRequest, "PGRST102", err.Error())
+			return
+		}
+		var updated []row
+		for _, existing := range f.tables[table] {
+			if query.matches(existing) {
+				for k, v := range values {
+					existing[k] = v
+				}
+				updated = append(updated, existing)
+			}
+		}
+		if returnRows {
+			writeJSON(w, http.StatusOK, f.projectLocked(table, updated, query.selects))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		kept := f.tables[table][:0]
+		for _, existing := range f.tables[table] {
+			if !query.matches(existing) {
+				kept = append(kept, existing)
+			}
+		}
+		f.tables[table] = kept
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writePostgrestError(w, http.StatusMethodNotAllowed, "PGRST117", "Unsupported HTTP method")
+	}
+}
+
+// decodeRows accepts a single JSON object or an array of objects
+func decodeRows(r *http.Request) ([]row, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	if len(raw) > 0 && raw[0] == '[' {
+		var rows []row
+		err := json.Unmarshal(raw, &rows)
+		return rows, err
+	}
+	var single row
+	err := json.Unmarshal(raw, &single)
+	return []row{single}, err
+}
+
+func (f *FakeSupabase) handleRPC(w http.ResponseWriter, r *http.Request, function string) {
+	if function != "create_user_profile" {
+		writePostgrestError(w, http.StatusNotFound, "PGRST202", "Could not find the function public."+function)
+		return
+	}
+
+	var args struct {
+		UserID string `json:"p_user_id"`
+		Name   string `json:"p_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		writePostgrestError(w, http.StatusBadRequest, "PGRST102", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, existing := range f.tables["user_profiles"] {
+		if existing["id"] == args.UserID {
+			writePostgrestError(w, http.StatusConflict, "23505", `duplicate key value violates unique constraint "user_profiles_pkey"`)
+			return
+		}
+	}
+
+	profile := f.insertLocked("user_profiles", row{
+		"id":   args.UserID,
+		"uid":  fmt.Sprintf("%08d", rand.Intn(100000000)),
+		"name": args.Name,
+	})
+	writeJSON(w, http.StatusOK, []row{profile})
+}
+
+// selectLocked applies filters, ordering and pagination
+func (f *FakeSupabase) selectLocked(table string, q *query) []row {
+	var matched []row
+	for _, r := range f.tables[table] {
+		if q.matches(r) {
+			matched = append(matched, r)
+		}
+	}
+
+	for i := len(q.order) - 1; i >= 0; i-- {
+		o := q.order[i]
+		sort.SliceStable(matched, func(a, b int) bool {
+			cmp := compareValues(matched[a][o.column], matched[b][o.column])
+			if o.ascending {
+				return cmp < 0
+			}
+			return cmp > 0
+		})
+	}
+
+	if q.offset > 0 {
+		if q.offset >= len(matched) {
+			matched = nil
+		} else {
+			matched = matched[q.offset:]
+		}
+	}
+	if q.limit >= 0 && q.limit < len(matched) {
+		matched = matched[:q.limit]
+	}
+	return matched
+}
+
+// projectLocked applies the select list, resolving embedded resources
+func (f *FakeSupabase) projectLocked(table string, rows []row, selects []selectItem) []row {
+	out := make([]row, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, f.projectRowLocked(table, r, selects))
+	}
+	return out
+}
+
+func (f *FakeSupabase) projectRowLocked(table string, r row, selects []selectItem) row {
+	if len(selects) == 0 {
+		return copyRow(r)
+	}
+
+	out := row{}
+	for _, item := range selects {
+		switch {
+		case item.column == "*":
+			for k, v := range r {
+				out[k] = v
+			}
+
+		case item.embed != "":
+			fk := foreignKeyColumn(table, item.embed, item.hint)
+			var embedded interface{}
+			for _, target := range f.tables[item.embed] {
+				if fmt.Sprint(target["id"]) == fmt.Sprint(r[fk]) {
+					embedded = f.projectRowLocked(item.embed, target, item.children)
+					break
+				}
+			}
+			out[item.outputName()] = embedded
+
+		default:
+			out[item.outputName()] = r[item.column]
+		}
+	}
+	return out
+}
+
+var fkeySuffix = regexp.MustCompile(`_fkey\d*$`)
+
+// foreignKeyColumn finds the column of table referencing target. Supabase
+// constraint names are <table>_<column>_fkey[N]; without a hint the
+// conventional <target>_id column is assumed.
+func foreignKeyColumn(table, target, hint string) string {
+	if hint != "" {
+		column := strings.TrimPrefix(hint, table+"_")
+		return fkeySuffix.ReplaceAllString(column, "")
+	}
+	return strings.TrimSuffix(target, "s") + "_id"
+}
+
+// query is a parsed PostgREST query string
+type query struct {
+	selects []selectItem
+	filters []condition
+	order   []orderItem
+	limit   int
+	offset  int
+}
+
+type orderItem struct {
+	column    string
+	ascending bool
+}
+
+// selectItem is one entry of a select list: a column, "*", or an embedded resource
+type selectItem struct {
+	alias    string
+	column   string
+	embed    string // embedded table name
+	hint     string // foreign key constraint after "!"
+	children []selectItem
+}
+
+func (s selectItem) outputName() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	if s.embed != "" {
+		return s.embed
+	}
+	return s.column
+}
+
+func (q *query) matches(r row) bool {
+	for _, c := range q.filters {
+		if !c.matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseQuery(raw string) (*query, error) {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &query{limit: -1}
+	for key, vals := range values {
+		for _, val := range vals {
+			switch key {
+			case "select":
+				items, err := parseSelect(val)
+				if err != nil {
+					return nil, err
+				}
+				q.selects = items
+
+			case "order":
+				for _, part := range strings.Split(val, ",") {
+					fields := strings.Split(part, ".")
+					q.order = append(q.order, orderItem{
+						column:    fields[0],
+						ascending: len(fields) < 2 || fields[1] != "desc",
+					})
+				}
+
+			case "limit":
+				if q.limit, err = strconv.Atoi(val); err != nil {
+					return nil, fmt.Errorf("invalid limit %q", val)
+				}
+
+			case "offset":
+				if q.offset, err = strconv.Atoi(val); err != nil {
+					return nil, fmt.Errorf("invalid offset %q", val)
+				}
+
+			case "or", "and":
+				if !strings.HasPrefix(val, "(") || !strings.HasSuffix(val, ")") {
+					return nil, fmt.Errorf("invalid logic tree %q", val)
+				}
+				p := &treeParser{input: val[1 : len(val)-1]}
+				children, err := p.parseList()
+				if err != nil {
+					return nil, err
+				}
+				q.filters = append(q.filters, condition{logic: key, children: children})
+
+			case "columns", "on_conflict":
+				// Accepted but irrelevant for the fake
+
+			default:
+				op, value, ok := strings.Cut(val, ".")
+				if !ok {
+					return nil, fmt.Errorf("invalid filter %s=%s", key, val)
+				}
+				c := condition{column: key, operator: op, value: value}
+				if op == "in" {
+					p := &treeParser{input: value}
+					if c.values, err = p.parseInList(); err != nil {
+						return nil, err
+					}
+				}
+				q.filters = append(q.filters, c)
+			}
+		}
+	}
+	return q, nil
+}
+
+// parseSelect parses "a,alias:b,alias:table!hint(c,d)"
+func parseSelect(s string) ([]selectItem, error) {
+	var items []selectItem
+	for _, part := range splitTopLevel(s) {
+		var item selectItem
+		if alias, rest, ok := strings.Cut(part, ":"); ok && !strings.Contains(alias, "(") {
+			item.alias = alias
+			part = rest
+		}
+
+		if open := strings.Index(part, "("); open >= 0 {
+			if !strings.HasSuffix(part, ")") {
+				return nil, fmt.Errorf("invalid embedded select %q", part)
+			}
+			target := part[:open]
+			item.embed, item.hint, _ = strings.Cut(target, "!")
+			children, err := parseSelect(part[open+1 : len(part)-1])
+			if err != nil {
+				return nil, err
+			}
+			item.children = children
+		} else {
+			item.column = part
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// splitTopLevel splits on commas outside parentheses
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, ch := range s {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		parts = append(parts, rest)
+	}
+	return parts
+}
+
+// condition is a filter on a column, or an and/or of conditions
+type condition struct {
+	column   string
+	operator string
+	value    string
+	values   []string // for "in"
+
+	logic    string
+	children []condition
+}
+
+func (c condition) matches(r row) bool {
+	switch c.logic {
+	case "and":
+		for _, child := range c.children {
+			if !child.matches(r) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, child := range c.children {
+			if child.matches(r) {
+				return true
+			}
+		}
+		return false
+	}
+
+	actual, ok := r[c.column]
+	if !ok || actual == nil {
+		return c.operator == "is" && c.value == "null"
+	}
+
+	switch c.operator {
+	case "eq":
+		return compareValues(actual, c.value) == 0
+	case "neq":
+		return compareValues(actual, c.value) != 0
+	case "gt":
+		return compareValues(actual, c.value) > 0
+	case "gte":
+		return compareValues(actual, c.value) >= 0
+	case "lt":
+		return compareValues(actual, c.value) < 0
+	case "lte":
+		return compareValues(actual, c.value) <= 0
+	case "in":
+		for _, v := range c.values {
+			if compareValues(actual, v) == 0 {
+				return true
+			}
+		}
+		return false
+	case "is":
+		return false
+	}
+	return false
+}
+
+// compareValues compares as timestamps, then numbers, then strings
+func compareValues(a, b interface{}) int {
+	as, bs := fmt.Sprint(a), fmt.Sprint(b)
+
+	if at, err := time.Parse(time.RFC3339Nano, as); err == nil {
+		if bt, err := time.Parse(time.RFC3339Nano, bs); err == nil {
+			return at.Compare(bt)
+		}
+	}
+	if af, err := strconv.ParseFloat(as, 64); err == nil {
+		if bf, err := strconv.ParseFloat(bs, 64); err == nil {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(as, bs)
+}
+
+// treeParser parses the inside of or=(...) / and=(...) logic trees
+type treeParser struct {
+	input string
+	pos   int
+}
+
+func (p *treeParser) parseList() ([]condition, error) {
+	var conditions []condition
+	for {
+		c, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+
+		if p.pos >= len(p.input) || p.input[p.pos] == ')' {
+			return conditions, nil
+		}
+		if p.input[p.pos] != ',' {
+			return nil, fmt.Errorf("unexpected %q in logic tree", p.input[p.pos])
+		}
+		p.pos++
+	}
+}
+
+func (p *treeParser) parseCondition() (condition, error) {
+	for _, logic := range []string{"and(", "or("} {
+		if strings.HasPrefix(p.input[p.pos:], logic) {
+			p.pos += len(logic)
+			children, err := p.parseList()
+			if err != nil {
+				return condition{}, err
+			}
+			if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+				return condition{}, fmt.Errorf("unterminated %s", logic)
+			}
+			p.pos++
+			return condition{logic: strings.TrimSuffix(logic, "("), children: children}, nil
+		}
+	}
+
+	// column.operator.value
+	end := strings.Index(p.input[p.pos:], ".")
+	if end < 0 {
+		return condition{}, fmt.Errorf("invalid condition in logic tree")
+	}
+	column := p.input[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	end = strings.Index(p.input[p.pos:], ".")
+	if end < 0 {
+		return condition{}, fmt.Errorf("invalid operator in logic tree")
+	}
+	operator := p.input[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	c := condition{column: column, operator: operator}
+	if operator == "in" {
+		values, err := p.parseInList()
+		if err != nil {
+			return condition{}, err
+		}
+		c.values = values
+		return c, nil
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return condition{}, err
+	}
+	c.value = value
+	return c, nil
+}
+
+// parseValue reads a bare value up to , or ), or a double-quoted value with \ escapes
+func (p *treeParser) parseValue() (string, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.input) {
+			ch := p.input[p.pos]
+			switch ch {
+			case '\\':
+				if p.pos+1 < len(p.input) {
+					b.WriteByte(p.input[p.pos+1])
+					p.pos += 2
+					continue
+				}
+			case '"':
+				p.pos++
+				return b.String(), nil
+			}
+			b.WriteByte(ch)
+			p.pos++
+		}
+		return "", fmt.Errorf("unterminated quoted value")
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && p.input[p.pos] != ',' && p.input[p.pos] != ')' {
+		p.pos++
+	}
+	return p.input[start:p.pos], nil
+}
+
+// parseInList reads an in list, (a,"b,c"), where quoted values may hold , and )
+func (p *treeParser) parseInList() ([]string, error) {
+	if p.pos >= len(p.input) || p.input[p.pos] != '(' {
+		return nil, fmt.Errorf("in requires a list")
+	}
+	p.pos++
+	var values []string
+	for p.pos < len(p.input) && p.input[p.pos] != ')' {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if p.pos < len(p.input) && p.input[p.pos] == ',' {
+			p.pos++
+		}
+	}
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("unterminated in list")
+	}
+	p.pos++
+	return values, nil
+}
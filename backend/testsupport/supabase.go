@@ -0,0 +1,294 @@
+// Package testsupport provides an in-process fake of the Supabase services the
+// backend talks to, so the real Fiber app can be exercised end-to-end.
+package testsupport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/supabase-community/gotrue-go/types"
+)
+
+// Defaults used by NewFakeSupabase
+const (
+	FakeAnonKey   = "test-anon-key"
+	FakeJWTSecret = "test-jwt-secret"
+)
+
+// FakeSupabase serves the GoTrue endpoints (/auth/v1) and the PostgREST subset
+// (/rest/v1) the backend uses, backed by in-memory tables
+type FakeSupabase struct {
+	Server    *httptest.Server
+	URL       string
+	AnonKey   string
+	JWTSecret string
+
+	// TokenTTL is the lifetime of minted access tokens
+	TokenTTL time.Duration
+
+	mu            sync.Mutex
+	users         map[string]*types.User // keyed by user ID
+	refreshTokens map[string]string      // refresh token -> user ID
+	otpRequests   []string               // emails magic links were sent to
+	tables        map[string][]row
+}
+
+// NewFakeSupabase starts a fake Supabase project. Call Close when done.
+func NewFakeSupabase() *FakeSupabase {
+	f := &FakeSupabase{
+		AnonKey:       FakeAnonKey,
+		JWTSecret:     FakeJWTSecret,
+		TokenTTL:      time.Hour,
+		users:         make(map[string]*types.User),
+		refreshTokens: make(map[string]string),
+		tables:        make(map[string][]row),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/v1/user", f.handleUser)
+	mux.HandleFunc("/auth/v1/token", f.handleToken)
+	mux.HandleFunc("/auth/v1/otp", f.handleOTP)
+	mux.HandleFunc("/auth/v1/logout", f.handleLogout)
+	mux.HandleFunc("/auth/v1/.well-known/jwks.json", f.handleJWKS)
+	mux.HandleFunc("/rest/v1/", f.handleREST)
+
+	f.Server = httptest.NewServer(f.requireAPIKey(mux))
+	f.URL = f.Server.URL
+	return f
+}
+
+// Close shuts down the fake server
+func (f *FakeSupabase) Close() {
+	f.Server.Close()
+}
+
+// CreateUser registers a confirmed user and returns their ID
+func (f *FakeSupabase) CreateUser(email string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.createUserLocked(email).ID.String()
+}
+
+func (f *FakeSupabase) createUserLocked(email string) *types.User {
+	for _, user := range f.users {
+		if user.Email == email {
+			return user
+		}
+	}
+
+	now := time.Now().UTC()
+	user := &types.User{
+		ID:               uuid.New(),
+		Aud:              "authenticated",
+		Role:             "authenticated",
+		Email:            email,
+		EmailConfirmedAt: &now,
+		AppMetadata:      map[string]interface{}{"provider": "email"},
+		UserMetadata:     map[string]interface{}{},
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	f.users[user.ID.String()] = user
+	return user
+}
+
+// AccessToken mints an HS256 access token for userID, signed like Supabase's
+func (f *FakeSupabase) AccessToken(userID string) string {
+	f.mu.Lock()
+	user := f.users[userID]
+	f.mu.Unlock()
+
+	claims := jwt.MapClaims{
+		"sub":        userID,
+		"aud":        "authenticated",
+		"role":       "authenticated",
+		"iss":        f.URL + "/auth/v1",
+		"iat":        time.Now().Unix(),
+		"exp":        time.Now().Add(f.TokenTTL).Unix(),
+		"session_id": uuid.NewString(),
+	}
+	if user != nil {
+		claims["email"] = user.Email
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(f.JWTSecret))
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// Session issues an access and refresh token pair for userID
+func (f *FakeSupabase) Session(userID string) types.Session {
+	refreshToken := uuid.NewString()
+
+	f.mu.Lock()
+	f.refreshTokens[refreshToken] = userID
+	user := f.users[userID]
+	f.mu.Unlock()
+
+	session := types.Session{
+		AccessToken:  f.AccessToken(userID),
+		RefreshToken: refreshToken,
+		TokenType:    "bearer",
+		ExpiresIn:    int(f.TokenTTL.Seconds()),
+		ExpiresAt:    time.Now().Add(f.TokenTTL).Unix(),
+	}
+	if user != nil {
+		session.User = *user
+	}
+	return session
+}
+
+// OTPRequests returns the emails magic links were requested for
+func (f *FakeSupabase) OTPRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.otpRequests...)
+}
+
+// requireAPIKey rejects requests without the project's API key, as the Supabase gateway does
+func (f *FakeSupabase) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("apikey") != f.AnonKey {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{
+				"message": "Invalid API key",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userFromRequest verifies the Bearer token and returns its user
+func (f *FakeSupabase) userFromRequest(r *http.Request) (*types.User, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(f.JWTSecret), nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, false
+	}
+
+	sub, _ := claims["sub"].(string)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user, ok := f.users[sub]
+	return user, ok
+}
+
+func (f *FakeSupabase) handleUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAuthError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	user, ok := f.userFromRequest(r)
+	if !ok {
+		writeAuthError(w, http.StatusUnauthorized, "invalid JWT")
+		return
+	}
+	writeJSON(w, http.StatusOK, types.UserResponse{User: *user})
+}
+
+func (f *FakeSupabase) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAuthError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if grantType := r.URL.Query().Get("grant_type"); grantType != "refresh_token" {
+		writeAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	var req types.TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAuthError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// Refresh tokens are single use, as in GoTrue
+	f.mu.Lock()
+	userID, ok := f.refreshTokens[req.RefreshToken]
+	delete(f.refreshTokens, req.RefreshToken)
+	f.mu.Unlock()
+
+	if !ok {
+		writeAuthError(w, http.StatusBadRequest, "Invalid Refresh Token: Refresh Token Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, types.TokenResponse{Session: f.Session(userID)})
+}
+
+func (f *FakeSupabase) handleOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAuthError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req types.OTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		writeAuthError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+
+	f.mu.Lock()
+	f.otpRequests = append(f.otpRequests, req.Email)
+	if req.CreateUser {
+		f.createUserLocked(req.Email)
+	}
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (f *FakeSupabase) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAuthError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	user, ok := f.userFromRequest(r)
+	if !ok {
+		writeAuthError(w, http.StatusUnauthorized, "invalid JWT")
+		return
+	}
+
+	// Revoke every refresh token of the user
+	f.mu.Lock()
+	for token, userID := range f.refreshTokens {
+		if userID == user.ID.String() {
+			delete(f.refreshTokens, token)
+		}
+	}
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleJWKS publishes no keys: the fake signs with the shared HS256 secret
+func (f *FakeSupabase) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []interface{}{}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAuthError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":    status,
+		"msg":     msg,
+		"message": msg,
+	})
+}
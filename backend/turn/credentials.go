@@ -0,0 +1,64 @@
+// Package turn issues and checks time-limited TURN credentials following the
+// coturn REST API convention: the username is "<expiry unix time>:<user ID>"
+// and the password is base64(HMAC-SHA1(secret, username)). Any TURN server
+// configured with the same shared secret (coturn's static-auth-secret)
+// accepts them until they expire.
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedUsername = errors.New("turn: malformed username")
+	ErrExpired           = errors.New("turn: credentials expired")
+)
+
+// Credentials are a TURN username and password valid until Expires
+type Credentials struct {
+	Username string
+	Password string
+	Expires  time.Time
+}
+
+// Issue derives credentials for userID that expire ttl after now
+func Issue(secret, userID string, ttl time.Duration, now time.Time) Credentials {
+	expires := now.Add(ttl).Truncate(time.Second)
+	username := strconv.FormatInt(expires.Unix(), 10) + ":" + userID
+	return Credentials{
+		Username: username,
+		Password: Password(secret, username),
+		Expires:  expires,
+	}
+}
+
+// Password returns the password that goes with username
+func Password(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseUsername splits a username into the user ID and expiry it was issued
+// with, and checks that it has not expired at now
+func ParseUsername(username string, now time.Time) (userID string, expires time.Time, err error) {
+	timestamp, userID, ok := strings.Cut(username, ":")
+	if !ok || userID == "" {
+		return "", time.Time{}, ErrMalformedUsername
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrMalformedUsername
+	}
+	expires = time.Unix(unix, 0)
+	if !now.Before(expires) {
+		return "", time.Time{}, ErrExpired
+	}
+	return userID, expires, nil
+}
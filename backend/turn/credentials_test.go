@@ -0,0 +1,82 @@
+package turn_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"athena-backend/turn"
+)
+
+func TestIssue(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 500_000_000, time.UTC)
+	creds := turn.Issue("s3cret", "user-1", time.Hour, now)
+
+	// Expiry is whole seconds, as it goes into the username
+	wantExpires := time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC)
+	if !creds.Expires.Equal(wantExpires) {
+		t.Errorf("got expiry %v, want %v", creds.Expires, wantExpires)
+	}
+	if creds.Username != "1772370000:user-1" {
+		t.Errorf("got username %q, want expiry:user", creds.Username)
+	}
+
+	// coturn checks base64(HMAC-SHA1(secret, username))
+	mac := hmac.New(sha1.New, []byte("s3cret"))
+	mac.Write([]byte(creds.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); creds.Password != want {
+		t.Errorf("got password %q, want %q", creds.Password, want)
+	}
+	if creds.Password != turn.Password("s3cret", creds.Username) {
+		t.Error("Issue and Password disagree")
+	}
+	if turn.Password("other", creds.Username) == creds.Password {
+		t.Error("got the same password for another secret")
+	}
+}
+
+func TestParseUsername(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+
+	tests := []struct {
+		name     string
+		username string
+		wantUser string
+		wantErr  error
+	}{
+		{"valid", "1800000060:user-1", "user-1", nil},
+		{"user ID with a colon", "1800000060:a:b", "a:b", nil},
+		{"expires now", "1800000000:user-1", "", turn.ErrExpired},
+		{"expired", "1799999999:user-1", "", turn.ErrExpired},
+		{"no colon", "1800000060", "", turn.ErrMalformedUsername},
+		{"no user ID", "1800000060:", "", turn.ErrMalformedUsername},
+		{"expiry not a number", "tomorrow:user-1", "", turn.ErrMalformedUsername},
+		{"empty", "", "", turn.ErrMalformedUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, expires, err := turn.ParseUsername(tt.username, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if userID != tt.wantUser {
+				t.Errorf("got user %q, want %q", userID, tt.wantUser)
+			}
+			if err == nil && expires.Unix() != 1_800_000_060 {
+				t.Errorf("got expiry %v", expires)
+			}
+		})
+	}
+
+	// What Issue hands out parses back until it expires
+	creds := turn.Issue("s3cret", "user-2", time.Minute, now)
+	if userID, _, err := turn.ParseUsername(creds.Username, now.Add(59*time.Second)); err != nil || userID != "user-2" {
+		t.Errorf("got %q, %v before expiry", userID, err)
+	}
+	if _, _, err := turn.ParseUsername(creds.Username, now.Add(time.Minute)); !errors.Is(err, turn.ErrExpired) {
+		t.Errorf("got %v at expiry, want ErrExpired", err)
+	}
+}
@@ -0,0 +1,284 @@
+package turn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+)
+
+// ServerConfig configures the embedded TURN/STUN server
+type ServerConfig struct {
+	ListenAddr   string // UDP and TCP address to listen on, e.g. "0.0.0.0:3478"
+	PublicIP     net.IP // address clients reach the relays on
+	Realm        string
+	Secret       string // the secret the API issues credentials with
+	RelayPortMin uint16
+	RelayPortMax uint16
+
+	// MaxAllocationsPerUser caps the relays one user holds at a time
+	MaxAllocationsPerUser int
+
+	// Authorize reports whether userID may relay media right now. Requests
+	// from users it rejects fail authentication.
+	Authorize func(userID string) bool
+}
+
+// Usage is relay traffic, in bytes, since the server started
+type Usage struct {
+	Allocations   int    `json:"allocations"`    // open right now
+	BytesSent     uint64 `json:"bytes_sent"`     // relayed to peers
+	BytesReceived uint64 `json:"bytes_received"` // relayed from peers
+}
+
+// Server is a TURN/STUN server that accepts the credentials issued by Issue
+// and keeps each user's relays within a quota
+type Server struct {
+	cfg  ServerConfig
+	turn *pionturn.Server
+
+	mu          sync.Mutex
+	relays      map[string]*relayConn            // by relay address, until the allocation is created
+	allocations map[string]*relayConn            // by five-tuple of the client
+	byUser      map[string]map[*relayConn]string // user ID -> open relays and their five-tuple
+	closed      Usage                            // traffic of relays already closed
+}
+
+// NewServer starts listening on cfg.ListenAddr
+func NewServer(cfg ServerConfig) (*Server, error) {
+	s := &Server{
+		cfg:         cfg,
+		relays:      make(map[string]*relayConn),
+		allocations: make(map[string]*relayConn),
+		byUser:      make(map[string]map[*relayConn]string),
+	}
+
+	udpConn, err := net.ListenPacket("udp4", cfg.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+	tcpListener, err := net.Listen("tcp4", cfg.ListenAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+
+	s.turn, err = pionturn.NewServer(pionturn.ServerConfig{
+		Realm:        cfg.Realm,
+		AuthHandler:  s.authenticate,
+		QuotaHandler: s.withinQuota,
+		EventHandler: pionturn.EventHandler{
+			OnAllocationCreated: s.allocationCreated,
+			OnAllocationDeleted: s.allocationDeleted,
+		},
+		PacketConnConfigs: []pionturn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: s.relayGenerator(),
+		}},
+		ListenerConfigs: []pionturn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: s.relayGenerator(),
+		}},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+	return s, nil
+}
+
+// Close stops the server and closes every relay
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
+
+// authenticate checks the HMAC credentials of every authenticated request
+// (Allocate, Refresh, CreatePermission, ChannelBind)
+func (s *Server) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	userID, _, err := ParseUsername(username, time.Now())
+	if err != nil {
+		log.Printf("TURN rejected %s from %s: %v", username, srcAddr, err)
+		return nil, false
+	}
+	if s.cfg.Authorize != nil && !s.cfg.Authorize(userID) {
+		log.Printf("TURN rejected %s from %s: not in a call", userID, srcAddr)
+		return nil, false
+	}
+	return pionturn.GenerateAuthKey(username, realm, Password(s.cfg.Secret, username)), true
+}
+
+// withinQuota rejects a new allocation once the user holds the maximum
+func (s *Server) withinQuota(username, realm string, srcAddr net.Addr) bool {
+	userID, _, err := ParseUsername(username, time.Now())
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.byUser[userID]) >= s.cfg.MaxAllocationsPerUser {
+		log.Printf("TURN allocation quota of %d reached for %s", s.cfg.MaxAllocationsPerUser, userID)
+		return false
+	}
+	return true
+}
+
+func (s *Server) allocationCreated(srcAddr, dstAddr net.Addr, protocol, username, realm string, relayAddr net.Addr, requestedPort int) {
+	userID, _, err := ParseUsername(username, time.Now())
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relay, ok := s.relays[relayAddr.String()]
+	if !ok {
+		return
+	}
+	delete(s.relays, relayAddr.String())
+
+	key := fiveTuple(srcAddr, dstAddr, protocol)
+	relay.userID = userID
+	relay.opened = time.Now()
+	s.allocations[key] = relay
+	if s.byUser[userID] == nil {
+		s.byUser[userID] = make(map[*relayConn]string)
+	}
+	s.byUser[userID][relay] = key
+}
+
+func (s *Server) allocationDeleted(srcAddr, dstAddr net.Addr, protocol, username, realm string) {
+	key := fiveTuple(srcAddr, dstAddr, protocol)
+
+	s.mu.Lock()
+	relay, ok := s.allocations[key]
+	if ok {
+		delete(s.allocations, key)
+		delete(s.byUser[relay.userID], relay)
+		if len(s.byUser[relay.userID]) == 0 {
+			delete(s.byUser, relay.userID)
+		}
+		s.closed.BytesSent += relay.sent.Load()
+		s.closed.BytesReceived += relay.received.Load()
+	}
+	s.mu.Unlock()
+
+	if ok {
+		log.Printf("TURN relay %s of %s closed after %s: %d bytes sent, %d bytes received",
+			relay.LocalAddr(), relay.userID, time.Since(relay.opened).Round(time.Second), relay.sent.Load(), relay.received.Load())
+	}
+}
+
+// Release closes every relay of userID, e.g. once its call has ended
+func (s *Server) Release(userID string) {
+	s.mu.Lock()
+	relays := make([]*relayConn, 0, len(s.byUser[userID]))
+	for relay := range s.byUser[userID] {
+		relays = append(relays, relay)
+	}
+	s.mu.Unlock()
+
+	// Closing the socket makes the server delete the allocation
+	for _, relay := range relays {
+		relay.Close()
+	}
+}
+
+// Usage returns the traffic relayed so far
+func (s *Server) Usage() Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.closed
+	usage.Allocations = len(s.allocations)
+	for _, relay := range s.allocations {
+		usage.BytesSent += relay.sent.Load()
+		usage.BytesReceived += relay.received.Load()
+	}
+	return usage
+}
+
+// relayGenerator allocates relays in the configured port range and counts
+// the traffic going through them
+func (s *Server) relayGenerator() pionturn.RelayAddressGenerator {
+	return &countingGenerator{
+		RelayAddressGenerator: &pionturn.RelayAddressGeneratorPortRange{
+			RelayAddress: s.cfg.PublicIP,
+			Address:      "0.0.0.0",
+			MinPort:      s.cfg.RelayPortMin,
+			MaxPort:      s.cfg.RelayPortMax,
+		},
+		server: s,
+	}
+}
+
+type countingGenerator struct {
+	pionturn.RelayAddressGenerator
+	server *Server
+}
+
+func (g *countingGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relay := &relayConn{PacketConn: conn}
+	g.server.mu.Lock()
+	g.server.relays[addr.String()] = relay
+	g.server.mu.Unlock()
+	return relay, addr, nil
+}
+
+// relayConn is the socket of one allocation facing the peers
+type relayConn struct {
+	net.PacketConn
+	userID   string
+	opened   time.Time
+	sent     atomic.Uint64
+	received atomic.Uint64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Close may run twice when Release closes a relay before the server does
+func (c *relayConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.PacketConn.Close()
+	})
+	return c.closeErr
+}
+
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.received.Add(uint64(n))
+	return n, addr, err
+}
+
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.sent.Add(uint64(n))
+	return n, err
+}
+
+func fiveTuple(srcAddr, dstAddr net.Addr, protocol string) string {
+	return protocol + "|" + srcAddr.String() + "|" + dstAddr.String()
+}
+
+// URLs returns the STUN and TURN URLs clients use to reach the server
+func (cfg ServerConfig) URLs() (stun, turn []string, err error) {
+	_, port, err := net.SplitHostPort(cfg.ListenAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("turn: %w", err)
+	}
+	hostPort := net.JoinHostPort(cfg.PublicIP.String(), port)
+	return []string{"stun:" + hostPort},
+		[]string{"turn:" + hostPort + "?transport=udp", "turn:" + hostPort + "?transport=tcp"},
+		nil
+}
@@ -0,0 +1,153 @@
+package turn_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"athena-backend/turn"
+
+	pionturn "github.com/pion/turn/v4"
+)
+
+const testSecret = "s3cret"
+
+// freePort finds a port free for both UDP and TCP on the loopback interface
+func freePort(t *testing.T) string {
+	t.Helper()
+	for range 10 {
+		udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := udp.LocalAddr().String()
+		tcp, err := net.Listen("tcp4", addr)
+		udp.Close()
+		if err == nil {
+			tcp.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// startServer runs a TURN server that lets users in inCall relay, at most
+// two allocations each
+func startServer(t *testing.T, inCall map[string]bool) (*turn.Server, string) {
+	t.Helper()
+	addr := freePort(t)
+	s, err := turn.NewServer(turn.ServerConfig{
+		ListenAddr:            addr,
+		PublicIP:              net.ParseIP("127.0.0.1"),
+		Realm:                 "athena",
+		Secret:                testSecret,
+		RelayPortMin:          40000,
+		RelayPortMax:          60000,
+		MaxAllocationsPerUser: 2,
+		Authorize:             func(userID string) bool { return inCall[userID] },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, addr
+}
+
+// allocate asks the server for a relay with the given credentials
+func allocate(t *testing.T, addr, username, password string) (net.PacketConn, error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pionturn.NewClient(&pionturn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Username:       username,
+		Password:       password,
+		Realm:          "athena",
+		Conn:           conn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return client.Allocate()
+}
+
+func allocateAs(t *testing.T, addr, userID string, ttl time.Duration) (net.PacketConn, error) {
+	t.Helper()
+	creds := turn.Issue(testSecret, userID, ttl, time.Now())
+	return allocate(t, addr, creds.Username, creds.Password)
+}
+
+func TestServerAuthenticates(t *testing.T) {
+	s, addr := startServer(t, map[string]bool{"alice": true})
+
+	if _, err := allocateAs(t, addr, "alice", time.Hour); err != nil {
+		t.Fatalf("allocating with valid credentials: %v", err)
+	}
+	if got := s.Usage().Allocations; got != 1 {
+		t.Errorf("got %d allocations, want 1", got)
+	}
+
+	expired := turn.Issue(testSecret, "alice", -time.Minute, time.Now())
+	if _, err := allocate(t, addr, expired.Username, expired.Password); err == nil {
+		t.Error("allocated with expired credentials")
+	}
+
+	forged := turn.Issue("guessed", "alice", time.Hour, time.Now())
+	if _, err := allocate(t, addr, forged.Username, forged.Password); err == nil {
+		t.Error("allocated with a password from another secret")
+	}
+
+	// Credentials of a user who is in no call are valid but not authorized
+	if _, err := allocateAs(t, addr, "bob", time.Hour); err == nil {
+		t.Error("allocated for a user Authorize rejects")
+	}
+
+	if got := s.Usage().Allocations; got != 1 {
+		t.Errorf("got %d allocations after rejected requests, want 1", got)
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	s, addr := startServer(t, map[string]bool{"alice": true, "bob": true})
+
+	for i := range 2 {
+		if _, err := allocateAs(t, addr, "alice", time.Hour); err != nil {
+			t.Fatalf("allocation %d within the quota: %v", i+1, err)
+		}
+	}
+	if _, err := allocateAs(t, addr, "alice", time.Hour); err == nil {
+		t.Fatal("allocated past the per-user quota")
+	}
+
+	// The quota is per user
+	if _, err := allocateAs(t, addr, "bob", time.Hour); err != nil {
+		t.Fatalf("allocating for another user: %v", err)
+	}
+	if got := s.Usage().Allocations; got != 3 {
+		t.Fatalf("got %d allocations, want 3", got)
+	}
+
+	// Releasing frees the user's relays, and with them the quota
+	s.Release("alice")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Usage().Allocations != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d allocations after releasing alice, want 1", s.Usage().Allocations)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := allocateAs(t, addr, "alice", time.Hour); err != nil {
+		t.Errorf("allocating after a release: %v", err)
+	}
+}
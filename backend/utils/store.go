@@ -0,0 +1,11 @@
+package utils
+
+import "athena-backend/store"
+
+// Shared profile store
+var profileStore store.ProfileStore
+
+// SetProfileStore sets the profile store for use in utils
+func SetProfileStore(profiles store.ProfileStore) {
+	profileStore = profiles
+}
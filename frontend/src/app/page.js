@@ -10,6 +10,11 @@ const CallModal = dynamic(() => import("@/components/CallModal"), {
   ssr: false,
 });
 
+const VoicemailRecorder = dynamic(
+  () => import("@/components/Voicemail").then((mod) => mod.VoicemailRecorder),
+  { ssr: false }
+);
+
 const OpenChat = dynamic(() => import("@/components/OpenChat"), {
   ssr: false,
 });
@@ -52,15 +57,24 @@ export default function ChatPage() {
     otherUser,
     isMuted,
     callDuration,
+    waitingCall,
+    voicemailTarget,
     remoteAudioRef,
     startCall,
     answerCall,
     declineCall,
     endCall,
+    acceptWaitingCall,
+    declineWaitingCall,
     toggleMute,
+    dismissVoicemail,
+    handleCallError,
+    handleRemoteCallEnd,
     handleIncomingOffer,
+    handleCallWaiting,
     handleIncomingAnswer,
     handleIncomingIceCandidate,
+    handleIncomingRenegotiate,
   } = useWebRTC(sendWSMessage);
 
   // Detect mobile view
@@ -198,12 +212,17 @@ export default function ChatPage() {
       // Handle WebRTC signaling messages globally
       if (messageType === "call-offer") {
         handleIncomingOffer(messagePayload);
+      } else if (messageType === "call-waiting") {
+        handleCallWaiting(messagePayload);
       } else if (messageType === "call-answer") {
         handleIncomingAnswer(messagePayload);
       } else if (messageType === "ice-candidate") {
         handleIncomingIceCandidate(messagePayload);
+      } else if (messageType === "call-renegotiate") {
+        handleIncomingRenegotiate(messagePayload);
       } else if (messageType === "call-error") {
         const { reason, receiver_id } = messagePayload;
+        handleCallError(messagePayload);
         if (reason === "user_offline") {
           toast.error("User is offline");
         } else if (reason === "user_busy") {
@@ -212,8 +231,14 @@ export default function ChatPage() {
           toast.error("Failed to reach user");
         }
       } else if (messageType === "call-end") {
-        // Other party ended the call
-        endCall();
+        // Other party or the server ended the call
+        handleRemoteCallEnd(messagePayload);
+      } else if (messageType === "missed-call") {
+        const startedAt = new Date(messagePayload.started_at);
+        toast(`Missed ${messagePayload.call_type} call at ${startedAt.toLocaleTimeString()}`, {
+          icon: "📞",
+          duration: 8000,
+        });
       }
       // Chat messages will be handled by OpenChat component through the passed addMessageHandler
     });
@@ -382,8 +407,14 @@ export default function ChatPage() {
             onDecline={declineCall}
             onEndCall={endCall}
             onToggleMute={toggleMute}
+            waitingCall={waitingCall}
+            onAcceptWaiting={acceptWaitingCall}
+            onDeclineWaiting={declineWaitingCall}
             remoteAudioRef={remoteAudioRef}
           />
+          {voicemailTarget && (
+            <VoicemailRecorder target={voicemailTarget} onClose={dismissVoicemail} />
+          )}
           {/* Chat List Box */}
           <div
             className={`bg-[#252526] border border-[#3e3e42] md:rounded-2xl p-4 flex flex-col h-full transition-transform duration-300 ${
@@ -11,6 +11,9 @@ export default function CallModal({
   onDecline,
   onEndCall,
   onToggleMute,
+  waitingCall,
+  onAcceptWaiting,
+  onDeclineWaiting,
   remoteAudioRef,
 }) {
   const formattedDuration = useMemo(() => {
@@ -55,6 +58,31 @@ export default function CallModal({
             </div>
           </div>
 
+          {/* Call Waiting: a second caller while this call is on */}
+          {waitingCall && (
+            <div className="mx-4 mb-4 p-3 rounded-xl bg-[#2d2d30] border border-[#3e3e42] flex items-center justify-between gap-2">
+              <p className="text-sm text-[#d4d4d4] animate-pulse">
+                {waitingCall.name} is calling...
+              </p>
+              <div className="flex gap-2">
+                <button
+                  onClick={onDeclineWaiting}
+                  className="p-2 rounded-full bg-red-600 hover:bg-red-700 active:bg-red-800 transition-all duration-200"
+                  title="Decline"
+                >
+                  <PhoneOff size={18} className="text-white" />
+                </button>
+                <button
+                  onClick={onAcceptWaiting}
+                  className="p-2 rounded-full bg-green-600 hover:bg-green-700 active:bg-green-800 transition-all duration-200"
+                  title="End current call and answer"
+                >
+                  <Phone size={18} className="text-white" />
+                </button>
+              </div>
+            </div>
+          )}
+
           {/* Call Controls */}
           <div className="p-4 pt-0">
             {/* Action Buttons */}
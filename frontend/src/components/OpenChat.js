@@ -13,6 +13,7 @@ import {
 } from "lucide-react";
 import { useMessages } from "@/hooks/useMessages";
 import { useAuth } from "@/contexts/AuthContext";
+import { VoicemailPlayer } from "@/components/Voicemail";
 
 export default function OpenChat({ selectedFriend, onClose, isMobile, onStartCall, sendWSMessage, addMessageHandler, callState }) {
   const { user } = useAuth();
@@ -50,6 +51,7 @@ export default function OpenChat({ selectedFriend, onClose, isMobile, onStartCal
           const newMsg = {
             id: actualMessage.id || `ws-${Date.now()}-${Math.random().toString(36).substr(2, 9)}`,
             text: actualMessage.content,
+            voicemail: actualMessage.voicemail,
             sender: actualMessage.sender_id,
             timestamp: new Date(actualMessage.created_at),
             isOwn: actualMessage.sender_id === user?.id,
@@ -70,6 +72,7 @@ export default function OpenChat({ selectedFriend, onClose, isMobile, onStartCal
           const newMsg = {
             id: actualMessage.id || `ws-${Date.now()}-${Math.random().toString(36).substr(2, 9)}`,
             text: actualMessage.content,
+            voicemail: actualMessage.voicemail,
             sender: actualMessage.sender_id,
             timestamp: new Date(actualMessage.created_at),
             isOwn: actualMessage.sender_id === user?.id,
@@ -89,8 +92,14 @@ export default function OpenChat({ selectedFriend, onClose, isMobile, onStartCal
     // Sort user IDs to ensure consistency
     const userIds = [user.id, selectedFriend.fid].sort();
 
-    // Create message object
+    // Unique ID for the optimistic message, also sent so the server can ack and dedupe retries
+    // Use timestamp + random string to ensure uniqueness even for rapid messages
+    const uniqueId = `${Date.now()}-${Math.random().toString(36).substr(2, 9)}`;
+
+    // Create message object; the server derives the sender and pair from recipient_id
     const messageData = {
+      recipient_id: selectedFriend.fid,
+      client_msg_id: uniqueId,
       user_id_1: userIds[0],
       user_id_2: userIds[1],
       sender_id: user.id,
@@ -108,9 +117,7 @@ export default function OpenChat({ selectedFriend, onClose, isMobile, onStartCal
     const sent = sendWSMessage(wrappedMessage);
     
     if (sent) {
-      // Optimistically add to UI with a unique ID
-      // Use timestamp + random string to ensure uniqueness even for rapid messages
-      const uniqueId = `${Date.now()}-${Math.random().toString(36).substr(2, 9)}`;
+      // Optimistically add to UI with the unique ID
       const newMessage = {
         id: uniqueId,
         text: message.trim(),
@@ -337,7 +344,11 @@ useEffect(() => {
                             : `bg-[#3e3e42] text-[#d4d4d4] border border-[#505050] ${msg.isSameSender ? "rounded-xl" : "rounded-tr-xl rounded-br-xl rounded-bl-xl"}`
                         }`}
                       >
-                        <p className="break-all" style={{ overflowWrap: 'anywhere', wordBreak: 'break-word' }}>{msg.text}</p>
+                        {msg.voicemail ? (
+                          <VoicemailPlayer voicemail={msg.voicemail} />
+                        ) : (
+                          <p className="break-all" style={{ overflowWrap: 'anywhere', wordBreak: 'break-word' }}>{msg.text}</p>
+                        )}
                         <p
                           className={`flex items-end text-xs mt-1 ${
                             msg.isOwn ? "text-gray-100" : "text-[#858585]"
@@ -556,7 +567,11 @@ useEffect(() => {
                           : `bg-[#3e3e42] text-[#d4d4d4] border border-[#505050] ${msg.isSameSender ? "rounded-xl" : "rounded-tr-xl rounded-br-xl rounded-bl-xl"}`
                       }`}
                   >
-                    <p className="break-all" style={{ overflowWrap: 'anywhere', wordBreak: 'break-word' }}>{msg.text}</p>
+                    {msg.voicemail ? (
+                      <VoicemailPlayer voicemail={msg.voicemail} />
+                    ) : (
+                      <p className="break-all" style={{ overflowWrap: 'anywhere', wordBreak: 'break-word' }}>{msg.text}</p>
+                    )}
                     <p
                         className={`flex items-end text-xs mt-1 ${
                           msg.isOwn ? "text-gray-100" : "text-[#858585]"
@@ -0,0 +1,177 @@
+"use client";
+import { useState, useRef, useEffect, useCallback } from "react";
+import toast from "react-hot-toast";
+import { Mic, Square, Send, X, Play, Pause } from "lucide-react";
+import { useApi } from "@/hooks/useApi";
+
+const API_URL = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
+const MAX_SECONDS = 60;
+
+const formatSeconds = (seconds) =>
+  `${Math.floor(seconds / 60)}:${(seconds % 60).toString().padStart(2, "0")}`;
+
+// ============================================
+// RECORDER (shown to the caller after user_offline / no_answer)
+// ============================================
+export function VoicemailRecorder({ target, onClose }) {
+  const { apiCall } = useApi();
+  const [recording, setRecording] = useState(false);
+  const [seconds, setSeconds] = useState(0);
+  const [recorded, setRecorded] = useState(null);
+  const [sending, setSending] = useState(false);
+  const recorderRef = useRef(null);
+  const intervalRef = useRef(null);
+
+  const stopRecording = useCallback(() => {
+    if (recorderRef.current?.state === "recording") {
+      recorderRef.current.stop();
+    }
+    clearInterval(intervalRef.current);
+    setRecording(false);
+  }, []);
+
+  const startRecording = useCallback(async () => {
+    try {
+      const stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+      const recorder = new MediaRecorder(stream);
+      const chunks = [];
+
+      recorder.ondataavailable = (event) => chunks.push(event.data);
+      recorder.onstop = () => {
+        stream.getTracks().forEach((track) => track.stop());
+        setRecorded(new Blob(chunks, { type: recorder.mimeType }));
+      };
+
+      recorderRef.current = recorder;
+      recorder.start();
+      setRecording(true);
+      setSeconds(0);
+      intervalRef.current = setInterval(() => setSeconds((s) => s + 1), 1000);
+    } catch (error) {
+      console.error("❌ Error starting voicemail recording:", error);
+      toast.error("Microphone not available");
+    }
+  }, []);
+
+  // Recordings are capped so they stay under the server's size limit
+  useEffect(() => {
+    if (recording && seconds >= MAX_SECONDS) stopRecording();
+  }, [recording, seconds, stopRecording]);
+
+  useEffect(() => () => stopRecording(), [stopRecording]);
+
+  const sendVoicemail = useCallback(async () => {
+    if (!recorded) return;
+    setSending(true);
+
+    const form = new FormData();
+    form.append("call_id", target.callId);
+    form.append("duration", String(seconds));
+    form.append("audio", recorded, "voicemail");
+
+    try {
+      const response = await apiCall(`${API_URL}/api/calls/voicemail`, {
+        method: "POST",
+        body: form,
+      });
+      if (!response.ok) {
+        const data = await response.json().catch(() => ({}));
+        throw new Error(data.error || "Failed to send voicemail");
+      }
+      toast.success(`Voicemail sent to ${target.user.name}`);
+      onClose();
+    } catch (error) {
+      toast.error(error.message);
+      setSending(false);
+    }
+  }, [apiCall, recorded, seconds, target, onClose]);
+
+  return (
+    <div className="fixed bottom-4 left-1/2 -translate-x-1/2 z-50 bg-[#252526] border border-[#3e3e42] rounded-2xl shadow-2xl p-4 w-80">
+      <div className="flex justify-between items-center mb-3">
+        <p className="text-[#d4d4d4] text-sm">
+          Leave a voicemail for <span className="font-semibold">{target.user.name}</span>
+        </p>
+        <button onClick={onClose} className="text-[#858585] hover:text-white" title="Close">
+          <X size={18} />
+        </button>
+      </div>
+
+      <div className="flex items-center gap-2">
+        {!recording && !recorded && (
+          <button
+            onClick={startRecording}
+            className="p-2 w-full rounded-full justify-center flex gap-2 bg-red-600 hover:bg-red-700 text-white"
+          >
+            <Mic size={20} /> Record
+          </button>
+        )}
+        {recording && (
+          <button
+            onClick={stopRecording}
+            className="p-2 w-full rounded-full justify-center flex gap-2 bg-[#3e3e42] hover:bg-[#505050] text-white animate-pulse"
+          >
+            <Square size={20} /> Stop ({formatSeconds(seconds)})
+          </button>
+        )}
+        {recorded && (
+          <button
+            onClick={sendVoicemail}
+            disabled={sending}
+            className="p-2 w-full rounded-full justify-center flex gap-2 bg-green-600 hover:bg-green-700 text-white disabled:opacity-50"
+          >
+            <Send size={20} /> Send ({formatSeconds(seconds)})
+          </button>
+        )}
+      </div>
+    </div>
+  );
+}
+
+// ============================================
+// PLAYER (voicemail messages in the chat)
+// ============================================
+export function VoicemailPlayer({ voicemail }) {
+  const { apiCall } = useApi();
+  const [playing, setPlaying] = useState(false);
+  const audioRef = useRef(null);
+  const objectUrlRef = useRef(null);
+
+  useEffect(() => {
+    return () => {
+      audioRef.current?.pause();
+      if (objectUrlRef.current) URL.revokeObjectURL(objectUrlRef.current);
+    };
+  }, []);
+
+  // The recording needs the auth header, so it is fetched once and played from a blob URL
+  const togglePlay = useCallback(async () => {
+    if (playing) {
+      audioRef.current?.pause();
+      setPlaying(false);
+      return;
+    }
+
+    try {
+      if (!audioRef.current) {
+        const response = await apiCall(`${API_URL}${voicemail.url}`);
+        if (!response.ok) throw new Error("Voicemail not available");
+        objectUrlRef.current = URL.createObjectURL(await response.blob());
+        audioRef.current = new Audio(objectUrlRef.current);
+        audioRef.current.onended = () => setPlaying(false);
+      }
+      await audioRef.current.play();
+      setPlaying(true);
+    } catch (error) {
+      console.error("❌ Error playing voicemail:", error);
+      toast.error("Could not play voicemail");
+    }
+  }, [apiCall, playing, voicemail.url]);
+
+  return (
+    <button onClick={togglePlay} className="flex items-center gap-2" title={playing ? "Pause" : "Play voicemail"}>
+      {playing ? <Pause size={18} /> : <Play size={18} />}
+      <span>Voicemail · {formatSeconds(voicemail.duration || 0)}</span>
+    </button>
+  );
+}
@@ -21,10 +21,10 @@ export const useApi = () => {
       throw new Error('No access token')
     }
 
-    // Set up default headers with authorization
+    // Set up default headers with authorization; form uploads set their own content type
     const defaultHeaders = {
       'Authorization': `Bearer ${accessToken}`,
-      'Content-Type': 'application/json',
+      ...(options.body instanceof FormData ? {} : { 'Content-Type': 'application/json' }),
       ...options.headers,
     }
 
@@ -64,6 +64,7 @@ export function useMessages(friendId) {
       const newMessages = (data.messages || []).map((msg) => ({
         id: msg.id,
         text: msg.content,
+        voicemail: msg.voicemail,
         sender: msg.sender_id,
         timestamp: new Date(msg.created_at),
         isOwn: msg.sender_id === user?.id,
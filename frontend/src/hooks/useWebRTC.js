@@ -70,6 +70,8 @@ export function useWebRTC(sendWSMessage) {
   const [otherUser, setOtherUser] = useState(null);
   const [isMuted, setIsMuted] = useState(false);
   const [callDuration, setCallDuration] = useState(0);
+  const [waitingCall, setWaitingCall] = useState(null); // second caller while in a call: { id, name, call_id }
+  const [voicemailTarget, setVoicemailTarget] = useState(null); // { callId, user } of an outgoing call nobody took
 
   // Refs
   const peerConnectionRef = useRef(null);
@@ -78,6 +80,10 @@ export function useWebRTC(sendWSMessage) {
   const remoteAudioRef = useRef(null);
   const iceCandidateQueueRef = useRef([]);
   const pendingOfferRef = useRef(null);
+  const waitingOfferRef = useRef(null); // { offer, caller } of the call waiting behind the current one
+  const outgoingCallRef = useRef(null); // { callId, user } of the last call we placed
+  const callIdRef = useRef(null); // call_id shared by every signalling frame of the current call
+  const callTypeRef = useRef(0); // 0 = audio, 1 = video, 2 = screen share
   const callStartTimeRef = useRef(null);
   const durationIntervalRef = useRef(null);
   const wakeLockRef = useRef(null);
@@ -224,9 +230,30 @@ export function useWebRTC(sendWSMessage) {
     }
 
     iceCandidateQueueRef.current = [];
+    callIdRef.current = null;
+    callTypeRef.current = 0;
     setIsMuted(false);
   }, [stopAllRingtones]);
 
+  // ============================================
+  // CALL WAITING
+  // ============================================
+  // Once the current call is over the server keeps the waiting call ringing in its place
+  const promoteWaitingCall = useCallback(() => {
+    const waiting = waitingOfferRef.current;
+    if (!waiting) return false;
+
+    waitingOfferRef.current = null;
+    setWaitingCall(null);
+    pendingOfferRef.current = waiting.offer;
+    callIdRef.current = waiting.offer.call_id;
+    setOtherUser(waiting.caller);
+    setCallState("ringing");
+    playIncomingRingtone();
+    toast(`Incoming call from ${waiting.caller.name}...`, { duration: 30000 });
+    return true;
+  }, [playIncomingRingtone]);
+
   // ============================================
   // END CALL
   // ============================================
@@ -234,11 +261,12 @@ export function useWebRTC(sendWSMessage) {
     console.log("📴 Ending call");
     toast("Call ended");
     
-    // Send call-end message to backend
+    // Hanging up before the callee answers cancels the call
     if (otherUser && user) {
       sendWSMessage({
-        type: "call-end",
+        type: callState === "calling" ? "call-cancel" : "call-end",
         payload: {
+          call_id: callIdRef.current,
           sender_id: user.id,
           receiver_id: otherUser.id,
         },
@@ -247,40 +275,119 @@ export function useWebRTC(sendWSMessage) {
     
     stopCallTimer();
     releaseWakeLock();
-    setCallState("idle");
-    setOtherUser(null);
     pendingOfferRef.current = null;
     cleanup();
-  }, [stopCallTimer, releaseWakeLock, cleanup, otherUser, user, sendWSMessage]);
+    if (!promoteWaitingCall()) {
+      setCallState("idle");
+      setOtherUser(null);
+    }
+  }, [stopCallTimer, releaseWakeLock, cleanup, promoteWaitingCall, otherUser, user, sendWSMessage, callState]);
+
+  // ============================================
+  // REMOTE CALL END
+  // ============================================
+  const handleRemoteCallEnd = useCallback((payload) => {
+    // The waiting caller gave up or nobody picked up in time
+    const waiting = waitingOfferRef.current;
+    if (waiting && payload.call_id === waiting.offer.call_id) {
+      toast(`Missed call from ${waiting.caller.name}`);
+      waitingOfferRef.current = null;
+      setWaitingCall(null);
+      return;
+    }
+
+    // Ignore call-end for a call we already left
+    if (payload.call_id && payload.call_id !== callIdRef.current) return;
+
+    // Nobody picked up our call; offer to leave a voicemail
+    if (payload.reason === "no_answer" && outgoingCallRef.current?.callId === payload.call_id) {
+      setVoicemailTarget(outgoingCallRef.current);
+    }
+
+    console.log("📴 Call ended by server:", payload.reason);
+    switch (payload.reason) {
+      case "declined":
+        toast("Call declined");
+        break;
+      case "cancelled":
+        toast("Missed call");
+        break;
+      case "no_answer":
+        toast("No answer");
+        break;
+      case "peer_disconnected":
+        toast.error("Call dropped");
+        break;
+      case "answered_elsewhere":
+        toast("Answered on another device");
+        break;
+      case "declined_elsewhere":
+        toast("Declined on another device");
+        break;
+      default:
+        toast("Call ended");
+    }
+
+    stopCallTimer();
+    releaseWakeLock();
+    pendingOfferRef.current = null;
+    cleanup();
+    if (!promoteWaitingCall()) {
+      setCallState("idle");
+      setOtherUser(null);
+    }
+  }, [stopCallTimer, releaseWakeLock, cleanup, promoteWaitingCall]);
+
+  // ============================================
+  // CALL ERROR
+  // ============================================
+  // An offer to an offline user never starts a call; tear down and offer a voicemail instead
+  const handleCallError = useCallback((payload) => {
+    if (payload.reason !== "user_offline" || payload.call_id !== callIdRef.current) return;
+
+    if (outgoingCallRef.current?.callId === payload.call_id) {
+      setVoicemailTarget(outgoingCallRef.current);
+    }
+    stopCallTimer();
+    releaseWakeLock();
+    cleanup();
+    setCallState("idle");
+    setOtherUser(null);
+  }, [stopCallTimer, releaseWakeLock, cleanup]);
+
+  const dismissVoicemail = useCallback(() => setVoicemailTarget(null), []);
 
   // ============================================
   // PEER CONNECTION
   // ============================================
+  // TURN credentials from the backend are short-lived, so they are fetched right before each call
+  const fetchIceServers = useCallback(async () => {
+    try {
+      const response = await apiCall(
+        `${process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080"}/api/calls/ice-servers`
+      );
+      if (response.ok) {
+        const data = await response.json();
+        if (data.ice_servers?.length > 0) return data.ice_servers;
+      }
+    } catch (error) {
+      console.error("❌ Error fetching ICE servers:", error);
+    }
+    return [{ urls: "stun:stun.l.google.com:19302" }];
+  }, [apiCall]);
+
   const initializePeerConnection = useCallback(
-    (targetUser) => {
+    (targetUser, iceServers) => {
       if (peerConnectionRef.current) return peerConnectionRef.current;
 
-      const pc = new RTCPeerConnection({
-        iceServers: [
-          { urls: "stun:stun.l.google.com:19302" },
-          {
-            urls: "turns:zibro.live:443?transport=tcp",
-            username: process.env.NEXT_PUBLIC_TURN_USERNAME,
-            credential: process.env.NEXT_PUBLIC_TURN_CREDENTIALS,
-          },
-          {
-            urls: "turn:zibro.live:3478?transport=tcp",
-            username: process.env.NEXT_PUBLIC_TURN_USERNAME,
-            credential: process.env.NEXT_PUBLIC_TURN_CREDENTIALS,
-          },
-        ],
-      });
+      const pc = new RTCPeerConnection({ iceServers });
 
       pc.onicecandidate = (event) => {
         if (event.candidate && targetUser) {
           sendWSMessage({
             type: "ice-candidate",
             payload: {
+              call_id: callIdRef.current,
               sender_id: user.id,
               receiver_id: targetUser.id,
               candidate: event.candidate.candidate,
@@ -339,14 +446,16 @@ export function useWebRTC(sendWSMessage) {
   const startCall = useCallback(
     async (friend) => {
       try {
+        callIdRef.current = crypto.randomUUID();
+        outgoingCallRef.current = { callId: callIdRef.current, user: friend };
         setOtherUser(friend);
         setCallState("calling");
         toast(`Calling ${friend.name}...`);
 
         playOutgoingRingtone();
 
-        const stream = await getLocalStream();
-        const pc = initializePeerConnection(friend);
+        const [stream, iceServers] = await Promise.all([getLocalStream(), fetchIceServers()]);
+        const pc = initializePeerConnection(friend, iceServers);
         stream.getTracks().forEach((track) => pc.addTrack(track, stream));
 
         const offer = await pc.createOffer();
@@ -355,6 +464,7 @@ export function useWebRTC(sendWSMessage) {
         sendWSMessage({
           type: "call-offer",
           payload: {
+            call_id: callIdRef.current,
             call_type: 0,
             sdp_type: 0,
             sender_id: user.id,
@@ -369,7 +479,7 @@ export function useWebRTC(sendWSMessage) {
         cleanup();
       }
     },
-    [user, getLocalStream, initializePeerConnection, sendWSMessage, playOutgoingRingtone, cleanup]
+    [user, getLocalStream, fetchIceServers, initializePeerConnection, sendWSMessage, playOutgoingRingtone, cleanup]
   );
 
   // ============================================
@@ -383,8 +493,8 @@ export function useWebRTC(sendWSMessage) {
     toast("Connecting...");
 
     const offer = pendingOfferRef.current;
-    const stream = await getLocalStream();
-    const pc = initializePeerConnection({ id: offer.sender_id, name: otherUser?.name });
+    const [stream, iceServers] = await Promise.all([getLocalStream(), fetchIceServers()]);
+    const pc = initializePeerConnection({ id: offer.sender_id, name: otherUser?.name }, iceServers);
 
     stream.getTracks().forEach((track) => pc.addTrack(track, stream));
     await pc.setRemoteDescription(new RTCSessionDescription({ type: "offer", sdp: offer.sdp_string }));
@@ -399,6 +509,7 @@ export function useWebRTC(sendWSMessage) {
     sendWSMessage({
       type: "call-answer",
       payload: {
+        call_id: offer.call_id,
         call_type: 0,
         sdp_type: 1,
         sender_id: user.id,
@@ -409,16 +520,17 @@ export function useWebRTC(sendWSMessage) {
     });
 
     pendingOfferRef.current = null;
-  }, [user, getLocalStream, initializePeerConnection, sendWSMessage, otherUser, stopAllRingtones]);
+  }, [user, getLocalStream, fetchIceServers, initializePeerConnection, sendWSMessage, otherUser, stopAllRingtones]);
 
   const declineCall = useCallback(() => {
     toast("Call declined");
     
-    // Send call-end message to backend
+    // Send call-decline message to backend
     if (otherUser && user) {
       sendWSMessage({
-        type: "call-end",
+        type: "call-decline",
         payload: {
+          call_id: callIdRef.current,
           sender_id: user.id,
           receiver_id: otherUser.id,
         },
@@ -426,10 +538,46 @@ export function useWebRTC(sendWSMessage) {
     }
     
     pendingOfferRef.current = null;
-    setCallState("idle");
-    setOtherUser(null);
     cleanup();
-  }, [cleanup, otherUser, user, sendWSMessage]);
+    if (!promoteWaitingCall()) {
+      setCallState("idle");
+      setOtherUser(null);
+    }
+  }, [cleanup, promoteWaitingCall, otherUser, user, sendWSMessage]);
+
+  // Answering the waiting call makes the server hang up the current one
+  const acceptWaitingCall = useCallback(async () => {
+    const waiting = waitingOfferRef.current;
+    if (!waiting) return;
+
+    waitingOfferRef.current = null;
+    setWaitingCall(null);
+    stopCallTimer();
+    releaseWakeLock();
+    cleanup();
+
+    pendingOfferRef.current = waiting.offer;
+    callIdRef.current = waiting.offer.call_id;
+    setOtherUser(waiting.caller);
+    await answerCall();
+  }, [stopCallTimer, releaseWakeLock, cleanup, answerCall]);
+
+  const declineWaitingCall = useCallback(() => {
+    const waiting = waitingOfferRef.current;
+    if (!waiting || !user) return;
+
+    sendWSMessage({
+      type: "call-decline",
+      payload: {
+        call_id: waiting.offer.call_id,
+        sender_id: user.id,
+        receiver_id: waiting.caller.id,
+      },
+    });
+    toast(`Declined call from ${waiting.caller.name}`);
+    waitingOfferRef.current = null;
+    setWaitingCall(null);
+  }, [user, sendWSMessage]);
 
   // ============================================
   // TOGGLE MUTE
@@ -448,28 +596,47 @@ export function useWebRTC(sendWSMessage) {
   // ============================================
   // INCOMING OFFER
   // ============================================
-  const handleIncomingOffer = useCallback(
-    async (payload) => {
-      let senderName = "Unknown User";
+  const fetchSenderName = useCallback(
+    async (senderId) => {
       try {
         const response = await apiCall(
-          `${process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080"}/api/user/get-name?id=${payload.sender_id}`
+          `${process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080"}/api/user/get-name?id=${senderId}`
         );
         if (response.ok) {
           const data = await response.json();
-          if (data.exists && data.name) senderName = data.name;
+          if (data.exists && data.name) return data.name;
         }
       } catch (error) {
         console.error("Error fetching sender name:", error);
       }
+      return "Unknown User";
+    },
+    [apiCall]
+  );
+
+  const handleIncomingOffer = useCallback(
+    async (payload) => {
+      const senderName = await fetchSenderName(payload.sender_id);
 
       pendingOfferRef.current = payload;
+      callIdRef.current = payload.call_id;
       setOtherUser({ id: payload.sender_id, name: senderName });
       setCallState("ringing");
       playIncomingRingtone();
       toast(`Incoming call from ${senderName}...`, { duration: 30000 });
     },
-    [apiCall, playIncomingRingtone]
+    [fetchSenderName, playIncomingRingtone]
+  );
+
+  // A second call while this device is busy; it rings quietly until accepted or declined
+  const handleCallWaiting = useCallback(
+    async (payload) => {
+      const caller = { id: payload.sender_id, name: await fetchSenderName(payload.sender_id) };
+      waitingOfferRef.current = { offer: payload, caller };
+      setWaitingCall({ ...caller, call_id: payload.call_id });
+      toast(`${caller.name} is calling...`, { icon: "📞", duration: 10000 });
+    },
+    [fetchSenderName]
   );
 
   // ============================================
@@ -492,6 +659,72 @@ export function useWebRTC(sendWSMessage) {
     [endCall]
   );
 
+  // ============================================
+  // RENEGOTIATION
+  // ============================================
+  // Sends a new offer mid-call, e.g. after adding a video or screen track (callType 1 or 2)
+  // or with { iceRestart: true } to recover a broken connection
+  const renegotiate = useCallback(
+    async (callType = callTypeRef.current, options = {}) => {
+      const pc = peerConnectionRef.current;
+      if (!pc || !otherUser || !user) return;
+
+      const offer = await pc.createOffer({ iceRestart: !!options.iceRestart });
+      await pc.setLocalDescription(offer);
+
+      sendWSMessage({
+        type: "call-renegotiate",
+        payload: {
+          call_id: callIdRef.current,
+          call_type: callType,
+          sdp_type: 0,
+          sender_id: user.id,
+          receiver_id: otherUser.id,
+          sdp_string: offer.sdp,
+          time: new Date().toISOString(),
+        },
+      });
+    },
+    [otherUser, user, sendWSMessage]
+  );
+
+  const handleIncomingRenegotiate = useCallback(
+    async (payload) => {
+      const pc = peerConnectionRef.current;
+      if (!pc || payload.call_id !== callIdRef.current) return;
+
+      if (payload.sdp_type === 1) {
+        // Our offer was accepted
+        await pc.setRemoteDescription(
+          new RTCSessionDescription({ type: "answer", sdp: payload.sdp_string })
+        );
+        callTypeRef.current = payload.call_type;
+        return;
+      }
+
+      await pc.setRemoteDescription(
+        new RTCSessionDescription({ type: "offer", sdp: payload.sdp_string })
+      );
+      const answer = await pc.createAnswer();
+      await pc.setLocalDescription(answer);
+      callTypeRef.current = payload.call_type;
+
+      sendWSMessage({
+        type: "call-renegotiate",
+        payload: {
+          call_id: callIdRef.current,
+          call_type: payload.call_type,
+          sdp_type: 1,
+          sender_id: user.id,
+          receiver_id: payload.sender_id,
+          sdp_string: answer.sdp,
+          time: new Date().toISOString(),
+        },
+      });
+    },
+    [user, sendWSMessage]
+  );
+
   // ============================================
   // ICE CANDIDATE
   // ============================================
@@ -530,14 +763,24 @@ export function useWebRTC(sendWSMessage) {
     otherUser,
     isMuted,
     callDuration,
+    waitingCall,
+    voicemailTarget,
     remoteAudioRef,
     startCall,
     answerCall,
     declineCall,
     endCall,
+    acceptWaitingCall,
+    declineWaitingCall,
     toggleMute,
+    dismissVoicemail,
+    handleCallError,
+    handleRemoteCallEnd,
     handleIncomingOffer,
+    handleCallWaiting,
     handleIncomingAnswer,
     handleIncomingIceCandidate,
+    renegotiate,
+    handleIncomingRenegotiate,
   };
 }
\ No newline at end of file